@@ -0,0 +1,72 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/nmcclain/picolytics/picolytics"
+	"github.com/spf13/pflag"
+)
+
+// importLogs implements the import-logs subcommand, which imports pageviews from web
+// server access logs given as arguments. Logs ending in .gz are decompressed.
+//
+//	picolytics import-logs -c config.yaml --format combined --domain example.com access.log.2.gz access.log.1
+func importLogs() {
+	format := pflag.String("format", "combined", "Access log format: common, combined, or json (nginx escape=json)")
+	domain := pflag.String("domain", "", "Site domain for the logs, required unless the log format includes the host")
+	config, _, err := getConfig()
+	if err != nil {
+		log.Fatalf("Config error: %v", err)
+	}
+	files := pflag.Args()
+	if len(files) < 1 {
+		log.Fatalf("Usage: picolytics import-logs [flags] <logfile>...")
+	}
+	importer, err := picolytics.NewLogImporter(config, *format, *domain, nil, nil)
+	if err != nil {
+		log.Fatalf("Initialization error: %v", err)
+	}
+	defer importer.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	for _, file := range files {
+		if err := importFile(ctx, importer, file); err != nil {
+			log.Printf("Import error: %v", err)
+			break
+		}
+	}
+	s := importer.Stats
+	log.Printf("Read %d lines: imported %d pageviews, skipped %d static, %d bots, %d other, %d invalid",
+		s.Lines, s.Imported, s.Static, s.Bots, s.Skipped, s.Invalid)
+}
+
+func importFile(ctx context.Context, importer *picolytics.LogImporter, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(file, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+	log.Printf("Importing %s", file)
+	if err := importer.Import(ctx, r); err != nil {
+		return fmt.Errorf("%s: %v", file, err)
+	}
+	return nil
+}
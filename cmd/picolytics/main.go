@@ -2,6 +2,7 @@ package main
 
 import (
 	"log"
+	"os"
 
 	"github.com/nmcclain/picolytics/picolytics"
 
@@ -9,6 +10,11 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "import-logs" {
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+		importLogs()
+		return
+	}
 	config, warnings, err := getConfig()
 	if err != nil {
 		log.Fatalf("Config error: %v", err)
@@ -1 +1 @@
-(function(){"use strict";const parts=window.document.currentScript.src.split("/");const endpoint=parts[0]+"//"+parts[2]+"/p";function sendMetrics(eventType){if(navigator.doNotTrack||document.visibilityState!=="visible")return;navigator.sendBeacon(endpoint,prepEvent(eventType))}const wpt=window.performance.timing;function prepEvent(eventType){return JSON.stringify({n:eventType,l:window.location.href,r:document.referrer,lt:Math.max(0,wpt.loadEventEnd-wpt.navigationStart),fb:Math.max(0,wpt.responseStart-wpt.navigationStart),sw:screen.width,sh:screen.height,tz:Intl.DateTimeFormat().resolvedOptions().timeZone,pr:window.devicePixelRatio,pd:window.screen.pixelDepth})}document.addEventListener("visibilitychange",()=>{sendMetrics(document.visibilityState)});window.addEventListener("popstate",()=>sendMetrics("popstate"));window.addEventListener("hashchange",()=>sendMetrics("hashchange"));window.addEventListener("load",()=>{sendMetrics("load");setInterval(()=>{sendMetrics("ping")},5e3)})})();
\ No newline at end of file
+(function(){"use strict";const a=window.document.currentScript.src.split("/"),W=window,D=document,N=navigator,L=W.location,y=D.currentScript.dataset,A=y.api||"/p",b=A.indexOf("//")>=0?A:a[0]+"//"+a[2]+A,P=Number(y.ping)||0,T=y.dnt!=="false",H=y.hash==="true",I=y.localhost==="false",X=(y.exclude||"").split(",").filter(g=>g.trim()).map(g=>new RegExp("^"+g.trim().replace(/[.+?^${}()|[\]\\]/g,"\\$&").replace(/\*\*/g,"\0").replace(/\*/g,"[^/]*").replace(/\0/g,".*")+"$")),w=W.performance.timing,v={};let c=0,f=0,l=0,d=!1;function C(){return L.pathname+(H?L.hash:"")}function k(p=C()){if(T&&N.doNotTrack)return!1;if(I&&/^(localhost|127\.0\.0\.1|\[::1\])$/.test(L.hostname))return!1;return!X.some(r=>r.test(p))}function s(t,p,x){if(!k()||D.visibilityState!=="visible")return;N.sendBeacon(b,m(t,p,x))}function m(t,p,x){return JSON.stringify(Object.assign({n:t,l:L.href,r:D.referrer,lt:Math.max(0,w.loadEventEnd-w.navigationStart),fb:Math.max(0,w.responseStart-w.navigationStart),sw:screen.width,sh:screen.height,tz:Intl.DateTimeFormat().resolvedOptions().timeZone,pr:W.devicePixelRatio,pd:W.screen.pixelDepth,p:p,d:y.domain,h:H||void 0},x))}function o(t,k,x){try{new PerformanceObserver(i=>i.getEntries().forEach(k)).observe(Object.assign({type:t,buffered:!0},x));return!0}catch(e){return!1}}o("paint",e=>{if(e.name==="first-contentful-paint")v.fcp=Math.round(e.startTime)});o("largest-contentful-paint",e=>{v.lcp=Math.round(e.startTime)});if(o("layout-shift",e=>{if(e.hadRecentInput)return;if(e.startTime-l>1e3||e.startTime-f>5e3){c=0;f=e.startTime}c+=e.value;l=e.startTime;v.cls=Math.max(v.cls,c)}))v.cls=0;o("event",e=>{if(e.interactionId)v.inp=Math.max(v.inp||0,Math.round(e.duration))},{durationThreshold:40});function h(){if(d||!k()||Object.keys(v).length===0)return;d=!0;N.sendBeacon(b,m("vitals",void 0,v))}let G=0,J=0,K=0;function U(){const t=Date.now();if(K>0)G+=Math.max(0,Math.min(t,K)-J);J=t;K=D.visibilityState==="visible"?t+3e4:0}let S=0,F=!1;function M(){const t=D.documentElement.scrollHeight;if(t>0)S=Math.max(S,Math.min(100,Math.round((W.scrollY+W.innerHeight)/t*100)))}function R(u,p){U();const x={l:u,em:G};G=0;if(!F&&S>0){x.sd=S;F=!0}if(x.em<1&&!x.sd||!k(p))return;N.sendBeacon(b,m("engagement",void 0,x))}U();["pointerdown","keydown","scroll","mousemove","touchstart"].forEach(t=>W.addEventListener(t,U,{passive:!0}));W.addEventListener("scroll",M,{passive:!0});function B(){M();R(L.href);h()}D.addEventListener("visibilitychange",()=>{s(D.visibilityState);if(D.visibilityState==="hidden")B();else U()});W.addEventListener("pagehide",B);let g=L.href,q=C();function n(){const r=g;g=L.href;if(C()===q)return;R(r,q);S=0;F=!1;Q={};q=C();s("pageview",void 0,{r:r})}["pushState","replaceState"].forEach(k=>{const u=history[k];history[k]=function(){const r=u.apply(this,arguments);n();return r}});W.addEventListener("popstate",()=>{s("popstate");n()});W.addEventListener("hashchange",()=>{s("hashchange");if(H)n()});const O=y.outbound==="true",E=(y.downloads==="true"?"pdf,zip,gz,dmg,exe,msi,pkg,csv,xls,xlsx,doc,docx,ppt,pptx,mp3,mp4":y.downloads||"").split(",").map(x=>x.trim().toLowerCase()).filter(x=>x);function z(e){if(e.type==="auxclick"&&e.button!==1)return;const u=e.target.closest&&e.target.closest("a[href]");if(!u||!/^https?:$/.test(u.protocol))return;if(E.indexOf(u.pathname.split(".").pop().toLowerCase())>=0)s("download",void 0,{tg:u.href});else if(O&&u.hostname!==L.hostname)s("outbound",void 0,{tg:u.href})}if(O||E.length>0){D.addEventListener("click",z);D.addEventListener("auxclick",z)}let Q={};function j(e,u,l,c,t){const x=[e,u,l,c].join(":");if(Q[x])return;Q[x]=!0;s("error",void 0,{msg:String(e).slice(0,512),src:u||"",ln:l||0,col:c||0,stk:String(t||"").slice(0,2048)})}if(y.errors==="true"){W.addEventListener("error",e=>{if(e.message)j(e.message,e.filename,e.lineno,e.colno,e.error&&e.error.stack)});W.addEventListener("unhandledrejection",e=>{const r=e.reason||{};j("Unhandled rejection: "+(r.message||r),"",0,0,r.stack)})}W.addEventListener("load",()=>{s("load");M();if(P>0)setInterval(()=>{s("ping")},P*1e3)});W.pico=function(t,p){s(t,p)}})();
\ No newline at end of file
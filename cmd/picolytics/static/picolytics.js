@@ -2,16 +2,38 @@
   "use strict";
 
   const parts = window.document.currentScript.src.split("/");
-  const endpoint = parts[0] + "//" + parts[2] + "/p";
+  // settings from the script tag's data attributes, e.g.
+  // <script src="https://example.com/pico.js" data-ping="off" data-exclude="/admin/**"></script>
+  const data = window.document.currentScript.dataset;
+  const api = data.api || "/p"; // a path on the script's host, or a full URL
+  const endpoint = api.indexOf("//") >= 0 ? api : parts[0] + "//" + parts[2] + api;
+  const pingSeconds = Number(data.ping) || 0; // pings are opt-in, engagement time replaces them
+  const honorDNT = data.dnt !== "false";
+  const hashRoutes = data.hash === "true";
+  const ignoreLocalhost = data.localhost === "false";
+  // path globs: "*" matches within a path segment, "**" matches across segments
+  const excluded = (data.exclude || "").split(",").filter((glob) => glob.trim()).map((glob) =>
+    new RegExp("^" + glob.trim().replace(/[.+?^${}()|[\]\\]/g, "\\$&")
+      .replace(/\*\*/g, "\0").replace(/\*/g, "[^/]*").replace(/\0/g, ".*") + "$"));
 
-  function sendMetrics(eventType) {
-    if (navigator.doNotTrack || document.visibilityState !== "visible") return;
-    navigator.sendBeacon(endpoint, prepEvent(eventType));
+  function currentPath() {
+    return window.location.pathname + (hashRoutes ? window.location.hash : "");
+  }
+
+  function tracking(path = currentPath()) {
+    if (honorDNT && navigator.doNotTrack) return false;
+    if (ignoreLocalhost && /^(localhost|127\.0\.0\.1|\[::1\])$/.test(window.location.hostname)) return false;
+    return !excluded.some((re) => re.test(path));
+  }
+
+  function sendMetrics(eventType, props, extra) {
+    if (!tracking() || document.visibilityState !== "visible") return;
+    navigator.sendBeacon(endpoint, prepEvent(eventType, props, extra));
   }
 
   const wpt = window.performance.timing;
-  function prepEvent(eventType) {
-    return JSON.stringify({
+  function prepEvent(eventType, props, extra) {
+    return JSON.stringify(Object.assign({
       n: eventType,
       l: window.location.href,
       r: document.referrer,
@@ -22,19 +44,183 @@
       tz: Intl.DateTimeFormat().resolvedOptions().timeZone,
       pr: window.devicePixelRatio,
       pd: window.screen.pixelDepth,
-    });
+      p: props,
+      d: data.domain,
+      h: hashRoutes || undefined,
+    }, extra));
+  }
+
+  // web vitals are collected with PerformanceObserver, and sent once in a "vitals" event
+  // when the page is first hidden. Unsupported vitals are omitted.
+  const vitals = {};
+  function observe(type, callback, opts) {
+    try {
+      new PerformanceObserver((list) => list.getEntries().forEach(callback))
+        .observe(Object.assign({ type: type, buffered: true }, opts));
+      return true;
+    } catch (e) {
+      return false;
+    }
   }
+  observe("paint", (e) => {
+    if (e.name === "first-contentful-paint") vitals.fcp = Math.round(e.startTime);
+  });
+  observe("largest-contentful-paint", (e) => { vitals.lcp = Math.round(e.startTime); });
+  // CLS is the largest burst of shifts: less than 1s apart, within a 5s window
+  let clsBurst = 0, clsFirst = 0, clsLast = 0;
+  if (observe("layout-shift", (e) => {
+    if (e.hadRecentInput) return;
+    if (e.startTime - clsLast > 1000 || e.startTime - clsFirst > 5000) {
+      clsBurst = 0;
+      clsFirst = e.startTime;
+    }
+    clsBurst += e.value;
+    clsLast = e.startTime;
+    vitals.cls = Math.max(vitals.cls, clsBurst);
+  })) vitals.cls = 0;
+  // INP is approximated by the slowest interaction
+  observe("event", (e) => {
+    if (e.interactionId) vitals.inp = Math.max(vitals.inp || 0, Math.round(e.duration));
+  }, { durationThreshold: 40 });
+
+  let vitalsSent = false;
+  function sendVitals() {
+    if (vitalsSent || !tracking() || Object.keys(vitals).length === 0) return;
+    vitalsSent = true;
+    navigator.sendBeacon(endpoint, prepEvent("vitals", undefined, vitals));
+  }
+
+  // engagement time is the time the page is visible, until 30s after the last input. It's
+  // reported in an "engagement" event when the page is hidden, or on navigation to a new path.
+  let engagedMs = 0, activeFrom = 0, activeUntil = 0;
+  function engage() {
+    const now = Date.now();
+    if (activeUntil > 0) engagedMs += Math.max(0, Math.min(now, activeUntil) - activeFrom);
+    activeFrom = now;
+    activeUntil = document.visibilityState === "visible" ? now + 30000 : 0;
+  }
+  // scroll depth is the furthest percent of the page seen, sent with the page's first engagement report
+  let scrollDepth = 0, scrollSent = false;
+  function scrolled() {
+    const height = document.documentElement.scrollHeight;
+    if (height > 0) {
+      scrollDepth = Math.max(scrollDepth, Math.min(100, Math.round((window.scrollY + window.innerHeight) / height * 100)));
+    }
+  }
+  function reportEngagement(href, path) {
+    engage();
+    const extra = { l: href, em: engagedMs };
+    engagedMs = 0;
+    if (!scrollSent && scrollDepth > 0) {
+      extra.sd = scrollDepth;
+      scrollSent = true;
+    }
+    if ((extra.em < 1 && !extra.sd) || !tracking(path)) return;
+    navigator.sendBeacon(endpoint, prepEvent("engagement", undefined, extra));
+  }
+  engage();
+  ["pointerdown", "keydown", "scroll", "mousemove", "touchstart"].forEach((type) => {
+    window.addEventListener(type, engage, { passive: true });
+  });
+  window.addEventListener("scroll", scrolled, { passive: true });
 
+  function pageHidden() {
+    scrolled();
+    reportEngagement(window.location.href);
+    sendVitals();
+  }
   document.addEventListener("visibilitychange", () => {
     sendMetrics(document.visibilityState);
+    if (document.visibilityState === "hidden") {
+      pageHidden();
+    } else {
+      engage();
+    }
+  });
+  window.addEventListener("pagehide", pageHidden);
+  // single-page apps navigate with the History API, or the hash with data-hash="true":
+  // each new path is a "pageview" event, with the previous page as the referrer
+  let lastPage = window.location.href;
+  let lastPath = currentPath();
+  function navigated() {
+    const referrer = lastPage;
+    lastPage = window.location.href;
+    if (currentPath() === lastPath) return;
+    reportEngagement(referrer, lastPath);
+    scrollDepth = 0;
+    scrollSent = false;
+    errorsSeen = {};
+    lastPath = currentPath();
+    sendMetrics("pageview", undefined, { r: referrer });
+  }
+  ["pushState", "replaceState"].forEach((method) => {
+    const original = history[method];
+    history[method] = function () {
+      const result = original.apply(this, arguments);
+      navigated();
+      return result;
+    };
+  });
+  window.addEventListener("popstate", () => {
+    sendMetrics("popstate");
+    navigated();
   });
-  window.addEventListener("popstate", () => sendMetrics("popstate"));
-  window.addEventListener("hashchange", () => sendMetrics("hashchange"));
+  window.addEventListener("hashchange", () => {
+    sendMetrics("hashchange");
+    if (hashRoutes) navigated();
+  });
+  // outbound link and download clicks are opt-in, with data-outbound="true", and
+  // data-downloads="true" or a CSV list of file extensions
+  const outbound = data.outbound === "true";
+  const downloads = (data.downloads === "true" ? "pdf,zip,gz,dmg,exe,msi,pkg,csv,xls,xlsx,doc,docx,ppt,pptx,mp3,mp4" : data.downloads || "")
+    .split(",").map((ext) => ext.trim().toLowerCase()).filter((ext) => ext);
+  function linkClicked(e) {
+    if (e.type === "auxclick" && e.button !== 1) return; // middle clicks only
+    const link = e.target.closest && e.target.closest("a[href]");
+    if (!link || !/^https?:$/.test(link.protocol)) return;
+    if (downloads.indexOf(link.pathname.split(".").pop().toLowerCase()) >= 0) {
+      sendMetrics("download", undefined, { tg: link.href });
+    } else if (outbound && link.hostname !== window.location.hostname) {
+      sendMetrics("outbound", undefined, { tg: link.href });
+    }
+  }
+  if (outbound || downloads.length > 0) {
+    document.addEventListener("click", linkClicked);
+    document.addEventListener("auxclick", linkClicked);
+  }
+
+  // javascript errors are opt-in, with data-errors="true": each distinct error is sent
+  // once per page in an "error" event
+  let errorsSeen = {};
+  function errorOccurred(message, source, line, col, stack) {
+    const key = [message, source, line, col].join(":");
+    if (errorsSeen[key]) return;
+    errorsSeen[key] = true;
+    sendMetrics("error", undefined, {
+      msg: String(message).slice(0, 512),
+      src: source || "",
+      ln: line || 0,
+      col: col || 0,
+      stk: String(stack || "").slice(0, 2048),
+    });
+  }
+  if (data.errors === "true") {
+    window.addEventListener("error", (e) => {
+      if (e.message) errorOccurred(e.message, e.filename, e.lineno, e.colno, e.error && e.error.stack);
+    });
+    window.addEventListener("unhandledrejection", (e) => {
+      const reason = e.reason || {};
+      errorOccurred("Unhandled rejection: " + (reason.message || reason), "", 0, 0, reason.stack);
+    });
+  }
+
   window.addEventListener("load", () => {
     sendMetrics("load");
-    setInterval(() => { sendMetrics("ping"); }, 5000);
+    scrolled();
+    if (pingSeconds > 0) setInterval(() => { sendMetrics("ping"); }, pingSeconds * 1000);
   });
 
-  // expose a global function to send metrics:
-  // window.pico = function (eventName) { sendMetrics(eventName); };
+  // expose a global function to send custom events, with optional properties:
+  // window.pico("signup", { plan: "pro", value: 49 });
+  window.pico = function (eventName, props) { sendMetrics(eventName, props); };
 })();
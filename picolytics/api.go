@@ -15,7 +15,6 @@ import (
 	"github.com/labstack/echo/v4/middleware"
 	slogecho "github.com/nmcclain/slog-echo"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"golang.org/x/time/rate"
 )
 
 type EchoAPI struct {
@@ -48,11 +47,17 @@ func NewEchoAPI(config *Config, o11y *PicolyticsO11y) (EchoAPI, error) {
 	}
 	api.E.Use(slogecho.NewWithConfig(o11y.Logger, slogCfg))
 
-	// see: https://echo.labstack.com/docs/middleware/rate-limiter
-	// The default in-memory implementation is focused on correctness and may not be the best option for a high number of concurrent requests or a large number of different identifiers (>16k).
-	if config.RequestRateLimit > 0 { // allow disabling rate limiter
+	if store := newRateLimiter(config.RequestRateLimit); store != nil {
 		api.E.Use(middleware.RateLimiterWithConfig(middleware.RateLimiterConfig{
-			Store: middleware.NewRateLimiterMemoryStore(rate.Limit(config.RequestRateLimit)),
+			// events are rate limited by site, in the tracker handler, or by API key
+			Skipper: func(c echo.Context) bool {
+				switch c.Path() {
+				case "/p", "/p.gif", "/p.png", "/api/v1/events":
+					return true
+				}
+				return false
+			},
+			Store: store,
 			DenyHandler: func(context echo.Context, identifier string, err error) error {
 				o11y.Metrics.rateLimiterDrops.Inc()
 				o11y.Logger.Debug("rate limit exceeded", "identifier", identifier, "error", err)
@@ -64,7 +69,8 @@ func NewEchoAPI(config *Config, o11y *PicolyticsO11y) (EchoAPI, error) {
 			},
 		}))
 	}
-	api.E.Use(middleware.CORS()) // https://echo.labstack.com/docs/middleware/cors#default-configuration
+	// https://echo.labstack.com/docs/middleware/cors#default-configuration
+	api.E.Use(middleware.CORSWithConfig(middleware.CORSConfig{AllowOrigins: allCorsOrigins(config)}))
 
 	if err := proxySetup(api.E, config, o11y); err != nil {
 		return api, fmt.Errorf("error setting up proxy: %v", err)
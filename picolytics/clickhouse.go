@@ -0,0 +1,237 @@
+package picolytics
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/cespare/xxhash"
+)
+
+//go:embed clickhouse/events.sql
+var clickhouseSchema string
+
+// ClickHouseWriter writes each batch of enriched events to a ClickHouse events table, over
+// the HTTP interface. Sessions and salt stay in the event store, which can skip saving events
+// with clickhouseEventsOnly.
+type ClickHouseWriter struct {
+	url      string // HTTP interface, e.g. http://localhost:8123
+	database string
+	user     string
+	password string
+	retries  int
+	client   *http.Client
+	o11y     *PicolyticsO11y
+}
+
+func NewClickHouseWriter(config *Config, o11y *PicolyticsO11y) (*ClickHouseWriter, error) {
+	w := ClickHouseWriter{
+		url:      strings.TrimSuffix(config.ClickhouseURL, "/"),
+		database: config.ClickhouseDatabase,
+		user:     config.ClickhouseUser,
+		password: config.ClickhousePassword,
+		retries:  config.ClickhouseRetries,
+		client:   &http.Client{Timeout: 30 * time.Second},
+		o11y:     o11y,
+	}
+	ctx := context.Background()
+	if err := w.exec(ctx, clickhouseSchema, nil, nil); err != nil {
+		return nil, fmt.Errorf("error creating clickhouse schema: %v", err)
+	}
+	// columns added since the table was first created
+	for _, column := range clickhouseAddedColumns {
+		if err := w.exec(ctx, "ALTER TABLE events ADD COLUMN IF NOT EXISTS "+column, nil, nil); err != nil {
+			return nil, fmt.Errorf("error updating clickhouse schema: %v", err)
+		}
+	}
+	// whole partitions are dropped once all their rows expire
+	ttl := "ALTER TABLE events REMOVE TTL"
+	if config.PruneDays > 0 {
+		ttl = fmt.Sprintf("ALTER TABLE events MODIFY TTL toDate(created_at) + INTERVAL %d DAY", config.PruneDays)
+	}
+	if err := w.exec(ctx, ttl, nil, nil); err != nil && config.PruneDays > 0 {
+		return nil, fmt.Errorf("error setting clickhouse TTL: %v", err)
+	}
+	return &w, nil
+}
+
+var clickhouseAddedColumns = []string{
+	"lcp Nullable(Int32) AFTER ttfb",
+	"cls Nullable(Float64) AFTER lcp",
+	"inp Nullable(Int32) AFTER cls",
+	"fcp Nullable(Int32) AFTER inp",
+	"target String AFTER fcp",
+	"engaged_ms Int32 AFTER target",
+	"scroll_depth Nullable(Int32) AFTER engaged_ms",
+}
+
+// clickhouseEvent is a row in the events table
+type clickhouseEvent struct {
+	CreatedAt      string   `json:"created_at"`
+	Domain         string   `json:"domain"`
+	Name           string   `json:"name"`
+	Path           string   `json:"path"`
+	Referrer       string   `json:"referrer"`
+	VisitorID      string   `json:"visitor_id"`
+	LoadTime       int32    `json:"load_time"`
+	TTFB           int32    `json:"ttfb"`
+	LCP            *int32   `json:"lcp"`
+	CLS            *float64 `json:"cls"`
+	INP            *int32   `json:"inp"`
+	FCP            *int32   `json:"fcp"`
+	Target         string   `json:"target"`
+	EngagedMs      int32    `json:"engaged_ms"`
+	ScrollDepth    *int32   `json:"scroll_depth"`
+	Props          string   `json:"props"`
+	Country        string   `json:"country"`
+	Subdivision    string   `json:"subdivision"`
+	City           string   `json:"city"`
+	Latitude       float64  `json:"latitude"`
+	Longitude      float64  `json:"longitude"`
+	Browser        string   `json:"browser"`
+	BrowserVersion string   `json:"browser_version"`
+	Os             string   `json:"os"`
+	OsVersion      string   `json:"os_version"`
+	Platform       string   `json:"platform"`
+	DeviceType     string   `json:"device_type"`
+	Bot            bool     `json:"bot"`
+	ScreenW        int32    `json:"screen_w"`
+	ScreenH        int32    `json:"screen_h"`
+	Timezone       string   `json:"timezone"`
+	PixelRatio     float64  `json:"pixel_ratio"`
+	PixelDepth     int32    `json:"pixel_depth"`
+	UtmSource      string   `json:"utm_source"`
+	UtmMedium      string   `json:"utm_medium"`
+	UtmCampaign    string   `json:"utm_campaign"`
+	UtmContent     string   `json:"utm_content"`
+	UtmTerm        string   `json:"utm_term"`
+}
+
+const clickhouseTimeLayout = "2006-01-02 15:04:05.000"
+
+// writeEvents inserts a batch, retrying with backoff. Retries of a batch have the same
+// deduplication token, so a batch is never inserted twice, even if the worker retries it.
+func (w *ClickHouseWriter) writeEvents(ctx context.Context, events []PicolyticsEvent) error {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, e := range events {
+		props := ""
+		if e.Props != nil {
+			b, err := json.Marshal(e.Props)
+			if err != nil {
+				return fmt.Errorf("error encoding clickhouse event: %v", err)
+			}
+			props = string(b)
+		}
+		if err := enc.Encode(clickhouseEvent{
+			CreatedAt:      e.Created.UTC().Format(clickhouseTimeLayout),
+			Domain:         e.Domain,
+			Name:           e.Name,
+			Path:           e.Path,
+			Referrer:       e.Referrer,
+			VisitorID:      e.VisitorID,
+			LoadTime:       e.LoadTime,
+			TTFB:           e.TTFB,
+			LCP:            e.LCP,
+			CLS:            e.CLS,
+			INP:            e.INP,
+			FCP:            e.FCP,
+			Target:         e.Target,
+			EngagedMs:      e.EngagedMs,
+			ScrollDepth:    e.ScrollDepth,
+			Props:          props,
+			Country:        e.Country,
+			Subdivision:    e.Subdivision,
+			City:           e.City,
+			Latitude:       e.Latitude,
+			Longitude:      e.Longitude,
+			Browser:        e.Browser,
+			BrowserVersion: e.BrowserVersion,
+			Os:             e.Os,
+			OsVersion:      e.OsVersion,
+			Platform:       e.Platform,
+			DeviceType:     e.DeviceType,
+			Bot:            e.Bot,
+			ScreenW:        e.ScreenW,
+			ScreenH:        e.ScreenH,
+			Timezone:       e.Timezone,
+			PixelRatio:     e.PixelRatio,
+			PixelDepth:     e.PixelDepth,
+			UtmSource:      e.UtmSource,
+			UtmMedium:      e.UtmMedium,
+			UtmCampaign:    e.UtmCampaign,
+			UtmContent:     e.UtmContent,
+			UtmTerm:        e.UtmTerm,
+		}); err != nil {
+			return fmt.Errorf("error encoding clickhouse event: %v", err)
+		}
+	}
+	params := url.Values{"insert_deduplication_token": {fmt.Sprintf("%x", xxhash.Sum64(body.Bytes()))}}
+	data := body.Bytes()
+
+	var err error
+	for attempt := 0; ; attempt++ {
+		err = w.exec(ctx, "INSERT INTO events FORMAT JSONEachRow", params, data)
+		if err == nil {
+			return nil
+		}
+		if _, ok := err.(clickhouseClientError); ok || attempt >= w.retries {
+			return fmt.Errorf("error writing events to clickhouse: %w", err)
+		}
+		backoff := backoffWithJitter(attempt)
+		w.o11y.Logger.Warn(fmt.Sprintf("Error writing events to clickhouse, trying again in %v", backoff), "error", err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return fmt.Errorf("error writing events to clickhouse: %v", err)
+		}
+	}
+}
+
+// clickhouseClientError is a rejected query, which won't succeed if retried
+type clickhouseClientError string
+
+func (e clickhouseClientError) Error() string {
+	return string(e)
+}
+
+// exec runs a query. For inserts, the query is sent as a parameter, and the data as the body.
+func (w *ClickHouseWriter) exec(ctx context.Context, query string, params url.Values, data []byte) error {
+	if params == nil {
+		params = url.Values{}
+	}
+	params.Set("database", w.database)
+	body := []byte(query)
+	if data != nil {
+		params.Set("query", query)
+		body = data
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url+"/?"+params.Encode(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-ClickHouse-User", w.user)
+	req.Header.Set("X-ClickHouse-Key", w.password)
+	res, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusOK {
+		_, _ = io.Copy(io.Discard, res.Body)
+		return nil
+	}
+	msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+	err = fmt.Errorf("clickhouse returned %d: %s", res.StatusCode, strings.TrimSpace(string(msg)))
+	if res.StatusCode >= 400 && res.StatusCode < 500 {
+		return clickhouseClientError(err.Error())
+	}
+	return err
+}
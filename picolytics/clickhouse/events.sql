@@ -0,0 +1,55 @@
+---- events with their session's attributes, so queries don't need joins: ----
+CREATE TABLE IF NOT EXISTS events (
+    ---- event essentials ----
+    created_at DateTime64(3, 'UTC'),
+    domain LowCardinality(String),
+    name LowCardinality(String),
+    path String,
+    referrer String,
+    visitor_id String,
+    ---- timing ----
+    load_time Int32,
+    ttfb Int32,
+    ---- web vitals, only reported by vitals events ----
+    lcp Nullable(Int32),
+    cls Nullable(Float64),
+    inp Nullable(Int32),
+    fcp Nullable(Int32),
+    ---- link URL of outbound and download events ----
+    target String,
+    ---- active time and scroll depth, reported by engagement events ----
+    engaged_ms Int32,
+    scroll_depth Nullable(Int32),
+    ---- custom event properties, as JSON ----
+    props String,
+    ---- geoip lookup ----
+    country LowCardinality(String),
+    subdivision String,
+    city String,
+    latitude Float64,
+    longitude Float64,
+    ---- useragent ----
+    browser LowCardinality(String),
+    browser_version String,
+    os LowCardinality(String),
+    os_version String,
+    platform LowCardinality(String),
+    device_type LowCardinality(String),
+    bot Bool,
+    screen_w Int32,
+    screen_h Int32,
+    timezone LowCardinality(String),
+    pixel_ratio Float64,
+    pixel_depth Int32,
+    ---- query string ----
+    utm_source String,
+    utm_medium String,
+    utm_campaign String,
+    utm_content String,
+    utm_term String
+)
+ENGINE = MergeTree
+PARTITION BY toDate(created_at)
+ORDER BY (domain, created_at)
+---- retried batches are deduplicated by their insert_deduplication_token ----
+SETTINGS non_replicated_deduplication_window = 1000, ttl_only_drop_parts = 1
@@ -0,0 +1,171 @@
+package picolytics
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeClickHouse records requests to a ClickHouse HTTP interface, and fails the first inserts
+type fakeClickHouse struct {
+	lock          sync.Mutex
+	queries       []string
+	inserts       [][]byte
+	tokens        []string
+	failInserts   int
+	failureStatus int
+}
+
+func (f *fakeClickHouse) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	body, _ := io.ReadAll(r.Body)
+	query := r.URL.Query().Get("query")
+	if len(query) < 1 {
+		f.queries = append(f.queries, string(body))
+		return
+	}
+	f.tokens = append(f.tokens, r.URL.Query().Get("insert_deduplication_token"))
+	if f.failInserts > 0 {
+		f.failInserts--
+		http.Error(w, "Code: 242. DB::Exception: Table is in readonly mode", f.failureStatus)
+		return
+	}
+	f.inserts = append(f.inserts, body)
+}
+
+func TestClickHouseWriter(t *testing.T) {
+	o11yMock := &PicolyticsO11y{
+		Logger:  slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError})),
+		Metrics: setupMetrics(1, "", "", ""),
+	}
+	created := time.Date(2024, 1, 1, 10, 0, 0, 123000000, time.UTC)
+	events := []PicolyticsEvent{
+		{Name: "load", Domain: "example.com", Path: "/", VisitorID: "a", Country: "US", Bot: true, Created: created},
+		{Name: "signup", Domain: "example.com", Path: "/pricing", VisitorID: "a", Props: map[string]interface{}{"plan": "pro"}, Created: created},
+	}
+	tests := []struct {
+		name          string
+		failInserts   int
+		failureStatus int
+		wantErr       bool
+		wantAttempts  int
+	}{
+		{
+			name:         "insert",
+			wantAttempts: 1,
+		},
+		{
+			name:          "retried",
+			failInserts:   2,
+			failureStatus: http.StatusServiceUnavailable,
+			wantAttempts:  3,
+		},
+		{
+			name:          "too many failures",
+			failInserts:   5,
+			failureStatus: http.StatusServiceUnavailable,
+			wantErr:       true,
+			wantAttempts:  3,
+		},
+		{
+			name:          "rejected",
+			failInserts:   1,
+			failureStatus: http.StatusBadRequest,
+			wantErr:       true,
+			wantAttempts:  1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeClickHouse{failInserts: tt.failInserts, failureStatus: tt.failureStatus}
+			server := httptest.NewServer(fake)
+			defer server.Close()
+			w, err := NewClickHouseWriter(&Config{ClickhouseURL: server.URL, ClickhouseDatabase: "default", ClickhouseRetries: 2, PruneDays: 30}, o11yMock)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Len(t, fake.queries, 2+len(clickhouseAddedColumns))
+			assert.Contains(t, fake.queries[0], "PARTITION BY toDate(created_at)")
+			assert.Equal(t, "ALTER TABLE events ADD COLUMN IF NOT EXISTS lcp Nullable(Int32) AFTER ttfb", fake.queries[1])
+			assert.Equal(t, "ALTER TABLE events MODIFY TTL toDate(created_at) + INTERVAL 30 DAY", fake.queries[len(fake.queries)-1])
+
+			err = w.writeEvents(context.Background(), events)
+			assert.Equal(t, tt.wantErr, err != nil, "unexpected error: %v", err)
+			assert.Len(t, fake.tokens, tt.wantAttempts)
+			for _, token := range fake.tokens {
+				assert.Equal(t, fake.tokens[0], token, "retries must have the same deduplication token")
+			}
+			if tt.wantErr {
+				assert.Empty(t, fake.inserts)
+				return
+			}
+			assert.Len(t, fake.inserts, 1)
+			rows := []map[string]interface{}{}
+			scanner := bufio.NewScanner(bytes.NewReader(fake.inserts[0]))
+			for scanner.Scan() {
+				row := map[string]interface{}{}
+				assert.NoError(t, json.Unmarshal(scanner.Bytes(), &row))
+				rows = append(rows, row)
+			}
+			assert.Len(t, rows, 2)
+			assert.Equal(t, "2024-01-01 10:00:00.123", rows[0]["created_at"])
+			assert.Equal(t, "US", rows[0]["country"])
+			assert.Equal(t, true, rows[0]["bot"])
+			assert.Equal(t, "", rows[0]["props"])
+			assert.Equal(t, `{"plan":"pro"}`, rows[1]["props"])
+		})
+	}
+}
+
+// TestClickHouseServer runs against a local ClickHouse server, e.g.
+// docker run -p 8123:8123 -e CLICKHOUSE_SKIP_USER_SETUP=1 clickhouse/clickhouse-server
+// CLICKHOUSE_TEST_URL=http://localhost:8123 go test -run TestClickHouseServer ./picolytics
+func TestClickHouseServer(t *testing.T) {
+	chURL := os.Getenv("CLICKHOUSE_TEST_URL")
+	if len(chURL) < 1 {
+		t.Skip("CLICKHOUSE_TEST_URL not set")
+	}
+	o11yMock := &PicolyticsO11y{
+		Logger:  slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError})),
+		Metrics: setupMetrics(1, "", "", ""),
+	}
+	ctx := context.Background()
+	w, err := NewClickHouseWriter(&Config{ClickhouseURL: chURL, ClickhouseDatabase: "default", ClickhouseUser: "default"}, o11yMock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	visitorID := "test-" + time.Now().Format(time.RFC3339Nano)
+	events := []PicolyticsEvent{
+		{Name: "load", Domain: "example.com", Path: "/", VisitorID: visitorID, Created: time.Now()},
+		{Name: "signup", Domain: "example.com", Path: "/", VisitorID: visitorID, Props: map[string]interface{}{"plan": "pro"}, Created: time.Now()},
+	}
+	assert.NoError(t, w.writeEvents(ctx, events))
+	assert.NoError(t, w.writeEvents(ctx, events)) // deduplicated
+
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(chURL, "/")+"/?database=default",
+		strings.NewReader("SELECT count() FROM events WHERE visitor_id = '"+visitorID+"'"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	assert.Equal(t, "2", strings.TrimSpace(string(body)))
+}
@@ -23,33 +23,62 @@ type Config struct {
 	PgSslMode      string `mapstructure:"pgSslMode"`
 	PgConnAttempts int    `mapstructure:"pgConnAttempts"`
 	SkipMigrations bool   `mapstructure:"skipMigrations"`
+	Storage        string `mapstructure:"storage"`
+	SqlitePath     string `mapstructure:"sqlitePath"`
+	// clickhouse:
+	ClickhouseURL        string `mapstructure:"clickhouseUrl"`
+	ClickhouseDatabase   string `mapstructure:"clickhouseDatabase"`
+	ClickhouseUser       string `mapstructure:"clickhouseUser"`
+	ClickhousePassword   string `mapstructure:"clickhousePassword"`
+	ClickhouseRetries    int    `mapstructure:"clickhouseRetries"`
+	ClickhouseEventsOnly bool   `mapstructure:"clickhouseEventsOnly"`
 	// server:
-	ListenAddr     string `mapstructure:"listenAddr"`
-	AutotlsEnabled bool   `mapstructure:"autotlsEnabled"`
-	AutotlsHost    string `mapstructure:"autotlsHost"`
-	AutotlsStaging bool   `mapstructure:"autotlsStaging"`
-	AdminListen    string `mapstructure:"adminListen"`
-	StaticDir      string `mapstructure:"staticDir"`
-	RootRedirect   string `mapstructure:"rootRedirect"`
+	ListenAddr     string   `mapstructure:"listenAddr"`
+	AutotlsEnabled bool     `mapstructure:"autotlsEnabled"`
+	AutotlsHost    string   `mapstructure:"autotlsHost"`
+	AutotlsStaging bool     `mapstructure:"autotlsStaging"`
+	AdminListen    string   `mapstructure:"adminListen"`
+	CorsOrigins    []string `mapstructure:"corsOrigins"`
+	StaticDir      string   `mapstructure:"staticDir"`
+	RootRedirect   string   `mapstructure:"rootRedirect"`
 	// proxy:
 	IPExtractor    string   `mapstructure:"ipExtractor"`
 	TrustedProxies []string `mapstructure:"trustedProxies"`
 	// privacy:
-	GeoIPFile         string `mapstructure:"geoIpFile"`
-	SessionTimeoutMin int    `mapstructure:"sessionTimeoutMin"`
+	GeoIPFile          string   `mapstructure:"geoIpFile"`
+	SessionTimeoutMin  int      `mapstructure:"sessionTimeoutMin"`
+	SourceParams       []string `mapstructure:"sourceParams"`
+	AllowedQueryParams []string `mapstructure:"allowedQueryParams"`
+	// sites:
+	Sites         []SiteConfig `mapstructure:"sites"`
+	Goals         []GoalConfig `mapstructure:"goals"`
+	VerifyOrigin  bool         `mapstructure:"verifyOrigin"`
+	IngestEnabled bool         `mapstructure:"ingestEnabled"`
 	// tuning:
 	QueueSize          int      `mapstructure:"queueSize"`
 	BatchMaxSize       int      `mapstructure:"batchMaxSize"`
 	BatchMaxMsec       int      `mapstructure:"batchMaxMsec"`
+	DrainTimeoutSec    int      `mapstructure:"drainTimeoutSec"`
 	RequestRateLimit   int      `mapstructure:"requestRateLimit"`
 	BodyMaxSize        int64    `mapstructure:"bodyMaxSize"`
+	BatchBodyMaxSize   int64    `mapstructure:"batchBodyMaxSize"`
+	BatchMaxAgeHours   int      `mapstructure:"batchMaxAgeHours"`
 	StaticCacheMaxAge  int      `mapstructure:"staticCacheMaxAge"`
 	DisableHostMetrics bool     `mapstructure:"disableHostMetrics"`
 	LogFormat          string   `mapstructure:"logFormat"`
 	PruneDays          int      `mapstructure:"pruneDays"`
 	PruneCheckHours    int      `mapstructure:"pruneCheckHours"`
+	PartitionInterval  string   `mapstructure:"partitionInterval"`
+	RollupsEnabled     bool     `mapstructure:"rollupsEnabled"`
+	RollupCheckMin     int      `mapstructure:"rollupCheckMin"`
+	RollupPruneDays    int      `mapstructure:"rollupPruneDays"`
+	GoalCheckMin       int      `mapstructure:"goalCheckMin"`
 	ValidEventNames    []string `mapstructure:"validEventNames"`
 	Debug              bool     `mapstructure:"debug"`
+	// spool:
+	SpoolDir          string `mapstructure:"spoolDir"`
+	SpoolMaxBytes     int64  `mapstructure:"spoolMaxBytes"`
+	SpoolSegmentBytes int64  `mapstructure:"spoolSegmentBytes"`
 
 	// internal config
 	StaticFiles fs.FS `mapstructure:"-"`
@@ -60,27 +89,51 @@ func SetConfigDefaults() {
 	viper.SetDefault("pgSslMode", "prefer")
 	viper.SetDefault("pgConnAttempts", 5)
 	viper.SetDefault("skipMigrations", false)
+	viper.SetDefault("storage", "postgres")
+	viper.SetDefault("sqlitePath", "picolytics.db")
+	viper.SetDefault("clickhouseUrl", "") // disabled
+	viper.SetDefault("clickhouseDatabase", "default")
+	viper.SetDefault("clickhouseUser", "default")
+	viper.SetDefault("clickhousePassword", "")
+	viper.SetDefault("clickhouseRetries", 3)
+	viper.SetDefault("clickhouseEventsOnly", false)
 	viper.SetDefault("listenAddr", ":8080")
 	viper.SetDefault("adminListen", "") // disabled
 	viper.SetDefault("staticDir", "static")
 	viper.SetDefault("rootRedirect", "")
+	viper.SetDefault("corsOrigins", []string{"*"})
 	viper.SetDefault("autotlsEnabled", false)
 	viper.SetDefault("autotlsStaging", true)
 	viper.SetDefault("ipExtractor", "direct")
 	viper.SetDefault("geoIpFile", "geoip.mmdb")
 	viper.SetDefault("sessionTimeoutMin", 30)
+	viper.SetDefault("sourceParams", []string{"ref", "source", "gclid=google", "fbclid=facebook", "msclkid=bing"})
+	viper.SetDefault("allowedQueryParams", []string{})
+	viper.SetDefault("verifyOrigin", false)
+	viper.SetDefault("ingestEnabled", false)
 	viper.SetDefault("queueSize", 640000)
 	viper.SetDefault("batchMaxSize", 6400)
 	viper.SetDefault("batchMaxMsec", 500)
+	viper.SetDefault("drainTimeoutSec", 10)
 	viper.SetDefault("requestRateLimit", 10)
-	viper.SetDefault("bodyMaxSize", int64(2*1024)) // 2KB
-	viper.SetDefault("staticCacheMaxAge", 3600)    // 1 hour
+	viper.SetDefault("bodyMaxSize", int64(2*1024))        // 2KB
+	viper.SetDefault("batchBodyMaxSize", int64(256*1024)) // 256KB
+	viper.SetDefault("batchMaxAgeHours", 24)
+	viper.SetDefault("staticCacheMaxAge", 3600) // 1 hour
 	viper.SetDefault("disableHostMetrics", true)
 	viper.SetDefault("logFormat", "json")
 	viper.SetDefault("pruneDays", 0)
 	viper.SetDefault("pruneCheckHours", 24)
-	viper.SetDefault("validEventNames", []string{"load", "visible", "hidden", "hashchange", "ping"})
+	viper.SetDefault("partitionInterval", "") // disabled
+	viper.SetDefault("rollupsEnabled", false)
+	viper.SetDefault("rollupCheckMin", 15)
+	viper.SetDefault("rollupPruneDays", 0)
+	viper.SetDefault("goalCheckMin", 5)
+	viper.SetDefault("validEventNames", []string{"load", "visible", "hidden", "hashchange", "ping", "vitals", "pageview", "outbound", "download", "engagement", "error", "email_open"})
 	viper.SetDefault("debug", false)
+	viper.SetDefault("spoolDir", "")                           // disabled
+	viper.SetDefault("spoolMaxBytes", int64(1024*1024*1024))   // 1GB
+	viper.SetDefault("spoolSegmentBytes", int64(16*1024*1024)) // 16MB
 }
 
 func BindEnvVars() {
@@ -95,6 +148,14 @@ func BindEnvVars() {
 	viper.BindEnv("pgSslMode", "PGSSLMODE")
 	viper.BindEnv("pgConnAttempts", "PGCONNATTEMPTS")
 	viper.BindEnv("skipMigrations", "SKIP_MIGRATIONS")
+	viper.BindEnv("storage", "STORAGE")
+	viper.BindEnv("sqlitePath", "SQLITE_PATH")
+	viper.BindEnv("clickhouseUrl", "CLICKHOUSE_URL")
+	viper.BindEnv("clickhouseDatabase", "CLICKHOUSE_DATABASE")
+	viper.BindEnv("clickhouseUser", "CLICKHOUSE_USER")
+	viper.BindEnv("clickhousePassword", "CLICKHOUSE_PASSWORD")
+	viper.BindEnv("clickhouseRetries", "CLICKHOUSE_RETRIES")
+	viper.BindEnv("clickhouseEventsOnly", "CLICKHOUSE_EVENTS_ONLY")
 	viper.BindEnv("listenAddr", "LISTEN_ADDR")
 	viper.BindEnv("autotlsEnabled", "AUTOTLS_ENABLED")
 	viper.BindEnv("autotlsHost", "AUTOTLS_HOST") // required if enableAcme is true
@@ -102,22 +163,38 @@ func BindEnvVars() {
 	viper.BindEnv("adminListen", "ADMIN_LISTEN")
 	viper.BindEnv("staticDir", "STATIC_DIR")
 	viper.BindEnv("rootRedirect", "ROOT_REDIRECT")
+	viper.BindEnv("corsOrigins", "CORS_ORIGINS") // comma separated list
 	viper.BindEnv("ipExtractor", "IP_EXTRACTOR")
 	viper.BindEnv("trustedProxies", "TRUSTED_PROXIES") // comma separated list
 	viper.BindEnv("geoIpFile", "GEO_IP_FILE")
 	viper.BindEnv("sessionTimeoutMin", "SESSION_TIMEOUT_MIN")
+	viper.BindEnv("sourceParams", "SOURCE_PARAMS")              // comma separated list
+	viper.BindEnv("allowedQueryParams", "ALLOWED_QUERY_PARAMS") // comma separated list
+	viper.BindEnv("verifyOrigin", "VERIFY_ORIGIN")
+	viper.BindEnv("ingestEnabled", "INGEST_ENABLED")
 	viper.BindEnv("queueSize", "QUEUE_SIZE")
 	viper.BindEnv("batchMaxSize", "BATCH_MAX_SIZE")
 	viper.BindEnv("batchMaxMsec", "BATCH_MAX_MSEC")
+	viper.BindEnv("drainTimeoutSec", "DRAIN_TIMEOUT_SEC")
 	viper.BindEnv("requestRateLimit", "REQUEST_RATE_LIMIT") // Limit is represented as number of events per second.
 	viper.BindEnv("bodyMaxSize", "BODY_MAX_SIZE")
+	viper.BindEnv("batchBodyMaxSize", "BATCH_BODY_MAX_SIZE")
+	viper.BindEnv("batchMaxAgeHours", "BATCH_MAX_AGE_HOURS")
 	viper.BindEnv("staticCacheMaxAge", "STATIC_CACHE_MAX_AGE") // seconds
 	viper.BindEnv("disableHostMetrics", "DISABLE_HOST_METRICS")
 	viper.BindEnv("logFormat", "LOG_FORMAT")
 	viper.BindEnv("pruneDays", "PRUNE_DAYS")
 	viper.BindEnv("pruneCheckHours", "PRUNE_CHECK_HOURS")
+	viper.BindEnv("partitionInterval", "PARTITION_INTERVAL")
+	viper.BindEnv("rollupsEnabled", "ROLLUPS_ENABLED")
+	viper.BindEnv("rollupCheckMin", "ROLLUP_CHECK_MIN")
+	viper.BindEnv("rollupPruneDays", "ROLLUP_PRUNE_DAYS")
+	viper.BindEnv("goalCheckMin", "GOAL_CHECK_MIN")
 	viper.BindEnv("validEventNames", "VALID_EVENT_NAMES") // comma separated list
 	viper.BindEnv("debug", "DEBUG")
+	viper.BindEnv("spoolDir", "SPOOL_DIR")
+	viper.BindEnv("spoolMaxBytes", "SPOOL_MAX_BYTES")
+	viper.BindEnv("spoolSegmentBytes", "SPOOL_SEGMENT_BYTES")
 }
 
 func setupLogger(debug bool, logHandler slog.Handler) (*slog.Logger, error) {
@@ -146,7 +223,24 @@ func validateConfig(config *Config) error {
 		return fmt.Errorf("invalid pgSslMode: %s", config.PgSslMode)
 	}
 
-	if len(config.PgConnString) < 1 {
+	if _, ok := storageBackends[config.Storage]; !ok {
+		return fmt.Errorf("invalid storage: %s", config.Storage)
+	}
+	if config.Storage != "postgres" {
+		// these features query postgres directly
+		if config.RollupsEnabled || len(config.Goals) > 0 || config.IngestEnabled {
+			return fmt.Errorf("rollups, goals, and ingestion require postgres storage")
+		}
+		if config.AutotlsEnabled && config.Storage != "sqlite" {
+			return fmt.Errorf("autotls requires postgres or sqlite storage")
+		}
+		if config.Storage == "sqlite" && len(config.SqlitePath) < 1 {
+			return fmt.Errorf("sqlitePath must be set")
+		}
+		if config.Storage == "memory" && config.PruneDays < 1 {
+			return fmt.Errorf("memory storage requires pruneDays, since it's only freed by pruning")
+		}
+	} else if len(config.PgConnString) < 1 {
 		if len(config.PgHost) == 0 || len(config.PgDatabase) == 0 || len(config.PgUser) == 0 || len(config.PgPassword) == 0 {
 			return fmt.Errorf("PGCONNSTRING must be set")
 		}
@@ -157,10 +251,47 @@ func validateConfig(config *Config) error {
 		}
 	}
 
+	if len(config.ClickhouseURL) > 0 && !strings.HasPrefix(config.ClickhouseURL, "http://") && !strings.HasPrefix(config.ClickhouseURL, "https://") {
+		return fmt.Errorf("clickhouseUrl must begin with http:// or https://")
+	}
+	if config.ClickhouseEventsOnly && (len(config.ClickhouseURL) < 1 || config.Storage != "postgres") {
+		return fmt.Errorf("clickhouseEventsOnly requires clickhouseUrl and postgres storage")
+	}
+	if config.ClickhouseEventsOnly && len(config.Goals) > 0 {
+		return fmt.Errorf("goals are matched against events in postgres, so can't be used with clickhouseEventsOnly")
+	}
+	if config.ClickhouseEventsOnly && config.RollupsEnabled {
+		return fmt.Errorf("rollups are folded from events in postgres, so can't be used with clickhouseEventsOnly")
+	}
+
+	ALLOWED_PARTITION_INTERVALS := map[string]bool{"": true, "day": true, "month": true}
+	if _, ok := ALLOWED_PARTITION_INTERVALS[config.PartitionInterval]; !ok {
+		return fmt.Errorf("invalid partitionInterval: %s", config.PartitionInterval)
+	}
+	if len(config.PartitionInterval) > 0 && config.Storage != "postgres" {
+		return fmt.Errorf("partitionInterval requires postgres storage")
+	}
+	if len(config.PartitionInterval) > 0 && config.PruneCheckHours >= partitionsAheadHours(config.PartitionInterval) {
+		return fmt.Errorf("pruneCheckHours must be less than %d with %s partitions, so partitions are created before they're needed", partitionsAheadHours(config.PartitionInterval), config.PartitionInterval)
+	}
+
 	ALLOWED_EXTRACTOR_MODES := map[string]bool{"direct": true, "xff": true, "realip": true}
 	if _, ok := ALLOWED_EXTRACTOR_MODES[config.IPExtractor]; !ok {
 		return fmt.Errorf("invalid ipExtractor mode: %s", config.IPExtractor)
 	}
 
+	if len(config.SpoolDir) > 0 {
+		if config.SpoolSegmentBytes < 1 || config.SpoolMaxBytes < config.SpoolSegmentBytes {
+			return fmt.Errorf("spoolMaxBytes must be at least spoolSegmentBytes, which must be positive")
+		}
+	}
+
+	if config.RollupsEnabled && config.RollupCheckMin < 1 {
+		return fmt.Errorf("rollupCheckMin must be positive")
+	}
+	if len(config.Goals) > 0 && config.GoalCheckMin < 1 {
+		return fmt.Errorf("goalCheckMin must be positive")
+	}
+
 	return nil
 }
@@ -1 +1,71 @@
 package picolytics
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateConfig(t *testing.T) {
+	valid := func() *Config {
+		return &Config{PgSslMode: "disable", Storage: "postgres", PgConnString: "postgres://localhost/picolytics", IPExtractor: "direct", PruneCheckHours: 24}
+	}
+	tests := []struct {
+		name    string
+		modify  func(c *Config)
+		wantErr error
+	}{
+		{
+			name:   "defaults",
+			modify: func(c *Config) {},
+		},
+		{
+			name:   "day partitions",
+			modify: func(c *Config) { c.PartitionInterval = "day" },
+		},
+		{
+			name: "day partitions pruned less often than they're created",
+			modify: func(c *Config) {
+				c.PartitionInterval = "day"
+				c.PruneCheckHours = 7 * 24
+			},
+			wantErr: errors.New("pruneCheckHours must be less than 168 with day partitions, so partitions are created before they're needed"),
+		},
+		{
+			name: "rollups with clickhouse events only",
+			modify: func(c *Config) {
+				c.ClickhouseURL = "http://localhost:8123"
+				c.ClickhouseEventsOnly = true
+				c.RollupsEnabled = true
+			},
+			wantErr: errors.New("rollups are folded from events in postgres, so can't be used with clickhouseEventsOnly"),
+		},
+		{
+			name:    "memory storage kept forever",
+			modify:  func(c *Config) { c.Storage = "memory" },
+			wantErr: errors.New("memory storage requires pruneDays, since it's only freed by pruning"),
+		},
+		{
+			name: "memory storage",
+			modify: func(c *Config) {
+				c.Storage = "memory"
+				c.PruneDays = 1
+			},
+		},
+		{
+			name: "month partitions pruned weekly",
+			modify: func(c *Config) {
+				c.PartitionInterval = "month"
+				c.PruneCheckHours = 7 * 24
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := valid()
+			tt.modify(config)
+			assert.Equal(t, tt.wantErr, validateConfig(config))
+		})
+	}
+}
@@ -37,6 +37,15 @@ func (r iteratorForCreateEvents) Values() ([]interface{}, error) {
 		r.rows[0].Referrer,
 		r.rows[0].LoadTime,
 		r.rows[0].Ttfb,
+		r.rows[0].Props,
+		r.rows[0].CreatedAt,
+		r.rows[0].Lcp,
+		r.rows[0].Cls,
+		r.rows[0].Inp,
+		r.rows[0].Fcp,
+		r.rows[0].Target,
+		r.rows[0].EngagedMs,
+		r.rows[0].ScrollDepth,
 	}, nil
 }
 
@@ -45,5 +54,5 @@ func (r iteratorForCreateEvents) Err() error {
 }
 
 func (q *Queries) CreateEvents(ctx context.Context, arg []CreateEventsParams) (int64, error) {
-	return q.db.CopyFrom(ctx, []string{"events"}, []string{"domain_id", "session_id", "visitor_id", "name", "path", "referrer", "load_time", "ttfb"}, &iteratorForCreateEvents{rows: arg})
+	return q.db.CopyFrom(ctx, []string{"events"}, []string{"domain_id", "session_id", "visitor_id", "name", "path", "referrer", "load_time", "ttfb", "props", "created_at", "lcp", "cls", "inp", "fcp", "target", "engaged_ms", "scroll_depth"}, &iteratorForCreateEvents{rows: arg})
 }
@@ -6,8 +6,17 @@ package db
 
 import (
 	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/nmcclain/picolytics/picolytics/dbtypes"
 )
 
+type ApiKey struct {
+	ID         int32
+	KeyHash    string
+	DomainName string
+	Name       string
+	CreatedAt  pgtype.Timestamptz
+}
+
 type AutocertCache struct {
 	Key       string
 	Data      []byte
@@ -21,16 +30,69 @@ type Domain struct {
 }
 
 type Event struct {
-	ID        int64
-	Name      string
+	ID          int64
+	Name        string
+	DomainID    int32
+	Path        string
+	Referrer    string
+	VisitorID   string
+	SessionID   int64
+	LoadTime    int32
+	Ttfb        int32
+	CreatedAt   pgtype.Timestamptz
+	Props       dbtypes.JSONB
+	Lcp         pgtype.Int4
+	Cls         pgtype.Float8
+	Inp         pgtype.Int4
+	Fcp         pgtype.Int4
+	Target      string
+	EngagedMs   int32
+	ScrollDepth pgtype.Int4
+}
+
+type JsError struct {
+	Fingerprint string
+	DomainID    int32
+	Message     string
+	Source      string
+	Line        int32
+	Col         int32
+	Stack       string
+	Path        string
+	Occurrences int64
+	FirstSeen   pgtype.Timestamptz
+	LastSeen    pgtype.Timestamptz
+}
+
+type RollupDailySession struct {
+	DomainID     int32
+	Day          pgtype.Date
+	ReferrerHost string
+	Country      string
+	DeviceType   string
+	Sessions     int64
+	Visitors     int64
+	Bounces      int64
+	DurationSum  int64
+}
+
+type RollupHourlyPath struct {
 	DomainID  int32
+	Hour      pgtype.Timestamptz
 	Path      string
-	Referrer  string
-	VisitorID string
-	SessionID int64
-	LoadTime  int32
-	Ttfb      int32
-	CreatedAt pgtype.Timestamptz
+	Events    int64
+	Pageviews int64
+	Visitors  int64
+	Vitals    int64
+	LcpP75    pgtype.Int4
+	ClsP75    pgtype.Float8
+	InpP75    pgtype.Int4
+	FcpP75    pgtype.Int4
+}
+
+type RollupWatermark struct {
+	Rollup     string
+	RolledUpTo pgtype.Timestamptz
 }
 
 type Salt struct {
@@ -70,4 +132,6 @@ type Session struct {
 	UtmCampaign    pgtype.Text
 	UtmContent     pgtype.Text
 	UtmTerm        pgtype.Text
+	EngagedSeconds int32
+	ConvertedGoals []string
 }
@@ -9,6 +9,7 @@ import (
 	"context"
 
 	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/nmcclain/picolytics/picolytics/dbtypes"
 )
 
 const autocertCacheDelete = `-- name: AutocertCacheDelete :exec
@@ -48,100 +49,166 @@ func (q *Queries) AutocertCachePut(ctx context.Context, arg AutocertCachePutPara
 	return err
 }
 
-type CreateEventsParams struct {
-	DomainID  int32
-	SessionID int64
-	VisitorID string
-	Name      string
-	Path      string
-	Referrer  string
-	LoadTime  int32
-	Ttfb      int32
-}
-
-const createSession = `-- name: CreateSession :one
-INSERT INTO sessions (
-    updated_at, bounce, domain_id, exit_path, ---- values updated with each event ----
-    visitor_id, entry_path, ---- static values from first event ---- 
-    country, latitude, longitude, subdivision, city, ---- geoip lookup ----
-    browser, browser_version, os, os_version, platform, device_type, bot, screen_w, screen_h, timezone, pixel_ratio, pixel_depth, ---- useragent ----
-    utm_source, utm_medium, utm_campaign, utm_content, utm_term ---- query string ----
-) VALUES (
-  CURRENT_TIMESTAMP, TRUE, $1, $2,
-  $3, $4,
-  $5, $6, $7, $8, $9,
-  $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21,
-  $22, $23, $24, $25, $26
+const checkPathRegex = `-- name: CheckPathRegex :one
+SELECT '' ~ $1::text AS matches
+`
+
+// -- fails if postgres can't compile the regex ----
+func (q *Queries) CheckPathRegex(ctx context.Context, pathRegex string) (bool, error) {
+	row := q.db.QueryRow(ctx, checkPathRegex, pathRegex)
+	var matches bool
+	err := row.Scan(&matches)
+	return matches, err
+}
+
+const convertGoal = `-- name: ConvertGoal :execrows
+UPDATE sessions
+SET converted_goals = array_append(sessions.converted_goals, $1::text)
+WHERE NOT ($1::text = ANY(sessions.converted_goals))
+AND sessions.id IN (
+    SELECT events.session_id FROM events
+    JOIN domains ON domains.domain_id = events.domain_id
+    WHERE events.created_at >= $2::timestamptz
+    AND events.created_at < $3::timestamptz
+    AND ($4::text = '' OR domains.domain_name = $4::text)
+    AND CASE WHEN $5::text = ''
+        THEN events.name IN ('load', 'pageview') AND events.path ~ $6::text
+        ELSE events.name = $5::text
+    END
 )
-RETURNING id
-`
-
-type CreateSessionParams struct {
-	DomainID       int32
-	ExitPath       string
-	VisitorID      pgtype.Text
-	EntryPath      string
-	Country        pgtype.Text
-	Latitude       pgtype.Float8
-	Longitude      pgtype.Float8
-	Subdivision    pgtype.Text
-	City           pgtype.Text
-	Browser        pgtype.Text
-	BrowserVersion pgtype.Text
-	Os             pgtype.Text
-	OsVersion      pgtype.Text
-	Platform       pgtype.Text
-	DeviceType     pgtype.Text
-	Bot            bool
-	ScreenW        pgtype.Int4
-	ScreenH        pgtype.Int4
-	Timezone       pgtype.Text
-	PixelRatio     pgtype.Float8
-	PixelDepth     pgtype.Int4
-	UtmSource      pgtype.Text
-	UtmMedium      pgtype.Text
-	UtmCampaign    pgtype.Text
-	UtmContent     pgtype.Text
-	UtmTerm        pgtype.Text
-}
-
-// -- MUST call this in a transaction after GetSession ----
-func (q *Queries) CreateSession(ctx context.Context, arg CreateSessionParams) (int64, error) {
-	row := q.db.QueryRow(ctx, createSession,
-		arg.DomainID,
-		arg.ExitPath,
-		arg.VisitorID,
-		arg.EntryPath,
-		arg.Country,
-		arg.Latitude,
-		arg.Longitude,
-		arg.Subdivision,
-		arg.City,
-		arg.Browser,
-		arg.BrowserVersion,
-		arg.Os,
-		arg.OsVersion,
-		arg.Platform,
-		arg.DeviceType,
-		arg.Bot,
-		arg.ScreenW,
-		arg.ScreenH,
-		arg.Timezone,
-		arg.PixelRatio,
-		arg.PixelDepth,
-		arg.UtmSource,
-		arg.UtmMedium,
-		arg.UtmCampaign,
-		arg.UtmContent,
-		arg.UtmTerm,
+`
+
+type ConvertGoalParams struct {
+	Goal      string
+	StartTime pgtype.Timestamptz
+	EndTime   pgtype.Timestamptz
+	Domain    string
+	EventName string
+	PathRegex string
+}
+
+// -- path goals match pageviews, event goals match events by name ----
+func (q *Queries) ConvertGoal(ctx context.Context, arg ConvertGoalParams) (int64, error) {
+	result, err := q.db.Exec(ctx, convertGoal,
+		arg.Goal,
+		arg.StartTime,
+		arg.EndTime,
+		arg.Domain,
+		arg.EventName,
+		arg.PathRegex,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const createAPIKey = `-- name: CreateAPIKey :one
+INSERT INTO api_keys (key_hash, domain_name, name) VALUES ($1, $2, $3)
+RETURNING id, created_at
+`
+
+type CreateAPIKeyParams struct {
+	KeyHash    string
+	DomainName string
+	Name       string
+}
+
+type CreateAPIKeyRow struct {
+	ID        int32
+	CreatedAt pgtype.Timestamptz
+}
+
+func (q *Queries) CreateAPIKey(ctx context.Context, arg CreateAPIKeyParams) (CreateAPIKeyRow, error) {
+	row := q.db.QueryRow(ctx, createAPIKey, arg.KeyHash, arg.DomainName, arg.Name)
+	var i CreateAPIKeyRow
+	err := row.Scan(&i.ID, &i.CreatedAt)
+	return i, err
+}
+
+type CreateEventsParams struct {
+	DomainID    int32
+	SessionID   int64
+	VisitorID   string
+	Name        string
+	Path        string
+	Referrer    string
+	LoadTime    int32
+	Ttfb        int32
+	Props       dbtypes.JSONB
+	CreatedAt   pgtype.Timestamptz
+	Lcp         pgtype.Int4
+	Cls         pgtype.Float8
+	Inp         pgtype.Int4
+	Fcp         pgtype.Int4
+	Target      string
+	EngagedMs   int32
+	ScrollDepth pgtype.Int4
+}
+
+const deleteAPIKey = `-- name: DeleteAPIKey :execrows
+DELETE FROM api_keys WHERE id = $1
+`
+
+func (q *Queries) DeleteAPIKey(ctx context.Context, id int32) (int64, error) {
+	result, err := q.db.Exec(ctx, deleteAPIKey, id)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const deleteRollupDailySessions = `-- name: DeleteRollupDailySessions :exec
+DELETE FROM rollup_daily_sessions
+WHERE day >= ($1::timestamptz AT TIME ZONE 'UTC')::date
+AND day < ($2::timestamptz AT TIME ZONE 'UTC')::date
+`
+
+type DeleteRollupDailySessionsParams struct {
+	StartTime pgtype.Timestamptz
+	EndTime   pgtype.Timestamptz
+}
+
+func (q *Queries) DeleteRollupDailySessions(ctx context.Context, arg DeleteRollupDailySessionsParams) error {
+	_, err := q.db.Exec(ctx, deleteRollupDailySessions,
+		arg.StartTime,
+		arg.EndTime,
+	)
+	return err
+}
+
+const deleteRollupHourlyPaths = `-- name: DeleteRollupHourlyPaths :exec
+DELETE FROM rollup_hourly_paths
+WHERE hour >= $1::timestamptz
+AND hour < $2::timestamptz
+`
+
+type DeleteRollupHourlyPathsParams struct {
+	StartTime pgtype.Timestamptz
+	EndTime   pgtype.Timestamptz
+}
+
+func (q *Queries) DeleteRollupHourlyPaths(ctx context.Context, arg DeleteRollupHourlyPathsParams) error {
+	_, err := q.db.Exec(ctx, deleteRollupHourlyPaths,
+		arg.StartTime,
+		arg.EndTime,
 	)
-	var id int64
-	err := row.Scan(&id)
-	return id, err
+	return err
+}
+
+const getAPIKeyDomain = `-- name: GetAPIKeyDomain :one
+SELECT domain_name FROM api_keys WHERE key_hash = $1
+`
+
+func (q *Queries) GetAPIKeyDomain(ctx context.Context, keyHash string) (string, error) {
+	row := q.db.QueryRow(ctx, getAPIKeyDomain, keyHash)
+	var domain_name string
+	err := row.Scan(&domain_name)
+	return domain_name, err
 }
 
 const getEvent = `-- name: GetEvent :one
-SELECT id, name, domain_id, path, referrer, visitor_id, session_id, load_time, ttfb, created_at FROM events
+SELECT id, name, domain_id, path, referrer, visitor_id, session_id, load_time, ttfb, created_at, props FROM events
 WHERE id = $1 LIMIT 1
 `
 
@@ -159,10 +226,36 @@ func (q *Queries) GetEvent(ctx context.Context, id int64) (Event, error) {
 		&i.LoadTime,
 		&i.Ttfb,
 		&i.CreatedAt,
+		&i.Props,
 	)
 	return i, err
 }
 
+const getRollupStartTime = `-- name: GetRollupStartTime :one
+SELECT LEAST(
+    COALESCE((SELECT MIN(created_at) FROM events), CURRENT_TIMESTAMP),
+    COALESCE((SELECT MIN(created_at) FROM sessions), CURRENT_TIMESTAMP)
+)::timestamptz AS start_time
+`
+
+func (q *Queries) GetRollupStartTime(ctx context.Context) (pgtype.Timestamptz, error) {
+	row := q.db.QueryRow(ctx, getRollupStartTime)
+	var i pgtype.Timestamptz
+	err := row.Scan(&i)
+	return i, err
+}
+
+const getRollupWatermark = `-- name: GetRollupWatermark :one
+SELECT rolled_up_to FROM rollup_watermarks WHERE rollup = $1
+`
+
+func (q *Queries) GetRollupWatermark(ctx context.Context, rollup string) (pgtype.Timestamptz, error) {
+	row := q.db.QueryRow(ctx, getRollupWatermark, rollup)
+	var i pgtype.Timestamptz
+	err := row.Scan(&i)
+	return i, err
+}
+
 const getSalt = `-- name: GetSalt :one
 SELECT salt, created_at FROM salt LIMIT 1
 `
@@ -174,28 +267,44 @@ func (q *Queries) GetSalt(ctx context.Context) (Salt, error) {
 	return i, err
 }
 
-const getSession = `-- name: GetSession :one
-SELECT id FROM sessions
-WHERE visitor_id = $1
-AND updated_at > CURRENT_TIMESTAMP - $2::interval
-ORDER by updated_at DESC
-LIMIT 1
+const listAPIKeys = `-- name: ListAPIKeys :many
+SELECT id, domain_name, name, created_at FROM api_keys ORDER BY id
 `
 
-type GetSessionParams struct {
-	VisitorID pgtype.Text
-	Column2   pgtype.Interval
+type ListAPIKeysRow struct {
+	ID         int32
+	DomainName string
+	Name       string
+	CreatedAt  pgtype.Timestamptz
 }
 
-func (q *Queries) GetSession(ctx context.Context, arg GetSessionParams) (int64, error) {
-	row := q.db.QueryRow(ctx, getSession, arg.VisitorID, arg.Column2)
-	var id int64
-	err := row.Scan(&id)
-	return id, err
+func (q *Queries) ListAPIKeys(ctx context.Context) ([]ListAPIKeysRow, error) {
+	rows, err := q.db.Query(ctx, listAPIKeys)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ListAPIKeysRow
+	for rows.Next() {
+		var i ListAPIKeysRow
+		if err := rows.Scan(
+			&i.ID,
+			&i.DomainName,
+			&i.Name,
+			&i.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
 }
 
 const listEvents = `-- name: ListEvents :many
-SELECT id, name, domain_id, path, referrer, visitor_id, session_id, load_time, ttfb, created_at FROM events
+SELECT id, name, domain_id, path, referrer, visitor_id, session_id, load_time, ttfb, created_at, props FROM events
 ORDER BY id DESC
 `
 
@@ -219,6 +328,7 @@ func (q *Queries) ListEvents(ctx context.Context) ([]Event, error) {
 			&i.LoadTime,
 			&i.Ttfb,
 			&i.CreatedAt,
+			&i.Props,
 		); err != nil {
 			return nil, err
 		}
@@ -239,6 +349,33 @@ func (q *Queries) PruneEvents(ctx context.Context, theInterval pgtype.Interval)
 	return err
 }
 
+const pruneJSErrors = `-- name: PruneJSErrors :exec
+DELETE FROM js_errors WHERE last_seen <= CURRENT_TIMESTAMP - $1::interval
+`
+
+func (q *Queries) PruneJSErrors(ctx context.Context, theInterval pgtype.Interval) error {
+	_, err := q.db.Exec(ctx, pruneJSErrors, theInterval)
+	return err
+}
+
+const pruneRollupDailySessions = `-- name: PruneRollupDailySessions :exec
+DELETE FROM rollup_daily_sessions WHERE day <= (CURRENT_TIMESTAMP - $1::interval)::date
+`
+
+func (q *Queries) PruneRollupDailySessions(ctx context.Context, theInterval pgtype.Interval) error {
+	_, err := q.db.Exec(ctx, pruneRollupDailySessions, theInterval)
+	return err
+}
+
+const pruneRollupHourlyPaths = `-- name: PruneRollupHourlyPaths :exec
+DELETE FROM rollup_hourly_paths WHERE hour <= CURRENT_TIMESTAMP - $1::interval
+`
+
+func (q *Queries) PruneRollupHourlyPaths(ctx context.Context, theInterval pgtype.Interval) error {
+	_, err := q.db.Exec(ctx, pruneRollupHourlyPaths, theInterval)
+	return err
+}
+
 const pruneSessions = `-- name: PruneSessions :exec
 DELETE FROM sessions WHERE updated_at <= CURRENT_TIMESTAMP - $1::interval
 `
@@ -248,6 +385,613 @@ func (q *Queries) PruneSessions(ctx context.Context, theInterval pgtype.Interval
 	return err
 }
 
+const rewindRollupWatermark = `-- name: RewindRollupWatermark :exec
+UPDATE rollup_watermarks SET rolled_up_to = LEAST(rolled_up_to, $2)
+WHERE rollup = $1
+`
+
+type RewindRollupWatermarkParams struct {
+	Rollup     string
+	RolledUpTo pgtype.Timestamptz
+}
+
+func (q *Queries) RewindRollupWatermark(ctx context.Context, arg RewindRollupWatermarkParams) error {
+	_, err := q.db.Exec(ctx, rewindRollupWatermark,
+		arg.Rollup,
+		arg.RolledUpTo,
+	)
+	return err
+}
+
+const rollupDailySessions = `-- name: RollupDailySessions :exec
+INSERT INTO rollup_daily_sessions (domain_id, day, referrer_host, country, device_type, sessions, visitors, bounces, duration_sum)
+SELECT
+    sessions.domain_id,
+    (sessions.created_at AT TIME ZONE 'UTC')::date,
+    COALESCE(substring(entry.referrer from '^[a-zA-Z][a-zA-Z0-9+.-]*://([^/:?#]+)'), ''),
+    COALESCE(sessions.country, ''),
+    COALESCE(sessions.device_type, ''),
+    COUNT(*),
+    COUNT(DISTINCT sessions.visitor_id),
+    COUNT(*) FILTER (WHERE sessions.bounce),
+    COALESCE(SUM(sessions.duration), 0)
+FROM sessions
+LEFT JOIN LATERAL (
+    SELECT events.referrer FROM events
+    WHERE events.session_id = sessions.id
+    ORDER BY events.id
+    LIMIT 1
+) AS entry ON TRUE
+WHERE sessions.created_at >= $1::timestamptz
+AND sessions.created_at < $2::timestamptz
+AND NOT sessions.bot
+GROUP BY 1, 2, 3, 4, 5
+ON CONFLICT (domain_id, day, referrer_host, country, device_type) DO UPDATE SET
+    sessions = EXCLUDED.sessions,
+    visitors = EXCLUDED.visitors,
+    bounces = EXCLUDED.bounces,
+    duration_sum = EXCLUDED.duration_sum
+`
+
+type RollupDailySessionsParams struct {
+	StartTime pgtype.Timestamptz
+	EndTime   pgtype.Timestamptz
+}
+
+// -- the session referrer is the referrer of its first event ----
+func (q *Queries) RollupDailySessions(ctx context.Context, arg RollupDailySessionsParams) error {
+	_, err := q.db.Exec(ctx, rollupDailySessions,
+		arg.StartTime,
+		arg.EndTime,
+	)
+	return err
+}
+
+const rollupHourlyPaths = `-- name: RollupHourlyPaths :exec
+INSERT INTO rollup_hourly_paths (domain_id, hour, path, events, pageviews, visitors, vitals, lcp_p75, cls_p75, inp_p75, fcp_p75)
+SELECT
+    domain_id,
+    date_trunc('hour', created_at),
+    path,
+    COUNT(*),
+    COUNT(*) FILTER (WHERE name IN ('load', 'pageview')),
+    COUNT(DISTINCT visitor_id),
+    COUNT(*) FILTER (WHERE name = 'vitals'),
+    percentile_cont(0.75) WITHIN GROUP (ORDER BY lcp)::int,
+    percentile_cont(0.75) WITHIN GROUP (ORDER BY cls),
+    percentile_cont(0.75) WITHIN GROUP (ORDER BY inp)::int,
+    percentile_cont(0.75) WITHIN GROUP (ORDER BY fcp)::int
+FROM events
+WHERE created_at >= $1::timestamptz
+AND created_at < $2::timestamptz
+GROUP BY domain_id, date_trunc('hour', created_at), path
+ON CONFLICT (domain_id, hour, path) DO UPDATE SET
+    events = EXCLUDED.events,
+    pageviews = EXCLUDED.pageviews,
+    visitors = EXCLUDED.visitors,
+    vitals = EXCLUDED.vitals,
+    lcp_p75 = EXCLUDED.lcp_p75,
+    cls_p75 = EXCLUDED.cls_p75,
+    inp_p75 = EXCLUDED.inp_p75,
+    fcp_p75 = EXCLUDED.fcp_p75
+`
+
+type RollupHourlyPathsParams struct {
+	StartTime pgtype.Timestamptz
+	EndTime   pgtype.Timestamptz
+}
+
+func (q *Queries) RollupHourlyPaths(ctx context.Context, arg RollupHourlyPathsParams) error {
+	_, err := q.db.Exec(ctx, rollupHourlyPaths,
+		arg.StartTime,
+		arg.EndTime,
+	)
+	return err
+}
+
+const setRollupWatermark = `-- name: SetRollupWatermark :exec
+INSERT INTO rollup_watermarks (rollup, rolled_up_to)
+VALUES ($1, $2)
+ON CONFLICT (rollup) DO UPDATE SET rolled_up_to = EXCLUDED.rolled_up_to
+`
+
+type SetRollupWatermarkParams struct {
+	Rollup     string
+	RolledUpTo pgtype.Timestamptz
+}
+
+func (q *Queries) SetRollupWatermark(ctx context.Context, arg SetRollupWatermarkParams) error {
+	_, err := q.db.Exec(ctx, setRollupWatermark,
+		arg.Rollup,
+		arg.RolledUpTo,
+	)
+	return err
+}
+
+const statsConversions = `-- name: StatsConversions :many
+SELECT
+    COALESCE(CASE $1::text
+        WHEN 'country' THEN sessions.country
+        WHEN 'referrer' THEN substring(entry.referrer from '^[a-zA-Z][a-zA-Z0-9+.-]*://([^/:?#]+)')
+        WHEN 'utm_source' THEN sessions.utm_source
+        WHEN 'utm_medium' THEN sessions.utm_medium
+        WHEN 'utm_campaign' THEN sessions.utm_campaign
+        WHEN 'utm_content' THEN sessions.utm_content
+        WHEN 'utm_term' THEN sessions.utm_term
+    END, '')::text AS value,
+    COUNT(*)::bigint AS sessions,
+    COUNT(*) FILTER (WHERE $2::text = ANY(sessions.converted_goals))::bigint AS conversions,
+    COALESCE(AVG(CASE WHEN $2::text = ANY(sessions.converted_goals) THEN 1.0 ELSE 0.0 END), 0)::float8 AS conversion_rate
+FROM sessions
+JOIN domains ON domains.domain_id = sessions.domain_id
+LEFT JOIN LATERAL (
+    SELECT events.referrer FROM events
+    WHERE $1::text = 'referrer'
+    AND events.session_id = sessions.id
+    ORDER BY events.id
+    LIMIT 1
+) AS entry ON TRUE
+WHERE ($3::text = '' OR domains.domain_name = $3::text)
+AND sessions.created_at >= $4::timestamptz
+AND sessions.created_at < $5::timestamptz
+AND ($6::boolean OR NOT sessions.bot)
+GROUP BY value
+ORDER BY conversions DESC, sessions DESC, value
+LIMIT $7::int
+`
+
+type StatsConversionsParams struct {
+	Field       string
+	Goal        string
+	Domain      string
+	StartTime   pgtype.Timestamptz
+	EndTime     pgtype.Timestamptz
+	IncludeBots bool
+	RowLimit    int32
+}
+
+type StatsConversionsRow struct {
+	Value          string
+	Sessions       int64
+	Conversions    int64
+	ConversionRate float64
+}
+
+// -- field must be one of the session columns in the CASE below, or referrer: the host of the session's first referrer ----
+func (q *Queries) StatsConversions(ctx context.Context, arg StatsConversionsParams) ([]StatsConversionsRow, error) {
+	rows, err := q.db.Query(ctx, statsConversions,
+		arg.Field,
+		arg.Goal,
+		arg.Domain,
+		arg.StartTime,
+		arg.EndTime,
+		arg.IncludeBots,
+		arg.RowLimit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []StatsConversionsRow
+	for rows.Next() {
+		var i StatsConversionsRow
+		if err := rows.Scan(
+			&i.Value,
+			&i.Sessions,
+			&i.Conversions,
+			&i.ConversionRate,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const statsGoals = `-- name: StatsGoals :many
+WITH filtered_sessions AS (
+    SELECT sessions.visitor_id, sessions.converted_goals
+    FROM sessions
+    JOIN domains ON domains.domain_id = sessions.domain_id
+    WHERE ($1::text = '' OR domains.domain_name = $1::text)
+    AND sessions.created_at >= $2::timestamptz
+    AND sessions.created_at < $3::timestamptz
+    AND ($4::boolean OR NOT sessions.bot)
+)
+SELECT
+    goal::text AS goal,
+    COUNT(*)::bigint AS conversions,
+    COUNT(DISTINCT filtered_sessions.visitor_id)::bigint AS visitors,
+    (COUNT(*)::float8 / (SELECT COUNT(*) FROM filtered_sessions))::float8 AS conversion_rate
+FROM filtered_sessions, unnest(filtered_sessions.converted_goals) AS goal
+GROUP BY goal
+ORDER BY conversions DESC, goal
+LIMIT $5::int
+`
+
+type StatsGoalsParams struct {
+	Domain      string
+	StartTime   pgtype.Timestamptz
+	EndTime     pgtype.Timestamptz
+	IncludeBots bool
+	RowLimit    int32
+}
+
+type StatsGoalsRow struct {
+	Goal           string
+	Conversions    int64
+	Visitors       int64
+	ConversionRate float64
+}
+
+// -- conversion rates are of all sessions in the range ----
+func (q *Queries) StatsGoals(ctx context.Context, arg StatsGoalsParams) ([]StatsGoalsRow, error) {
+	rows, err := q.db.Query(ctx, statsGoals,
+		arg.Domain,
+		arg.StartTime,
+		arg.EndTime,
+		arg.IncludeBots,
+		arg.RowLimit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []StatsGoalsRow
+	for rows.Next() {
+		var i StatsGoalsRow
+		if err := rows.Scan(
+			&i.Goal,
+			&i.Conversions,
+			&i.Visitors,
+			&i.ConversionRate,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const statsScrollDepth = `-- name: StatsScrollDepth :many
+SELECT
+    events.path,
+    COUNT(*)::bigint AS pageviews,
+    AVG(events.scroll_depth)::float8 AS avg_depth,
+    COUNT(*) FILTER (WHERE events.scroll_depth >= 25)::bigint AS reached_25,
+    COUNT(*) FILTER (WHERE events.scroll_depth >= 50)::bigint AS reached_50,
+    COUNT(*) FILTER (WHERE events.scroll_depth >= 75)::bigint AS reached_75,
+    COUNT(*) FILTER (WHERE events.scroll_depth >= 100)::bigint AS reached_100
+FROM events
+JOIN domains ON domains.domain_id = events.domain_id
+JOIN sessions ON sessions.id = events.session_id
+WHERE events.scroll_depth IS NOT NULL
+AND ($1::text = '' OR domains.domain_name = $1::text)
+AND events.created_at >= $2::timestamptz
+AND events.created_at < $3::timestamptz
+AND ($4::boolean OR NOT sessions.bot)
+GROUP BY events.path
+ORDER BY pageviews DESC, events.path
+LIMIT $5::int
+`
+
+type StatsScrollDepthParams struct {
+	Domain      string
+	StartTime   pgtype.Timestamptz
+	EndTime     pgtype.Timestamptz
+	IncludeBots bool
+	RowLimit    int32
+}
+
+type StatsScrollDepthRow struct {
+	Path       string
+	Pageviews  int64
+	AvgDepth   float64
+	Reached25  int64
+	Reached50  int64
+	Reached75  int64
+	Reached100 int64
+}
+
+// -- pageviews are counted by their scroll depth reports, one per pageview ----
+func (q *Queries) StatsScrollDepth(ctx context.Context, arg StatsScrollDepthParams) ([]StatsScrollDepthRow, error) {
+	rows, err := q.db.Query(ctx, statsScrollDepth,
+		arg.Domain,
+		arg.StartTime,
+		arg.EndTime,
+		arg.IncludeBots,
+		arg.RowLimit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []StatsScrollDepthRow
+	for rows.Next() {
+		var i StatsScrollDepthRow
+		if err := rows.Scan(
+			&i.Path,
+			&i.Pageviews,
+			&i.AvgDepth,
+			&i.Reached25,
+			&i.Reached50,
+			&i.Reached75,
+			&i.Reached100,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const statsSessionBreakdown = `-- name: StatsSessionBreakdown :many
+SELECT
+    COALESCE(CASE $1::text
+        WHEN 'country' THEN sessions.country
+        WHEN 'browser' THEN sessions.browser
+        WHEN 'os' THEN sessions.os
+        WHEN 'device_type' THEN sessions.device_type
+        WHEN 'entry_path' THEN sessions.entry_path
+        WHEN 'exit_path' THEN sessions.exit_path
+        WHEN 'utm_source' THEN sessions.utm_source
+        WHEN 'utm_medium' THEN sessions.utm_medium
+        WHEN 'utm_campaign' THEN sessions.utm_campaign
+        WHEN 'utm_content' THEN sessions.utm_content
+        WHEN 'utm_term' THEN sessions.utm_term
+    END, '')::text AS value,
+    COUNT(DISTINCT sessions.visitor_id)::bigint AS visitors,
+    COUNT(*)::bigint AS sessions,
+    COALESCE(AVG(CASE WHEN sessions.bounce THEN 1.0 ELSE 0.0 END), 0)::float8 AS bounce_rate
+FROM sessions
+JOIN domains ON domains.domain_id = sessions.domain_id
+WHERE ($2::text = '' OR domains.domain_name = $2::text)
+AND sessions.created_at >= $3::timestamptz
+AND sessions.created_at < $4::timestamptz
+AND ($5::boolean OR NOT sessions.bot)
+GROUP BY value
+ORDER BY sessions DESC, value
+LIMIT $6::int
+`
+
+type StatsSessionBreakdownParams struct {
+	Field       string
+	Domain      string
+	StartTime   pgtype.Timestamptz
+	EndTime     pgtype.Timestamptz
+	IncludeBots bool
+	RowLimit    int32
+}
+
+type StatsSessionBreakdownRow struct {
+	Value      string
+	Visitors   int64
+	Sessions   int64
+	BounceRate float64
+}
+
+// -- field must be one of the session columns in the CASE below ----
+func (q *Queries) StatsSessionBreakdown(ctx context.Context, arg StatsSessionBreakdownParams) ([]StatsSessionBreakdownRow, error) {
+	rows, err := q.db.Query(ctx, statsSessionBreakdown,
+		arg.Field,
+		arg.Domain,
+		arg.StartTime,
+		arg.EndTime,
+		arg.IncludeBots,
+		arg.RowLimit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []StatsSessionBreakdownRow
+	for rows.Next() {
+		var i StatsSessionBreakdownRow
+		if err := rows.Scan(
+			&i.Value,
+			&i.Visitors,
+			&i.Sessions,
+			&i.BounceRate,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const statsSummary = `-- name: StatsSummary :one
+WITH filtered_sessions AS (
+    SELECT sessions.id, sessions.visitor_id, sessions.bounce, sessions.duration
+    FROM sessions
+    JOIN domains ON domains.domain_id = sessions.domain_id
+    WHERE ($1::text = '' OR domains.domain_name = $1::text)
+    AND sessions.created_at >= $2::timestamptz
+    AND sessions.created_at < $3::timestamptz
+    AND ($4::boolean OR NOT sessions.bot)
+)
+SELECT
+    COUNT(DISTINCT visitor_id)::bigint AS visitors,
+    COUNT(*)::bigint AS sessions,
+    (SELECT COUNT(*) FROM events
+        JOIN filtered_sessions ON filtered_sessions.id = events.session_id
+        WHERE events.name IN ('load', 'pageview')
+    )::bigint AS pageviews,
+    COALESCE(AVG(CASE WHEN bounce THEN 1.0 ELSE 0.0 END), 0)::float8 AS bounce_rate,
+    COALESCE(AVG(duration), 0)::float8 AS avg_duration
+FROM filtered_sessions
+`
+
+type StatsSummaryParams struct {
+	Domain      string
+	StartTime   pgtype.Timestamptz
+	EndTime     pgtype.Timestamptz
+	IncludeBots bool
+}
+
+type StatsSummaryRow struct {
+	Visitors    int64
+	Sessions    int64
+	Pageviews   int64
+	BounceRate  float64
+	AvgDuration float64
+}
+
+func (q *Queries) StatsSummary(ctx context.Context, arg StatsSummaryParams) (StatsSummaryRow, error) {
+	row := q.db.QueryRow(ctx, statsSummary,
+		arg.Domain,
+		arg.StartTime,
+		arg.EndTime,
+		arg.IncludeBots,
+	)
+	var i StatsSummaryRow
+	err := row.Scan(
+		&i.Visitors,
+		&i.Sessions,
+		&i.Pageviews,
+		&i.BounceRate,
+		&i.AvgDuration,
+	)
+	return i, err
+}
+
+const statsTopPaths = `-- name: StatsTopPaths :many
+SELECT
+    events.path,
+    COUNT(*)::bigint AS pageviews,
+    COUNT(DISTINCT events.visitor_id)::bigint AS visitors
+FROM events
+JOIN domains ON domains.domain_id = events.domain_id
+JOIN sessions ON sessions.id = events.session_id
+WHERE events.name IN ('load', 'pageview')
+AND ($1::text = '' OR domains.domain_name = $1::text)
+AND events.created_at >= $2::timestamptz
+AND events.created_at < $3::timestamptz
+AND ($4::boolean OR NOT sessions.bot)
+GROUP BY events.path
+ORDER BY pageviews DESC, events.path
+LIMIT $5::int
+`
+
+type StatsTopPathsParams struct {
+	Domain      string
+	StartTime   pgtype.Timestamptz
+	EndTime     pgtype.Timestamptz
+	IncludeBots bool
+	RowLimit    int32
+}
+
+type StatsTopPathsRow struct {
+	Path      string
+	Pageviews int64
+	Visitors  int64
+}
+
+func (q *Queries) StatsTopPaths(ctx context.Context, arg StatsTopPathsParams) ([]StatsTopPathsRow, error) {
+	rows, err := q.db.Query(ctx, statsTopPaths,
+		arg.Domain,
+		arg.StartTime,
+		arg.EndTime,
+		arg.IncludeBots,
+		arg.RowLimit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []StatsTopPathsRow
+	for rows.Next() {
+		var i StatsTopPathsRow
+		if err := rows.Scan(
+			&i.Path,
+			&i.Pageviews,
+			&i.Visitors,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const statsTopReferrers = `-- name: StatsTopReferrers :many
+SELECT
+    events.referrer,
+    COUNT(DISTINCT events.session_id)::bigint AS sessions,
+    COUNT(DISTINCT events.visitor_id)::bigint AS visitors
+FROM events
+JOIN domains ON domains.domain_id = events.domain_id
+JOIN sessions ON sessions.id = events.session_id
+WHERE events.name = 'load'
+AND events.referrer != ''
+AND ($1::text = '' OR domains.domain_name = $1::text)
+AND events.created_at >= $2::timestamptz
+AND events.created_at < $3::timestamptz
+AND ($4::boolean OR NOT sessions.bot)
+GROUP BY events.referrer
+ORDER BY sessions DESC, events.referrer
+LIMIT $5::int
+`
+
+type StatsTopReferrersParams struct {
+	Domain      string
+	StartTime   pgtype.Timestamptz
+	EndTime     pgtype.Timestamptz
+	IncludeBots bool
+	RowLimit    int32
+}
+
+type StatsTopReferrersRow struct {
+	Referrer string
+	Sessions int64
+	Visitors int64
+}
+
+func (q *Queries) StatsTopReferrers(ctx context.Context, arg StatsTopReferrersParams) ([]StatsTopReferrersRow, error) {
+	rows, err := q.db.Query(ctx, statsTopReferrers,
+		arg.Domain,
+		arg.StartTime,
+		arg.EndTime,
+		arg.IncludeBots,
+		arg.RowLimit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []StatsTopReferrersRow
+	for rows.Next() {
+		var i StatsTopReferrersRow
+		if err := rows.Scan(
+			&i.Referrer,
+			&i.Sessions,
+			&i.Visitors,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
 const updateSalt = `-- name: UpdateSalt :exec
 DO $$
 BEGIN
@@ -263,28 +1007,6 @@ func (q *Queries) UpdateSalt(ctx context.Context) error {
 	return err
 }
 
-const updateSession = `-- name: UpdateSession :exec
-UPDATE sessions 
-SET 
-    bounce = CASE WHEN $3::text NOT IN ('hidden', 'ping') THEN FALSE ELSE bounce END,
-    updated_at = CURRENT_TIMESTAMP,
-    exit_path = $1,
-    duration = EXTRACT(EPOCH FROM (CURRENT_TIMESTAMP - created_at))
-WHERE id = $2
-`
-
-type UpdateSessionParams struct {
-	ExitPath  string
-	ID        int64
-	EventName string
-}
-
-// -- MUST call this in a transaction after GetSession ----
-func (q *Queries) UpdateSession(ctx context.Context, arg UpdateSessionParams) error {
-	_, err := q.db.Exec(ctx, updateSession, arg.ExitPath, arg.ID, arg.EventName)
-	return err
-}
-
 const upsertDomain = `-- name: UpsertDomain :one
 INSERT INTO domains (domain_name)
 VALUES ($1)
@@ -299,3 +1021,204 @@ func (q *Queries) UpsertDomain(ctx context.Context, domainName string) (int32, e
 	err := row.Scan(&domain_id)
 	return domain_id, err
 }
+
+const upsertJSError = `-- name: UpsertJSError :exec
+INSERT INTO js_errors (
+    fingerprint, domain_id, message, source, line, col, stack, path, occurrences, first_seen, last_seen
+) VALUES (
+    $1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11
+)
+ON CONFLICT (fingerprint) DO UPDATE SET
+    stack = EXCLUDED.stack,
+    path = EXCLUDED.path,
+    occurrences = js_errors.occurrences + EXCLUDED.occurrences,
+    first_seen = LEAST(js_errors.first_seen, EXCLUDED.first_seen),
+    last_seen = GREATEST(js_errors.last_seen, EXCLUDED.last_seen)
+`
+
+type UpsertJSErrorParams struct {
+	Fingerprint string
+	DomainID    int32
+	Message     string
+	Source      string
+	Line        int32
+	Col         int32
+	Stack       string
+	Path        string
+	Occurrences int64
+	FirstSeen   pgtype.Timestamptz
+	LastSeen    pgtype.Timestamptz
+}
+
+func (q *Queries) UpsertJSError(ctx context.Context, arg UpsertJSErrorParams) error {
+	_, err := q.db.Exec(ctx, upsertJSError,
+		arg.Fingerprint,
+		arg.DomainID,
+		arg.Message,
+		arg.Source,
+		arg.Line,
+		arg.Col,
+		arg.Stack,
+		arg.Path,
+		arg.Occurrences,
+		arg.FirstSeen,
+		arg.LastSeen,
+	)
+	return err
+}
+
+const upsertSessions = `-- name: UpsertSessions :many
+WITH batch AS (
+    SELECT * FROM unnest(
+        $1::text[], $2::int[], $3::text[], $4::text[],
+        $5::boolean[], $6::boolean[],
+        $7::text[], $8::float8[], $9::float8[], $10::text[], $11::text[],
+        $12::text[], $13::text[], $14::text[], $15::text[], $16::text[], $17::text[],
+        $18::boolean[], $19::int[], $20::int[], $21::text[], $22::float8[], $23::int[],
+        $24::text[], $25::text[], $26::text[], $27::text[], $28::text[], $29::int[],
+        $30::timestamptz[], $31::timestamptz[], $32::int[]
+    ) AS b(
+        visitor_id, domain_id, entry_path, exit_path,
+        engaged, engaged_after_entry,
+        country, latitude, longitude, subdivision, city,
+        browser, browser_version, os, os_version, platform, device_type,
+        bot, screen_w, screen_h, timezone, pixel_ratio, pixel_depth,
+        utm_source, utm_medium, utm_campaign, utm_content, utm_term, session_timeout_min,
+        first_event_time, last_event_time, engaged_ms
+    )
+), existing AS (
+    SELECT DISTINCT ON (sessions.visitor_id) sessions.id, sessions.visitor_id
+    FROM sessions JOIN batch ON sessions.visitor_id = batch.visitor_id
+    WHERE sessions.updated_at > batch.first_event_time - make_interval(mins => batch.session_timeout_min)
+    AND sessions.updated_at <= batch.first_event_time + make_interval(mins => batch.session_timeout_min)
+    -- partitioned sessions are bounded, so only recent partitions are searched
+    AND sessions.created_at >= $33::timestamptz
+    ORDER BY sessions.visitor_id, sessions.updated_at DESC
+), updated AS (
+    UPDATE sessions
+    SET
+        bounce = CASE WHEN batch.engaged THEN FALSE ELSE sessions.bounce END,
+        updated_at = GREATEST(sessions.updated_at, batch.last_event_time),
+        exit_path = batch.exit_path,
+        duration = EXTRACT(EPOCH FROM (GREATEST(sessions.updated_at, batch.last_event_time) - sessions.created_at)),
+        engaged_seconds = sessions.engaged_seconds + ROUND(batch.engaged_ms / 1000.0)
+    FROM existing JOIN batch ON batch.visitor_id = existing.visitor_id
+    WHERE sessions.id = existing.id
+    RETURNING sessions.id, sessions.visitor_id
+), created AS (
+    INSERT INTO sessions (
+        created_at, updated_at, bounce, domain_id, exit_path,
+        visitor_id, entry_path,
+        country, latitude, longitude, subdivision, city,
+        browser, browser_version, os, os_version, platform, device_type, bot, screen_w, screen_h, timezone, pixel_ratio, pixel_depth,
+        utm_source, utm_medium, utm_campaign, utm_content, utm_term, engaged_seconds
+    )
+    SELECT
+        batch.first_event_time, batch.last_event_time, NOT batch.engaged_after_entry, batch.domain_id, batch.exit_path,
+        batch.visitor_id, batch.entry_path,
+        batch.country, batch.latitude, batch.longitude, batch.subdivision, batch.city,
+        batch.browser, batch.browser_version, batch.os, batch.os_version, batch.platform, batch.device_type, batch.bot, batch.screen_w, batch.screen_h, batch.timezone, batch.pixel_ratio, batch.pixel_depth,
+        batch.utm_source, batch.utm_medium, batch.utm_campaign, batch.utm_content, batch.utm_term, ROUND(batch.engaged_ms / 1000.0)
+    FROM batch
+    WHERE NOT EXISTS (SELECT 1 FROM existing WHERE existing.visitor_id = batch.visitor_id)
+    RETURNING sessions.id, sessions.visitor_id
+)
+SELECT id, visitor_id FROM updated
+UNION ALL
+SELECT id, visitor_id FROM created
+`
+
+type UpsertSessionsParams struct {
+	VisitorIds         []string
+	DomainIds          []int32
+	EntryPaths         []string
+	ExitPaths          []string
+	Engaged            []bool
+	EngagedAfterEntry  []bool
+	Countries          []string
+	Latitudes          []float64
+	Longitudes         []float64
+	Subdivisions       []string
+	Cities             []string
+	Browsers           []string
+	BrowserVersions    []string
+	Oses               []string
+	OsVersions         []string
+	Platforms          []string
+	DeviceTypes        []string
+	Bots               []bool
+	ScreenWs           []int32
+	ScreenHs           []int32
+	Timezones          []string
+	PixelRatios        []float64
+	PixelDepths        []int32
+	UtmSources         []string
+	UtmMediums         []string
+	UtmCampaigns       []string
+	UtmContents        []string
+	UtmTerms           []string
+	SessionTimeoutMins []int32
+	FirstEventTimes    []pgtype.Timestamptz
+	LastEventTimes     []pgtype.Timestamptz
+	EngagedMs          []int32
+	CreatedAfter       pgtype.Timestamptz
+}
+
+type UpsertSessionsRow struct {
+	ID        int64
+	VisitorID pgtype.Text
+}
+
+func (q *Queries) UpsertSessions(ctx context.Context, arg UpsertSessionsParams) ([]UpsertSessionsRow, error) {
+	rows, err := q.db.Query(ctx, upsertSessions,
+		arg.VisitorIds,
+		arg.DomainIds,
+		arg.EntryPaths,
+		arg.ExitPaths,
+		arg.Engaged,
+		arg.EngagedAfterEntry,
+		arg.Countries,
+		arg.Latitudes,
+		arg.Longitudes,
+		arg.Subdivisions,
+		arg.Cities,
+		arg.Browsers,
+		arg.BrowserVersions,
+		arg.Oses,
+		arg.OsVersions,
+		arg.Platforms,
+		arg.DeviceTypes,
+		arg.Bots,
+		arg.ScreenWs,
+		arg.ScreenHs,
+		arg.Timezones,
+		arg.PixelRatios,
+		arg.PixelDepths,
+		arg.UtmSources,
+		arg.UtmMediums,
+		arg.UtmCampaigns,
+		arg.UtmContents,
+		arg.UtmTerms,
+		arg.SessionTimeoutMins,
+		arg.FirstEventTimes,
+		arg.LastEventTimes,
+		arg.EngagedMs,
+		arg.CreatedAfter,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []UpsertSessionsRow
+	for rows.Next() {
+		var i UpsertSessionsRow
+		if err := rows.Scan(&i.ID, &i.VisitorID); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
@@ -1,53 +1,214 @@
 package picolytics
 
 import (
+	"errors"
 	"fmt"
 	"net/url"
 	"strings"
+	"unicode/utf8"
 
 	"github.com/cespare/xxhash"
 )
 
 type AsyncEventSaver struct {
-	events          chan PicolyticsEvent
-	salter          Salter
-	validEventNames []string
-	o11y            *PicolyticsO11y
+	events      chan PicolyticsEvent
+	spool       *Spool
+	salter      Salter
+	queryParams *QueryParams
+	sites       *Sites
+	o11y        *PicolyticsO11y
 }
 
-func NewAsyncEventSaver(events chan PicolyticsEvent, salter Salter, validEventNames []string, o11y *PicolyticsO11y) *AsyncEventSaver {
+func NewAsyncEventSaver(events chan PicolyticsEvent, spool *Spool, salter Salter, queryParams *QueryParams, sites *Sites, o11y *PicolyticsO11y) *AsyncEventSaver {
 	return &AsyncEventSaver{
-		events:          events,
-		salter:          salter,
-		validEventNames: validEventNames,
-		o11y:            o11y,
+		events:      events,
+		spool:       spool,
+		salter:      salter,
+		queryParams: queryParams,
+		sites:       sites,
+		o11y:        o11y,
 	}
 }
 
-func (es *AsyncEventSaver) SaveEvent(event PicolyticsEvent) {
-	if err := parseEvent(&event, es.validEventNames); err != nil {
-		es.o11y.Metrics.eventErrors.WithLabelValues("parse").Add(1)
-		es.o11y.Logger.Info("error parsing event", "error", err)
-		return
+// SaveEvent validates and queues an event, and returns an error if it was rejected.
+func (es *AsyncEventSaver) SaveEvent(event PicolyticsEvent) error {
+	if err := parseEvent(&event, es.sites, es.queryParams); err != nil {
+		switch {
+		case errors.Is(err, errUnknownSite):
+			es.o11y.Metrics.eventErrors.WithLabelValues("unknown_site").Add(1)
+			es.o11y.Logger.Debug("rejected event", "error", err) // debug level, since these are often from bots
+		case errors.Is(err, errOriginMismatch):
+			es.o11y.Metrics.eventErrors.WithLabelValues("origin_mismatch").Add(1)
+			es.o11y.Logger.Debug("rejected event", "error", err)
+		default:
+			es.o11y.Metrics.eventErrors.WithLabelValues("parse").Add(1)
+			es.o11y.Logger.Info("error parsing event", "error", err)
+		}
+		return err
 	}
 	event.VisitorID = createVisitID(&event, es.salter, es.o11y)
 	es.o11y.Metrics.ingestedEvents.WithLabelValues(event.Domain).Add(1)
+	if es.spool != nil { // the worker is fed from the spool
+		if err := es.spool.append(event); err != nil {
+			if err == errSpoolFull {
+				es.o11y.Metrics.eventErrors.WithLabelValues("spool_full").Add(1)
+			} else {
+				es.o11y.Metrics.eventErrors.WithLabelValues("spool_write").Add(1)
+			}
+			es.o11y.Logger.Info("error spooling event", "error", err)
+			return err
+		}
+		return nil
+	}
 	if err := queueEvent(es.events, event); err != nil {
 		es.o11y.Metrics.eventErrors.WithLabelValues("enqueue").Add(1)
 		es.o11y.Logger.Info("error queueing event", "error", err)
-		return
+		return err
 	}
+	return nil
 }
 
-func parseEvent(event *PicolyticsEvent, validEventNames []string) error {
-	if !validEventName(validEventNames, event.Name) {
+// parseEvent validates the event against its site's settings, and resolves the site
+func parseEvent(event *PicolyticsEvent, sites *Sites, queryParams *QueryParams) error {
+	if !validEventName(sites.forEvent(event).validEventNames, event.Name) {
 		return fmt.Errorf("invalid event name: %s", event.Name)
 	}
 	var err error
-	event.Domain, event.Path, err = extractDomainPath(event.Location)
+	var query url.Values
+	event.Domain, event.Path, query, err = extractDomainPath(event.Location)
 	if err != nil {
 		return err
 	}
+	if len(event.DomainOverride) > 0 {
+		if !validHostname(event.DomainOverride) {
+			return fmt.Errorf("invalid domain override: %q", event.DomainOverride)
+		}
+		event.Domain = siteHost(event.DomainOverride) // must be a registered site, checked by resolve
+	}
+	if err := sites.resolve(event); err != nil {
+		return err
+	}
+	route := ""
+	if event.HashRoutes {
+		route = hashRoute(event.Location)
+	}
+	queryParams.apply(event, query)
+	event.Path += route
+	if err := validateProps(event.Props); err != nil {
+		return fmt.Errorf("invalid event props: %v", err)
+	}
+	if err := validateVitals(event); err != nil {
+		return fmt.Errorf("invalid web vitals: %v", err)
+	}
+	if len(event.Target) > 0 {
+		if event.Target, err = sanitizeTarget(event.Target); err != nil {
+			return fmt.Errorf("invalid target: %v", err)
+		}
+	}
+	if event.EngagedMs < 0 || event.EngagedMs > engagedMaxMs {
+		return fmt.Errorf("invalid engagement time: %d", event.EngagedMs)
+	}
+	if event.ScrollDepth != nil && (*event.ScrollDepth < 0 || *event.ScrollDepth > 100) {
+		return fmt.Errorf("invalid scroll depth: %d", *event.ScrollDepth)
+	}
+	if event.Name == "error" {
+		if err := sanitizeJSError(event); err != nil {
+			return fmt.Errorf("invalid error event: %v", err)
+		}
+	}
+	return nil
+}
+
+const (
+	errorMessageMaxLen = 512
+	errorStackMaxLen   = 2048
+)
+
+// sanitizeJSError requires a message, and truncates long messages and stacks. Like link
+// targets, the script URL's query string and fragment are removed.
+func sanitizeJSError(event *PicolyticsEvent) error {
+	if len(event.ErrorMessage) < 1 {
+		return fmt.Errorf("missing message")
+	}
+	if event.ErrorLine < 0 || event.ErrorColumn < 0 {
+		return fmt.Errorf("invalid position: %d:%d", event.ErrorLine, event.ErrorColumn)
+	}
+	if i := strings.IndexAny(event.ErrorSource, "?#"); i >= 0 {
+		event.ErrorSource = event.ErrorSource[:i]
+	}
+	event.ErrorMessage = truncate(event.ErrorMessage, errorMessageMaxLen)
+	event.ErrorSource = truncate(event.ErrorSource, targetMaxLen)
+	event.ErrorStack = truncate(event.ErrorStack, errorStackMaxLen)
+	return nil
+}
+
+const engagedMaxMs = 24 * 60 * 60 * 1000 // a day, more than any page could hold attention
+
+const targetMaxLen = 1024
+
+// sanitizeTarget reduces a link URL to its scheme, host, and path, since query strings
+// and fragments can hold tokens and personal data
+func sanitizeTarget(target string) (string, error) {
+	parsedURL, err := url.Parse(target)
+	if err != nil {
+		return "", err
+	}
+	if parsedURL.Scheme != "http" && parsedURL.Scheme != "https" {
+		return "", fmt.Errorf("unsupported scheme: %q", parsedURL.Scheme)
+	}
+	if len(parsedURL.Hostname()) < 1 {
+		return "", fmt.Errorf("missing host")
+	}
+	sanitized := url.URL{Scheme: parsedURL.Scheme, Host: strings.ToLower(parsedURL.Host), Path: parsedURL.Path}
+	return truncate(sanitized.String(), targetMaxLen), nil
+}
+
+const (
+	vitalsMaxMs  = 120000 // 2 minutes, far beyond "poor" for any timing
+	vitalsMaxCLS = 100
+)
+
+// validateVitals rejects implausible web vitals, so they don't skew percentiles
+func validateVitals(event *PicolyticsEvent) error {
+	for _, v := range []struct {
+		name string
+		ms   *int32
+	}{{"lcp", event.LCP}, {"inp", event.INP}, {"fcp", event.FCP}} {
+		if v.ms != nil && (*v.ms < 0 || *v.ms > vitalsMaxMs) {
+			return fmt.Errorf("%s out of range: %d", v.name, *v.ms)
+		}
+	}
+	if event.CLS != nil && (*event.CLS < 0 || *event.CLS > vitalsMaxCLS) {
+		return fmt.Errorf("cls out of range: %v", *event.CLS)
+	}
+	return nil
+}
+
+const (
+	propsMaxKeys     = 16
+	propsMaxKeyLen   = 64
+	propsMaxValueLen = 256
+)
+
+// validateProps limits custom event properties to a small, flat map of strings, numbers, and booleans
+func validateProps(props map[string]interface{}) error {
+	if len(props) > propsMaxKeys {
+		return fmt.Errorf("too many keys: %d > %d", len(props), propsMaxKeys)
+	}
+	for k, v := range props {
+		if len(k) < 1 || len(k) > propsMaxKeyLen {
+			return fmt.Errorf("invalid key length: %q", k)
+		}
+		switch val := v.(type) {
+		case string:
+			if len(val) > propsMaxValueLen {
+				return fmt.Errorf("value too long for key: %q", k)
+			}
+		case float64, bool:
+		default:
+			return fmt.Errorf("unsupported value type for key %q: %T", k, v)
+		}
+	}
 	return nil
 }
 
@@ -70,15 +231,137 @@ func createVisitID(event *PicolyticsEvent, salter Salter, o11y *PicolyticsO11y)
 	return fmt.Sprintf("%x", hash)
 }
 
-func extractDomainPath(eventURL string) (string, string, error) {
+func extractDomainPath(eventURL string) (string, string, url.Values, error) {
 	if len(eventURL) < 1 {
-		return "", "", fmt.Errorf("missing event url")
+		return "", "", nil, fmt.Errorf("missing event url")
 	}
 	parsedURL, err := url.Parse(eventURL)
 	if err != nil {
-		return "", "", fmt.Errorf("parsing url %s: %v", eventURL, err)
+		return "", "", nil, fmt.Errorf("parsing url %s: %v", eventURL, err)
+	}
+	return strings.TrimPrefix(parsedURL.Hostname(), "www."), parsedURL.Path, parsedURL.Query(), nil
+}
+
+// hashRoute returns the route from a hash-routed app's URL fragment, e.g. "#/users" for
+// "#/users?tab=2". Like the URL's, the fragment's query string is discarded.
+func hashRoute(eventURL string) string {
+	parsedURL, err := url.Parse(eventURL)
+	if err != nil || len(parsedURL.Fragment) < 1 {
+		return ""
+	}
+	route, _, _ := strings.Cut(parsedURL.Fragment, "?")
+	if len(route) < 1 {
+		return ""
+	}
+	return "#" + route
+}
+
+const hostnameMaxLen = 253
+
+// validHostname allows DNS hostnames: letters, digits, dots, and hyphens
+func validHostname(host string) bool {
+	if len(host) < 1 || len(host) > hostnameMaxLen {
+		return false
+	}
+	for _, r := range host {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// QueryParams controls how the event URL query string is used: UTM and source parameters
+// populate the UTM fields, allowed parameters are kept in the path, and the rest are discarded.
+type QueryParams struct {
+	sources []sourceParam
+	allowed map[string]bool
+}
+
+type sourceParam struct {
+	name   string
+	source string // if empty, the parameter value is the source
+}
+
+const utmMaxLen = 256
+
+// NewQueryParams parses source params, which are either a parameter name like "ref",
+// whose value is used as utm_source, or a click ID mapped to a fixed source like "gclid=google".
+func NewQueryParams(sourceParams, allowedParams []string) (*QueryParams, error) {
+	qp := QueryParams{allowed: map[string]bool{}}
+	for _, p := range sourceParams {
+		name, source, _ := strings.Cut(p, "=")
+		if len(name) < 1 {
+			return nil, fmt.Errorf("invalid source param: %q", p)
+		}
+		qp.sources = append(qp.sources, sourceParam{name: name, source: source})
+	}
+	for _, p := range allowedParams {
+		qp.allowed[p] = true
+	}
+	return &qp, nil
+}
+
+// apply fills empty UTM fields from the query, then strips all but the allowed params from the event location
+func (qp *QueryParams) apply(event *PicolyticsEvent, query url.Values) {
+	utmFields := []struct {
+		param string
+		value *string
+	}{
+		{"utm_source", &event.UtmSource},
+		{"utm_medium", &event.UtmMedium},
+		{"utm_campaign", &event.UtmCampaign},
+		{"utm_content", &event.UtmContent},
+		{"utm_term", &event.UtmTerm},
+	}
+	for _, f := range utmFields {
+		if len(*f.value) < 1 {
+			*f.value = truncate(query.Get(f.param), utmMaxLen)
+		}
+	}
+
+	kept := url.Values{}
+	if qp != nil {
+		for _, sp := range qp.sources {
+			if len(event.UtmSource) > 0 {
+				break
+			}
+			if !query.Has(sp.name) {
+				continue
+			}
+			if len(sp.source) > 0 {
+				event.UtmSource = sp.source
+			} else {
+				event.UtmSource = truncate(query.Get(sp.name), utmMaxLen)
+			}
+		}
+		for name, values := range query {
+			if qp.allowed[name] {
+				kept[name] = values
+			}
+		}
+	}
+
+	if i := strings.IndexAny(event.Location, "?#"); i >= 0 {
+		event.Location = event.Location[:i]
+	}
+	if len(kept) > 0 {
+		event.Path += "?" + kept.Encode()
+		event.Location += "?" + kept.Encode()
+	}
+}
+
+// truncate shortens s to at most maxLen bytes, without splitting a multi-byte character.
+// Invalid UTF-8, which postgres would reject, is replaced first.
+func truncate(s string, maxLen int) string {
+	s = strings.ToValidUTF8(s, "\uFFFD")
+	if len(s) <= maxLen {
+		return s
+	}
+	for maxLen > 0 && !utf8.RuneStart(s[maxLen]) {
+		maxLen--
 	}
-	return strings.TrimPrefix(parsedURL.Hostname(), "www."), parsedURL.Path, nil
+	return s[:maxLen]
 }
 
 func queueEvent(events chan PicolyticsEvent, event PicolyticsEvent) error {
@@ -0,0 +1,261 @@
+package picolytics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"github.com/nmcclain/picolytics/picolytics/db"
+)
+
+// GoalConfig defines a conversion goal. Sessions convert when they view a matching path, or
+// record a matching event. Exactly one of Path, PathRegex, or Event must be set.
+type GoalConfig struct {
+	Name      string `mapstructure:"name"`
+	Domain    string `mapstructure:"domain"`    // if empty, the goal applies to every domain
+	Path      string `mapstructure:"path"`      // glob: "*" matches within a path segment, "**" across segments
+	PathRegex string `mapstructure:"pathRegex"` // matched by postgres, so must be valid in both Go and postgres
+	Event     string `mapstructure:"event"`
+}
+
+// goal is a validated GoalConfig, with path globs compiled to regexes.
+type goal struct {
+	name      string
+	domain    string
+	pathRegex string
+	event     string
+}
+
+const (
+	goalLag   = 5 * time.Minute // events are batched and saved within seconds
+	goalChunk = 24 * time.Hour  // max range converted in one transaction
+)
+
+// parseGoals validates the goal definitions.
+func parseGoals(configs []GoalConfig) ([]goal, error) {
+	goals := []goal{}
+	names := map[string]bool{}
+	for _, gc := range configs {
+		g := goal{
+			name:   strings.TrimSpace(gc.Name),
+			domain: siteHost(gc.Domain),
+			event:  strings.TrimSpace(gc.Event),
+		}
+		if len(g.name) < 1 {
+			return nil, fmt.Errorf("goal missing name")
+		}
+		if names[g.name] {
+			return nil, fmt.Errorf("duplicate goal: %s", g.name)
+		}
+		names[g.name] = true
+		matchers := 0
+		for _, m := range []string{gc.Path, gc.PathRegex, g.event} {
+			if len(m) > 0 {
+				matchers++
+			}
+		}
+		if matchers != 1 {
+			return nil, fmt.Errorf("goal %s must have exactly one of path, pathRegex, or event", g.name)
+		}
+		switch {
+		case len(gc.Path) > 0:
+			g.pathRegex = globToRegex(gc.Path)
+		case len(gc.PathRegex) > 0:
+			if _, err := regexp.Compile(gc.PathRegex); err != nil {
+				return nil, fmt.Errorf("goal %s has invalid pathRegex: %v", g.name, err)
+			}
+			g.pathRegex = gc.PathRegex
+		}
+		goals = append(goals, g)
+	}
+	return goals, nil
+}
+
+// globToRegex converts a path glob to an anchored regex, the same way the tracker
+// converts data-exclude globs.
+func globToRegex(glob string) string {
+	re := regexp.QuoteMeta(strings.TrimSpace(glob))
+	re = strings.ReplaceAll(re, `\*\*`, "\x00")
+	re = strings.ReplaceAll(re, `\*`, "[^/]*")
+	re = strings.ReplaceAll(re, "\x00", ".*")
+	return "^" + re + "$"
+}
+
+// GoalConverter incrementally marks the sessions that reached each goal, by adding the
+// goal's name to sessions.converted_goals. Each goal keeps its own watermark in
+// rollup_watermarks, so new goals are backfilled from the oldest raw row. Ranges with
+// events saved since the last run are converted again, the same way the Aggregator refolds.
+type GoalConverter struct {
+	config     *Config
+	pool       PgxIface
+	o11y       *PicolyticsO11y
+	client     *db.Queries
+	goals      []goal
+	lateWindow time.Duration
+	late       lateEvents
+	lock       sync.Mutex
+}
+
+// NewGoalConverter parses the goals, and checks that postgres can compile their path regexes.
+func NewGoalConverter(config *Config, pool PgxIface, o11y *PicolyticsO11y) (*GoalConverter, error) {
+	goals, err := parseGoals(config.Goals)
+	if err != nil {
+		return nil, err
+	}
+	g := GoalConverter{
+		config:     config,
+		pool:       pool,
+		o11y:       o11y,
+		client:     db.New(pool),
+		goals:      goals,
+		lateWindow: lateWindow(config),
+	}
+	for _, gl := range g.goals {
+		if len(gl.pathRegex) < 1 {
+			continue
+		}
+		if _, err := g.client.CheckPathRegex(context.Background(), gl.pathRegex); err != nil {
+			return nil, fmt.Errorf("goal %s has invalid pathRegex: %v", gl.name, err)
+		}
+	}
+	return &g, nil
+}
+
+func (g *GoalConverter) convert() {
+	g.late.saved(time.Now().Add(-g.lateWindow))
+	ticker := time.NewTicker(time.Minute * time.Duration(g.config.GoalCheckMin))
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := g.convertAll(context.Background(), time.Now()); err != nil {
+			g.o11y.Logger.Error("goal conversion error", "error", err)
+		}
+	}
+}
+
+// convertAll converts every goal up to the lag before now, after converting the range
+// since the oldest event saved since the last run again. A failing goal doesn't stop the others.
+func (g *GoalConverter) convertAll(ctx context.Context, now time.Time) error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	lateSince := g.late.take()
+	var errs []error
+	for _, gl := range g.goals {
+		if err := g.convertGoal(ctx, gl, now, lateSince); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 && !lateSince.IsZero() {
+		g.late.saved(lateSince) // try again next time
+	}
+	return errors.Join(errs...)
+}
+
+func (g *GoalConverter) convertGoal(ctx context.Context, gl goal, now, lateSince time.Time) error {
+	watermark, err := g.watermark(ctx, gl)
+	if err != nil {
+		return fmt.Errorf("error getting goal %s watermark: %v", gl.name, err)
+	}
+	start := lateSince.Truncate(time.Minute)
+	for !lateSince.IsZero() && start.Before(watermark) {
+		next := start.Add(goalChunk)
+		if next.After(watermark) {
+			next = watermark
+		}
+		converted, err := g.convertRange(ctx, gl, start, next, false)
+		if err != nil {
+			return fmt.Errorf("error converting goal %s again: %v", gl.name, err)
+		}
+		g.o11y.Metrics.goalConversions.WithLabelValues(gl.name).Add(float64(converted))
+		g.o11y.Logger.Debug("Converted goal again", "goal", gl.name, "from", start, "to", next, "sessions", converted)
+		start = next
+	}
+	end := now.Add(-goalLag).Truncate(time.Minute)
+	for watermark.Before(end) {
+		next := watermark.Add(goalChunk)
+		if next.After(end) {
+			next = end
+		}
+		converted, err := g.convertRange(ctx, gl, watermark, next, true)
+		if err != nil {
+			return fmt.Errorf("error converting goal %s: %v", gl.name, err)
+		}
+		g.o11y.Metrics.goalConversions.WithLabelValues(gl.name).Add(float64(converted))
+		g.o11y.Logger.Debug("Converted goal", "goal", gl.name, "from", watermark, "to", next, "sessions", converted)
+		watermark = next
+	}
+	return nil
+}
+
+func goalWatermarkName(gl goal) string {
+	return "goal:" + gl.name
+}
+
+// rewindGoals moves each goal's watermark back to since, if it's later, so events saved
+// behind the watermarks by another process, like imported logs, are converted on the next run.
+func rewindGoals(ctx context.Context, client *db.Queries, goals []GoalConfig, since time.Time) error {
+	for _, gc := range goals {
+		err := client.RewindRollupWatermark(ctx, db.RewindRollupWatermarkParams{
+			Rollup:     goalWatermarkName(goal{name: gc.Name}),
+			RolledUpTo: newPGTimestamptz(since.UTC().Truncate(time.Minute)),
+		})
+		if err != nil {
+			return fmt.Errorf("error rewinding goal %s watermark: %v", gc.Name, err)
+		}
+	}
+	return nil
+}
+
+// watermark returns where to resume converting. New goals start at the oldest raw row.
+func (g *GoalConverter) watermark(ctx context.Context, gl goal) (time.Time, error) {
+	watermark, err := g.client.GetRollupWatermark(ctx, goalWatermarkName(gl))
+	if err == nil {
+		return watermark.Time, nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return time.Time{}, err
+	}
+	start, err := g.client.GetRollupStartTime(ctx)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return start.Time.UTC().Truncate(time.Minute), nil
+}
+
+// convertRange marks the sessions with matching events in [start, end), and optionally
+// advances the watermark, in one transaction. Sessions are only marked once, so ranges can
+// be converted again. It returns the number of sessions converted.
+func (g *GoalConverter) convertRange(ctx context.Context, gl goal, start, end time.Time, advance bool) (converted int64, err error) {
+	tx, err := g.pool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback(ctx)
+		}
+	}()
+	txClient := g.client.WithTx(tx)
+	converted, err = txClient.ConvertGoal(ctx, db.ConvertGoalParams{
+		Goal:      gl.name,
+		StartTime: newPGTimestamptz(start),
+		EndTime:   newPGTimestamptz(end),
+		Domain:    gl.domain,
+		EventName: gl.event,
+		PathRegex: gl.pathRegex,
+	})
+	if err != nil {
+		return 0, err
+	}
+	if advance {
+		if err = txClient.SetRollupWatermark(ctx, db.SetRollupWatermarkParams{Rollup: goalWatermarkName(gl), RolledUpTo: newPGTimestamptz(end)}); err != nil {
+			return 0, err
+		}
+	}
+	return converted, tx.Commit(ctx)
+}
@@ -0,0 +1,237 @@
+package picolytics
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/pashagolub/pgxmock/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseGoals(t *testing.T) {
+	tests := []struct {
+		name    string
+		configs []GoalConfig
+		want    []goal
+		wantErr error
+	}{
+		{
+			name: "path, regex, and event goals",
+			configs: []GoalConfig{
+				{Name: "signup", Domain: "www.Example.com", Path: "/signup/*/done"},
+				{Name: "pricing", PathRegex: "^/pricing(/.*)?$"},
+				{Name: "purchase", Event: "purchase"},
+			},
+			want: []goal{
+				{name: "signup", domain: "example.com", pathRegex: "^/signup/[^/]*/done$"},
+				{name: "pricing", pathRegex: "^/pricing(/.*)?$"},
+				{name: "purchase", event: "purchase"},
+			},
+		},
+		{
+			name:    "missing name",
+			configs: []GoalConfig{{Event: "purchase"}},
+			wantErr: errors.New("goal missing name"),
+		},
+		{
+			name:    "duplicate name",
+			configs: []GoalConfig{{Name: "signup", Event: "signup"}, {Name: "signup", Path: "/signup"}},
+			wantErr: errors.New("duplicate goal: signup"),
+		},
+		{
+			name:    "no matcher",
+			configs: []GoalConfig{{Name: "signup"}},
+			wantErr: errors.New("goal signup must have exactly one of path, pathRegex, or event"),
+		},
+		{
+			name:    "two matchers",
+			configs: []GoalConfig{{Name: "signup", Path: "/signup", Event: "signup"}},
+			wantErr: errors.New("goal signup must have exactly one of path, pathRegex, or event"),
+		},
+		{
+			name:    "invalid regex",
+			configs: []GoalConfig{{Name: "signup", PathRegex: "^/signup("}},
+			wantErr: errors.New("goal signup has invalid pathRegex: error parsing regexp: missing closing ): `^/signup(`"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseGoals(tt.configs)
+			assert.Equal(t, tt.wantErr, err)
+			if tt.wantErr == nil {
+				assert.Equal(t, tt.want, got)
+			}
+		})
+	}
+}
+
+func TestGlobToRegex(t *testing.T) {
+	tests := []struct {
+		glob     string
+		matches  []string
+		excludes []string
+	}{
+		{glob: "/signup", matches: []string{"/signup"}, excludes: []string{"/signup/", "/signups", "/x/signup"}},
+		{glob: "/blog/*", matches: []string{"/blog/", "/blog/post"}, excludes: []string{"/blog/2024/post", "/blog"}},
+		{glob: "/docs/**", matches: []string{"/docs/", "/docs/a/b/c"}, excludes: []string{"/doc/a"}},
+		{glob: "/thanks.html", matches: []string{"/thanks.html"}, excludes: []string{"/thanksxhtml"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.glob, func(t *testing.T) {
+			re := regexp.MustCompile(globToRegex(tt.glob))
+			for _, path := range tt.matches {
+				assert.True(t, re.MatchString(path), path)
+			}
+			for _, path := range tt.excludes {
+				assert.False(t, re.MatchString(path), path)
+			}
+		})
+	}
+}
+
+func TestConvertAll(t *testing.T) {
+	o11yMock := &PicolyticsO11y{
+		Logger:  slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError})),
+		Metrics: setupMetrics(1, "", "", ""),
+	}
+	ts := func(day, hour, min int) interface{} {
+		return newPGTimestamptz(time.Date(2024, 1, day, hour, min, 0, 0, time.UTC))
+	}
+	now := time.Date(2024, 1, 3, 12, 2, 30, 0, time.UTC)
+	goals := []GoalConfig{
+		{Name: "signup", Domain: "example.com", Path: "/signup/done"},
+		{Name: "purchase", Event: "purchase"},
+	}
+	// the signup regex is checked by postgres at startup
+	expectCheck := func(mock pgxmock.PgxPoolIface) {
+		mock.ExpectQuery("SELECT '' ~").WithArgs("^/signup/done$").
+			WillReturnRows(mock.NewRows([]string{"matches"}).AddRow(false))
+	}
+	expectConvert := func(mock pgxmock.PgxPoolIface, args []interface{}, advance bool) {
+		mock.ExpectBegin()
+		mock.ExpectExec("UPDATE sessions").WithArgs(args...).
+			WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+		if advance {
+			mock.ExpectExec("INSERT INTO rollup_watermarks").WithArgs("goal:"+args[0].(string), args[2]).
+				WillReturnResult(pgxmock.NewResult("INSERT", 1))
+		}
+		mock.ExpectCommit()
+	}
+	expectPurchase := func(mock pgxmock.PgxPoolIface) {
+		// new goals are backfilled in chunks from the oldest raw row
+		mock.ExpectQuery("SELECT rolled_up_to FROM rollup_watermarks").WithArgs("goal:purchase").
+			WillReturnError(pgx.ErrNoRows)
+		mock.ExpectQuery("SELECT LEAST").
+			WillReturnRows(mock.NewRows([]string{"start_time"}).AddRow(newPGTimestamptz(time.Date(2024, 1, 2, 8, 30, 45, 0, time.UTC))))
+		expectConvert(mock, []interface{}{"purchase", ts(2, 8, 30), ts(3, 8, 30), "", "purchase", ""}, true)
+		expectConvert(mock, []interface{}{"purchase", ts(3, 8, 30), ts(3, 11, 57), "", "purchase", ""}, true)
+	}
+	tests := []struct {
+		name         string
+		late         time.Time
+		getMock      func() pgxmock.PgxPoolIface
+		wantSetupErr error
+		wantErr      error
+		wantLate     time.Time
+	}{
+		{
+			name: "convert from watermark and start time",
+			getMock: func() pgxmock.PgxPoolIface {
+				mock, err := pgxmock.NewPool()
+				if err != nil {
+					t.Fatal(err)
+				}
+				expectCheck(mock)
+				mock.ExpectQuery("SELECT rolled_up_to FROM rollup_watermarks").WithArgs("goal:signup").
+					WillReturnRows(mock.NewRows([]string{"rolled_up_to"}).AddRow(ts(3, 11, 0)))
+				// resumes at its watermark, and stops before the lag
+				expectConvert(mock, []interface{}{"signup", ts(3, 11, 0), ts(3, 11, 57), "example.com", "", "^/signup/done$"}, true)
+				expectPurchase(mock)
+				return mock
+			},
+		},
+		{
+			name: "late event converted again",
+			late: time.Date(2024, 1, 1, 6, 0, 30, 0, time.UTC),
+			getMock: func() pgxmock.PgxPoolIface {
+				mock, err := pgxmock.NewPool()
+				if err != nil {
+					t.Fatal(err)
+				}
+				expectCheck(mock)
+				mock.ExpectQuery("SELECT rolled_up_to FROM rollup_watermarks").WithArgs("goal:signup").
+					WillReturnRows(mock.NewRows([]string{"rolled_up_to"}).AddRow(ts(3, 11, 0)))
+				expectConvert(mock, []interface{}{"signup", ts(1, 6, 0), ts(2, 6, 0), "example.com", "", "^/signup/done$"}, false)
+				expectConvert(mock, []interface{}{"signup", ts(2, 6, 0), ts(3, 6, 0), "example.com", "", "^/signup/done$"}, false)
+				expectConvert(mock, []interface{}{"signup", ts(3, 6, 0), ts(3, 11, 0), "example.com", "", "^/signup/done$"}, false)
+				expectConvert(mock, []interface{}{"signup", ts(3, 11, 0), ts(3, 11, 57), "example.com", "", "^/signup/done$"}, true)
+				mock.ExpectQuery("SELECT rolled_up_to FROM rollup_watermarks").WithArgs("goal:purchase").
+					WillReturnRows(mock.NewRows([]string{"rolled_up_to"}).AddRow(ts(3, 11, 30)))
+				expectConvert(mock, []interface{}{"purchase", ts(1, 6, 0), ts(2, 6, 0), "", "purchase", ""}, false)
+				expectConvert(mock, []interface{}{"purchase", ts(2, 6, 0), ts(3, 6, 0), "", "purchase", ""}, false)
+				expectConvert(mock, []interface{}{"purchase", ts(3, 6, 0), ts(3, 11, 30), "", "purchase", ""}, false)
+				expectConvert(mock, []interface{}{"purchase", ts(3, 11, 30), ts(3, 11, 57), "", "purchase", ""}, true)
+				return mock
+			},
+		},
+		{
+			name: "db failure doesn't stop the other goals",
+			late: time.Date(2024, 1, 3, 9, 0, 0, 0, time.UTC),
+			getMock: func() pgxmock.PgxPoolIface {
+				mock, err := pgxmock.NewPool()
+				if err != nil {
+					t.Fatal(err)
+				}
+				expectCheck(mock)
+				mock.ExpectQuery("SELECT rolled_up_to FROM rollup_watermarks").WithArgs("goal:signup").
+					WillReturnRows(mock.NewRows([]string{"rolled_up_to"}).AddRow(ts(3, 11, 0)))
+				mock.ExpectBegin()
+				mock.ExpectExec("UPDATE sessions").WithArgs(anyArgs(6)...).
+					WillReturnError(os.ErrDeadlineExceeded)
+				mock.ExpectRollback()
+				expectPurchase(mock)
+				return mock
+			},
+			wantErr: errors.Join(errors.New("error converting goal signup again: i/o timeout")),
+			// kept, to convert again next time
+			wantLate: time.Date(2024, 1, 3, 9, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "path regex rejected by postgres",
+			getMock: func() pgxmock.PgxPoolIface {
+				mock, err := pgxmock.NewPool()
+				if err != nil {
+					t.Fatal(err)
+				}
+				mock.ExpectQuery("SELECT '' ~").WithArgs("^/signup/done$").
+					WillReturnError(errors.New("invalid regular expression"))
+				return mock
+			},
+			wantSetupErr: errors.New("goal signup has invalid pathRegex: invalid regular expression"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := tt.getMock()
+			defer mock.Close()
+			g, err := NewGoalConverter(&Config{Goals: goals}, mock, o11yMock)
+			assert.Equal(t, tt.wantSetupErr, err)
+			if err == nil {
+				g.late.saved(tt.late)
+				err = g.convertAll(context.Background(), now)
+				assert.Equal(t, tt.wantErr, err)
+				assert.Equal(t, tt.wantLate, g.late.since)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,324 @@
+package picolytics
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nmcclain/picolytics/picolytics/db"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// LogImporter imports pageviews from web server access logs, e.g. from before picolytics
+// was deployed. Events keep their original times, and sessions are rebuilt by the same
+// session upsert as live events, so each site's logs must be imported in chronological order.
+type LogImporter struct {
+	config      *Config
+	store       EventStore
+	sites       *Sites
+	queryParams *QueryParams
+	geo         *maxminddb.Reader
+	o11y        *PicolyticsO11y
+	format      string
+	domain      string // for formats without the host
+	salt        string // random for each import, and rotated daily by event time
+
+	batch    []PicolyticsEvent
+	lastSeen map[string]time.Time // visitorID -> time of the visitor's last event in the batch
+	oldest   time.Time            // of the saved pageviews
+	Stats    ImportStats
+}
+
+// ImportStats counts the log lines read by a LogImporter, and what became of them.
+type ImportStats struct {
+	Lines    int // lines read
+	Imported int // pageviews saved
+	Static   int // static assets and picolytics' own endpoints
+	Bots     int
+	Skipped  int // not successful page loads, or older than pruneDays
+	Invalid  int // unparseable lines, and events rejected like live events
+}
+
+var logFormats = map[string]bool{"common": true, "combined": true, "json": true}
+
+func NewLogImporter(config *Config, format, domain string, logHandler slog.Handler, pool PgxIface) (*LogImporter, error) {
+	li := LogImporter{
+		config:   config,
+		o11y:     &PicolyticsO11y{},
+		format:   format,
+		domain:   domain,
+		salt:     uuid.NewString(),
+		lastSeen: map[string]time.Time{},
+	}
+	if !logFormats[format] {
+		return nil, fmt.Errorf("invalid log format: %s", format)
+	}
+	if format != "json" && len(domain) < 1 {
+		return nil, fmt.Errorf("%s logs require a domain", format)
+	}
+	var err error
+	if err := validateConfig(li.config); err != nil {
+		return nil, fmt.Errorf("config error: %v", err)
+	}
+	li.o11y.Logger, err = setupLogger(li.config.Debug, logHandler)
+	if err != nil {
+		return nil, fmt.Errorf("logger setup error: %v", err)
+	}
+	li.o11y.Metrics = setupMetrics(float64(li.config.QueueSize), li.config.GitCommit, li.config.GitBranch, li.config.AppVersion)
+	li.sites, err = NewSites(li.config)
+	if err != nil {
+		return nil, fmt.Errorf("config error: %v", err)
+	}
+	li.queryParams, err = NewQueryParams(li.config.SourceParams, li.config.AllowedQueryParams)
+	if err != nil {
+		return nil, fmt.Errorf("config error: %v", err)
+	}
+	li.geo, err = maxminddb.Open(li.config.GeoIPFile)
+	if err != nil {
+		return nil, fmt.Errorf("error opening GeoIP database: %v", err)
+	}
+	li.store, err = NewEventStore(li.config, pool, li.sites, li.o11y)
+	if err != nil {
+		return nil, fmt.Errorf("storage setup error: %v", err)
+	}
+	return &li, nil
+}
+
+func (li *LogImporter) Close() {
+	li.geo.Close()
+	li.store.Close()
+}
+
+// Import reads a log, and saves its pageviews in batches. Goals are then rewound to the
+// oldest pageview, so the server's GoalConverter converts the imported range.
+func (li *LogImporter) Import(ctx context.Context, r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		li.Stats.Lines++
+		event, ok := li.parseLine(scanner.Text())
+		if !ok {
+			continue
+		}
+		// the batch is saved early if the visitor's session timed out, since
+		// each visitor's events in a batch are saved to a single session
+		if last, ok := li.lastSeen[event.VisitorID]; ok &&
+			event.Created.Sub(last) > time.Duration(li.sites.sessionTimeoutMin(event.Domain))*time.Minute {
+			if err := li.flush(ctx); err != nil {
+				return err
+			}
+		}
+		li.batch = append(li.batch, event)
+		li.lastSeen[event.VisitorID] = event.Created
+		if len(li.batch) >= li.config.BatchMaxSize {
+			if err := li.flush(ctx); err != nil {
+				return err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("error reading log: %v", err)
+	}
+	if err := li.flush(ctx); err != nil {
+		return err
+	}
+	store, ok := li.store.(*PostgresStore)
+	if !ok || li.oldest.IsZero() {
+		return nil
+	}
+	return rewindGoals(ctx, db.New(store.pool), li.config.Goals, li.oldest)
+}
+
+// parseLine turns a log line into an enriched pageview, or returns false if it's skipped.
+func (li *LogImporter) parseLine(line string) (PicolyticsEvent, bool) {
+	entry, err := parseLogLine(li.format, line)
+	if err != nil {
+		li.Stats.Invalid++
+		li.o11y.Logger.Debug("invalid log line", "line", li.Stats.Lines, "error", err)
+		return PicolyticsEvent{}, false
+	}
+	if entry.method != "GET" || (entry.status/100 != 2 && entry.status != 304) {
+		li.Stats.Skipped++
+		return PicolyticsEvent{}, false
+	}
+	if li.config.PruneDays > 0 && entry.time.Before(time.Now().AddDate(0, 0, -li.config.PruneDays)) {
+		li.Stats.Skipped++ // would be pruned right away
+		return PicolyticsEvent{}, false
+	}
+	uriPath, _, _ := strings.Cut(entry.uri, "?")
+	if staticPath(uriPath) {
+		li.Stats.Static++
+		return PicolyticsEvent{}, false
+	}
+	host := entry.host
+	if len(host) < 1 {
+		host = li.domain
+	}
+
+	event := PicolyticsEvent{
+		Name:               "load",
+		Location:           "https://" + host + entry.uri,
+		Referrer:           entry.referrer,
+		Created:            entry.time,
+		ClientIpDONOTSTORE: entry.ip,
+		UaDONOTSTORE:       entry.userAgent,
+		Lang:               entry.lang,
+		Origin:             "https://" + host, // the log is already for the site
+	}
+	if err := parseEvent(&event, li.sites, li.queryParams); err != nil {
+		li.Stats.Invalid++
+		li.o11y.Logger.Debug("invalid log event", "line", li.Stats.Lines, "error", err)
+		return PicolyticsEvent{}, false
+	}
+	salt := importSalt(li.salt + event.Created.UTC().Format(time.DateOnly))
+	event.VisitorID = createVisitID(&event, salt, li.o11y)
+	if err := enrichEvent(&event, li.geo); err != nil {
+		li.o11y.Logger.Debug("Error enriching event - saving anyway", "line", li.Stats.Lines, "error", err)
+		event.Bot = isBot(&event)
+	}
+	event.ClientIpDONOTSTORE = "" // explicitly never store client IP
+	event.UaDONOTSTORE = ""       // explicitly never store useragent
+	if event.Bot {
+		li.Stats.Bots++
+		return PicolyticsEvent{}, false
+	}
+	return event, true
+}
+
+func (li *LogImporter) flush(ctx context.Context) error {
+	if len(li.batch) < 1 {
+		return nil
+	}
+	if err := li.store.SaveEvents(ctx, li.batch); err != nil {
+		return err
+	}
+	li.Stats.Imported += len(li.batch)
+	for _, event := range li.batch {
+		if li.oldest.IsZero() || event.Created.Before(li.oldest) {
+			li.oldest = event.Created
+		}
+	}
+	li.o11y.Logger.Debug("imported batch", "events", len(li.batch), "to", li.batch[len(li.batch)-1].Created)
+	li.batch = li.batch[:0]
+	li.lastSeen = map[string]time.Time{}
+	return nil
+}
+
+// importSalt is used instead of the daily salt, so imported visitors can't be linked to
+// live visitors, or across days.
+type importSalt string
+
+func (s importSalt) getSalt() (string, error) {
+	return string(s), nil
+}
+
+type logEntry struct {
+	ip, method, uri, host string
+	referrer, userAgent   string
+	lang                  string
+	status                int
+	time                  time.Time
+}
+
+// common: 127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET /index.html HTTP/1.0" 200 2326
+// combined adds: "http://example.com/start.html" "Mozilla/4.08 [en] (Win98; I ;Nav)"
+var clfRegexp = regexp.MustCompile(`^(\S+) \S+ \S+ \[([^\]]+)\] "([^"]*)" (\d{3}) \S+(?: "((?:[^"\\]|\\.)*)" "((?:[^"\\]|\\.)*)")?`)
+
+const clfTimeLayout = "02/Jan/2006:15:04:05 -0700"
+
+func parseLogLine(format, line string) (logEntry, error) {
+	if format == "json" {
+		return parseJSONLogLine(line)
+	}
+	m := clfRegexp.FindStringSubmatch(line)
+	if m == nil {
+		return logEntry{}, fmt.Errorf("line does not match %s log format", format)
+	}
+	entry := logEntry{ip: m[1], referrer: m[5], userAgent: m[6]}
+	var err error
+	if entry.time, err = time.Parse(clfTimeLayout, m[2]); err != nil {
+		return logEntry{}, fmt.Errorf("invalid time: %v", err)
+	}
+	entry.method, entry.uri, _ = strings.Cut(m[3], " ")
+	entry.uri, _, _ = strings.Cut(entry.uri, " ") // protocol
+	entry.status, _ = strconv.Atoi(m[4])
+	if entry.referrer == "-" {
+		entry.referrer = ""
+	}
+	return entry, nil
+}
+
+// parseJSONLogLine parses nginx logs written with escape=json, using nginx's variable names:
+// remote_addr, time_iso8601 or time_local, request or request_method and request_uri, status,
+// http_referer, http_user_agent, http_accept_language, and host or http_host.
+func parseJSONLogLine(line string) (logEntry, error) {
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(line), &fields); err != nil {
+		return logEntry{}, fmt.Errorf("invalid json: %v", err)
+	}
+	get := func(keys ...string) string {
+		for _, key := range keys {
+			if v, ok := fields[key]; ok && v != nil {
+				if s := fmt.Sprint(v); len(s) > 0 && s != "-" {
+					return s
+				}
+			}
+		}
+		return ""
+	}
+	entry := logEntry{
+		ip:        get("remote_addr"),
+		method:    get("request_method"),
+		uri:       get("request_uri"),
+		host:      get("host", "http_host"),
+		referrer:  get("http_referer"),
+		userAgent: get("http_user_agent"),
+		lang:      get("http_accept_language"),
+	}
+	if len(entry.uri) < 1 {
+		entry.method, entry.uri, _ = strings.Cut(get("request"), " ")
+		entry.uri, _, _ = strings.Cut(entry.uri, " ")
+	}
+	var err error
+	if t := get("time_iso8601"); len(t) > 0 {
+		entry.time, err = time.Parse(time.RFC3339, t)
+	} else {
+		entry.time, err = time.Parse(clfTimeLayout, get("time_local"))
+	}
+	if err != nil {
+		return logEntry{}, fmt.Errorf("invalid time: %v", err)
+	}
+	if entry.status, err = strconv.Atoi(get("status")); err != nil {
+		return logEntry{}, fmt.Errorf("invalid status: %v", err)
+	}
+	if len(entry.ip) < 1 || len(entry.uri) < 1 {
+		return logEntry{}, fmt.Errorf("missing remote_addr or request")
+	}
+	return entry, nil
+}
+
+var staticExtensions = map[string]bool{
+	".css": true, ".js": true, ".mjs": true, ".map": true, ".json": true, ".xml": true, ".txt": true,
+	".png": true, ".jpg": true, ".jpeg": true, ".gif": true, ".svg": true, ".ico": true, ".webp": true, ".avif": true,
+	".woff": true, ".woff2": true, ".ttf": true, ".otf": true, ".eot": true,
+	".mp4": true, ".webm": true, ".mp3": true, ".pdf": true, ".zip": true,
+}
+
+// picolytics' own endpoints, in case it was served from the same host
+var trackerPaths = map[string]bool{"/p": true, "/p.gif": true, "/p.png": true, "/p/batch": true, "/pico.js": true}
+
+func staticPath(p string) bool {
+	return staticExtensions[strings.ToLower(path.Ext(p))] || trackerPaths[p]
+}
@@ -0,0 +1,152 @@
+package picolytics
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/pashagolub/pgxmock/v3"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLogLine(t *testing.T) {
+	ts := time.Date(2024, 1, 1, 10, 0, 0, 0, time.FixedZone("", -7*60*60))
+	tests := []struct {
+		name    string
+		format  string
+		line    string
+		want    logEntry
+		wantErr bool
+	}{
+		{
+			name:   "common",
+			format: "common",
+			line:   `203.0.113.1 - frank [01/Jan/2024:10:00:00 -0700] "GET /index.html HTTP/1.0" 200 2326`,
+			want:   logEntry{ip: "203.0.113.1", method: "GET", uri: "/index.html", status: 200, time: ts},
+		},
+		{
+			name:   "combined",
+			format: "combined",
+			line:   `2001:db8::1 - - [01/Jan/2024:10:00:00 -0700] "GET /?q=1 HTTP/2.0" 304 0 "https://google.com/" "Mozilla/5.0 \"quoted\""`,
+			want: logEntry{ip: "2001:db8::1", method: "GET", uri: "/?q=1", status: 304, time: ts,
+				referrer: "https://google.com/", userAgent: `Mozilla/5.0 \"quoted\"`},
+		},
+		{
+			name:   "combined without referrer",
+			format: "combined",
+			line:   `203.0.113.1 - - [01/Jan/2024:10:00:00 -0700] "GET / HTTP/1.1" 200 512 "-" "curl/8.0"`,
+			want:   logEntry{ip: "203.0.113.1", method: "GET", uri: "/", status: 200, time: ts, userAgent: "curl/8.0"},
+		},
+		{
+			name:    "invalid time",
+			format:  "common",
+			line:    `203.0.113.1 - - [yesterday] "GET / HTTP/1.1" 200 512`,
+			wantErr: true,
+		},
+		{
+			name:    "not a log line",
+			format:  "combined",
+			line:    `hello world`,
+			wantErr: true,
+		},
+		{
+			name:   "nginx json",
+			format: "json",
+			line: `{"time_iso8601":"2024-01-01T10:00:00-07:00","remote_addr":"203.0.113.1","request_method":"GET","request_uri":"/about",` +
+				`"status":"200","http_referer":"","http_user_agent":"Mozilla/5.0","http_accept_language":"en-US","host":"www.example.com"}`,
+			want: logEntry{ip: "203.0.113.1", method: "GET", uri: "/about", host: "www.example.com", status: 200, time: ts,
+				userAgent: "Mozilla/5.0", lang: "en-US"},
+		},
+		{
+			name:   "nginx json with request and time_local",
+			format: "json",
+			line:   `{"time_local":"01/Jan/2024:10:00:00 -0700","remote_addr":"203.0.113.1","request":"GET /about HTTP/1.1","status":200,"http_referer":"-"}`,
+			want:   logEntry{ip: "203.0.113.1", method: "GET", uri: "/about", status: 200, time: ts},
+		},
+		{
+			name:    "nginx json missing request",
+			format:  "json",
+			line:    `{"time_iso8601":"2024-01-01T10:00:00-07:00","remote_addr":"203.0.113.1","status":"200"}`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseLogLine(tt.format, tt.line)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.True(t, tt.want.time.Equal(got.time), "time %v != %v", tt.want.time, got.time)
+			got.time = tt.want.time
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestLogImporter(t *testing.T) {
+	SetConfigDefaults()
+	config := Config{}
+	if err := viper.Unmarshal(&config); err != nil {
+		t.Fatalf("Unable to decode config, %v", err)
+	}
+	config.PgConnString = "postgres://notused"
+	config.GeoIPFile = "../etc/geoip-city-test.mmdb"
+	config.SessionTimeoutMin = 30
+	config.PruneDays = 0
+	config.Goals = []GoalConfig{{Name: "pricing", Path: "/pricing"}}
+
+	ua := "Mozilla/5.0 (X11; Linux x86_64; rv:120.0) Gecko/20100101 Firefox/120.0"
+	logLines := []string{
+		`203.0.113.1 - - [01/Jan/2024:10:00:00 +0000] "GET /?utm_source=news HTTP/1.1" 200 512 "https://google.com/" "` + ua + `"`,
+		`203.0.113.1 - - [01/Jan/2024:10:00:01 +0000] "GET /style.css HTTP/1.1" 200 512 "https://example.com/" "` + ua + `"`,
+		`66.249.66.1 - - [01/Jan/2024:10:01:00 +0000] "GET / HTTP/1.1" 200 512 "-" "Mozilla/5.0 (compatible; Googlebot/2.1)"`,
+		`203.0.113.1 - - [01/Jan/2024:10:05:00 +0000] "GET /missing HTTP/1.1" 404 128 "-" "` + ua + `"`,
+		`203.0.113.1 - - [01/Jan/2024:10:10:00 +0000] "GET /about HTTP/1.1" 200 512 "https://example.com/" "` + ua + `"`,
+		`not a log line`,
+		`203.0.113.1 - - [01/Jan/2024:10:11:00 +0000] "POST /login HTTP/1.1" 200 512 "https://example.com/about" "` + ua + `"`,
+		`203.0.113.1 - - [01/Jan/2024:12:00:00 +0000] "GET /pricing HTTP/1.1" 200 512 "-" "` + ua + `"`,
+	}
+
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mock.Close()
+	logHandler := slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError})
+	importer, err := NewLogImporter(&config, "combined", "www.example.com", logHandler, mock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	importer.salt = "test"
+	visitorID := createVisitID(&PicolyticsEvent{Domain: "example.com", ClientIpDONOTSTORE: "203.0.113.1", UaDONOTSTORE: ua},
+		importSalt("test2024-01-01"), importer.o11y)
+
+	// the visitor's last pageview is after the session timeout, so it's saved in a separate batch
+	for i, events := range []int{2, 1} {
+		mock.ExpectQuery("INSERT INTO domains").WithArgs("example.com").
+			WillReturnRows(mock.NewRows([]string{"domain_id"}).AddRow(int32(1)))
+		mock.ExpectQuery("WITH batch AS").WithArgs(anyArgs(33)...).
+			WillReturnRows(mock.NewRows([]string{"id", "visitor_id"}).AddRow(int64(i+1), newPGText(visitorID)))
+		mock.ExpectCopyFrom(pgx.Identifier{"events"}, []string{"domain_id", "session_id", "visitor_id",
+			"name", "path", "referrer", "load_time", "ttfb", "props", "created_at", "lcp", "cls", "inp", "fcp", "target", "engaged_ms", "scroll_depth"}).WillReturnResult(int64(events))
+	}
+	// the server converts goals again from the oldest imported pageview
+	mock.ExpectExec("UPDATE rollup_watermarks").
+		WithArgs("goal:pricing", newPGTimestamptz(time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC))).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+
+	err = importer.Import(context.Background(), strings.NewReader(strings.Join(logLines, "\n")))
+	assert.NoError(t, err)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+	assert.Equal(t, ImportStats{Lines: 8, Imported: 3, Static: 1, Bots: 1, Skipped: 2, Invalid: 1}, importer.Stats)
+}
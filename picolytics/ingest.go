@@ -0,0 +1,290 @@
+package picolytics
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+
+	"github.com/nmcclain/picolytics/picolytics/db"
+)
+
+// IngestAPI accepts batches of events from servers, authenticated with per-site API keys.
+// Unlike the tracker, the client IP, user agent, and time of each event are supplied by
+// the caller, since the request comes from the caller's server rather than the visitor.
+// Visitor IDs are hashed from the same fields as the tracker's, so server events only join
+// the browser's visitor and session when the caller also forwards its language and device fields.
+type IngestAPI struct {
+	client     *db.Queries
+	sites      *Sites
+	eventSaver EventSaver
+	o11y       *PicolyticsO11y
+}
+
+func NewIngestAPI(pool PgxIface, sites *Sites, eventSaver EventSaver, o11y *PicolyticsO11y) *IngestAPI {
+	return &IngestAPI{
+		client:     db.New(pool),
+		sites:      sites,
+		eventSaver: eventSaver,
+		o11y:       o11y,
+	}
+}
+
+const (
+	ingestMaxEvents = 100
+	ingestMaxAge    = 24 * time.Hour
+	ingestMaxSkew   = time.Minute // allowed clock skew for event times in the future
+	apiKeyPrefix    = "pk_"
+	apiKeyDomainKey = "apiKeyDomain" // echo context key
+)
+
+type serverEvent struct {
+	Name        string                 `json:"n"`
+	Location    string                 `json:"l"`
+	Referrer    string                 `json:"r"`
+	Props       map[string]interface{} `json:"p"`
+	UtmSource   string                 `json:"utm_source"`
+	UtmMedium   string                 `json:"utm_medium"`
+	UtmCampaign string                 `json:"utm_campaign"`
+	UtmContent  string                 `json:"utm_content"`
+	UtmTerm     string                 `json:"utm_term"`
+	// supplied by the caller instead of the request
+	ClientIP  string    `json:"ip"`
+	UserAgent string    `json:"ua"`
+	Lang      string    `json:"lang"`
+	Timestamp time.Time `json:"ts"` // optional, defaults to now
+	// optional, the tracker's device fields, so the event gets the browser's visitor ID
+	ScreenW    int32   `json:"sw"`
+	ScreenH    int32   `json:"sh"`
+	PixelRatio float64 `json:"pr"`
+	PixelDepth int32   `json:"pd"`
+	Timezone   string  `json:"tz"`
+}
+
+type ingestRequest struct {
+	Events []serverEvent `json:"events"`
+}
+
+type ingestResponse struct {
+	Accepted int `json:"accepted"`
+}
+
+// register adds the ingestion endpoint to the public server.
+func (api *IngestAPI) register(g *echo.Group) {
+	g.POST("", api.ingest, api.authenticate)
+}
+
+// registerKeys adds the API key management endpoints to the admin server.
+func (api *IngestAPI) registerKeys(g *echo.Group) {
+	g.GET("", api.listKeys)
+	g.POST("", api.createKey)
+	g.DELETE("/:id", api.deleteKey)
+}
+
+// authenticate checks the bearer API key, and stores its site's domain in the context.
+func (api *IngestAPI) authenticate(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		key, ok := strings.CutPrefix(c.Request().Header.Get(echo.HeaderAuthorization), "Bearer ")
+		if !ok || !strings.HasPrefix(key, apiKeyPrefix) {
+			api.o11y.Metrics.eventErrors.WithLabelValues("api_key").Add(1)
+			return echo.NewHTTPError(http.StatusUnauthorized, "Missing API key")
+		}
+		keyHash := hashAPIKey(key)
+		domain, err := api.client.GetAPIKeyDomain(c.Request().Context(), keyHash)
+		if errors.Is(err, pgx.ErrNoRows) {
+			api.o11y.Metrics.eventErrors.WithLabelValues("api_key").Add(1)
+			return echo.NewHTTPError(http.StatusUnauthorized, "Invalid API key")
+		} else if err != nil {
+			api.o11y.Logger.Error("api key lookup error", "error", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "API key lookup failed")
+		}
+		// servers send many visitors' events from one IP, so requests are limited per key instead
+		if st, ok := api.sites.lookup(domain); ok && st.rateLimiter != nil {
+			if allow, err := st.rateLimiter.Allow("api_key:" + keyHash); !allow || err != nil {
+				api.o11y.Metrics.rateLimiterDrops.Inc()
+				api.o11y.Logger.Debug("rate limit exceeded", "domain", domain, "error", err)
+				return middleware.ErrRateLimitExceeded
+			}
+		}
+		c.Set(apiKeyDomainKey, domain)
+		return next(c)
+	}
+}
+
+func (api *IngestAPI) ingest(c echo.Context) error {
+	var req ingestRequest
+	if _, err := unmarshallBody(c, &req, api.sites.maxBodySize*ingestMaxEvents); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid event data")
+	}
+	if len(req.Events) < 1 || len(req.Events) > ingestMaxEvents {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Batches must have 1 to %d events", ingestMaxEvents))
+	}
+
+	// the whole batch is checked before any event is saved
+	domain, _ := c.Get(apiKeyDomainKey).(string)
+	now := time.Now()
+	events := make([]PicolyticsEvent, 0, len(req.Events))
+	for i, se := range req.Events {
+		event, err := api.toEvent(se, domain, now)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Invalid event %d: %v", i, err))
+		}
+		events = append(events, event)
+	}
+	accepted := 0
+	for _, event := range events {
+		if err := api.eventSaver.SaveEvent(event); err == nil {
+			accepted++
+		}
+	}
+	return c.JSON(http.StatusAccepted, ingestResponse{Accepted: accepted})
+}
+
+// toEvent checks a server event against the API key's site, and converts it to a tracker event.
+func (api *IngestAPI) toEvent(se serverEvent, domain string, now time.Time) (PicolyticsEvent, error) {
+	if net.ParseIP(se.ClientIP) == nil {
+		return PicolyticsEvent{}, fmt.Errorf("invalid ip %q", se.ClientIP)
+	}
+	if se.Timestamp.IsZero() {
+		se.Timestamp = now
+	}
+	if se.Timestamp.After(now.Add(ingestMaxSkew)) || se.Timestamp.Before(now.Add(-ingestMaxAge)) {
+		return PicolyticsEvent{}, fmt.Errorf("ts must be within the last %s", ingestMaxAge)
+	}
+	site := api.sites.forLocation(se.Location)
+	if !validEventName(site.validEventNames, se.Name) {
+		return PicolyticsEvent{}, fmt.Errorf("invalid event name: %s", se.Name)
+	}
+	eventDomain, _, _, err := extractDomainPath(se.Location)
+	if err != nil {
+		return PicolyticsEvent{}, err
+	}
+	if st, ok := api.sites.lookup(eventDomain); ok && len(st.domain) > 0 {
+		eventDomain = st.domain
+	}
+	if eventDomain != domain {
+		return PicolyticsEvent{}, fmt.Errorf("API key is for %s, not %s", domain, eventDomain)
+	}
+	if err := validateProps(se.Props); err != nil {
+		return PicolyticsEvent{}, fmt.Errorf("invalid event props: %v", err)
+	}
+	return PicolyticsEvent{
+		Name:               se.Name,
+		Location:           se.Location,
+		Referrer:           se.Referrer,
+		Props:              se.Props,
+		UtmSource:          truncate(se.UtmSource, utmMaxLen),
+		UtmMedium:          truncate(se.UtmMedium, utmMaxLen),
+		UtmCampaign:        truncate(se.UtmCampaign, utmMaxLen),
+		UtmContent:         truncate(se.UtmContent, utmMaxLen),
+		UtmTerm:            truncate(se.UtmTerm, utmMaxLen),
+		Lang:               se.Lang,
+		ScreenW:            se.ScreenW,
+		ScreenH:            se.ScreenH,
+		PixelRatio:         se.PixelRatio,
+		PixelDepth:         se.PixelDepth,
+		Timezone:           se.Timezone,
+		Origin:             se.Location, // the API key has already verified the site
+		Created:            se.Timestamp,
+		ClientIpDONOTSTORE: se.ClientIP,
+		UaDONOTSTORE:       se.UserAgent,
+	}, nil
+}
+
+type apiKey struct {
+	ID        int32     `json:"id"`
+	Key       string    `json:"key,omitempty"` // only returned when created
+	Domain    string    `json:"domain"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// newAPIKey returns a random API key. Only its hash is stored.
+func newAPIKey() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return apiKeyPrefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func (api *IngestAPI) createKey(c echo.Context) error {
+	domain := siteHost(c.QueryParam("domain"))
+	if len(domain) < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, "missing domain")
+	}
+	if len(api.sites.hosts) > 0 {
+		st, ok := api.sites.lookup(domain)
+		if !ok {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("unknown site: %s", domain))
+		}
+		domain = st.domain
+	}
+	key, err := newAPIKey()
+	if err != nil {
+		return api.keyError(err)
+	}
+	row, err := api.client.CreateAPIKey(c.Request().Context(), db.CreateAPIKeyParams{
+		KeyHash:    hashAPIKey(key),
+		DomainName: domain,
+		Name:       c.QueryParam("name"),
+	})
+	if err != nil {
+		return api.keyError(err)
+	}
+	return c.JSON(http.StatusCreated, apiKey{
+		ID:        row.ID,
+		Key:       key,
+		Domain:    domain,
+		Name:      c.QueryParam("name"),
+		CreatedAt: row.CreatedAt.Time,
+	})
+}
+
+func (api *IngestAPI) listKeys(c echo.Context) error {
+	rows, err := api.client.ListAPIKeys(c.Request().Context())
+	if err != nil {
+		return api.keyError(err)
+	}
+	keys := []apiKey{}
+	for _, row := range rows {
+		keys = append(keys, apiKey{ID: row.ID, Domain: row.DomainName, Name: row.Name, CreatedAt: row.CreatedAt.Time})
+	}
+	return c.JSON(http.StatusOK, keys)
+}
+
+func (api *IngestAPI) deleteKey(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 32)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid id")
+	}
+	deleted, err := api.client.DeleteAPIKey(c.Request().Context(), int32(id))
+	if err != nil {
+		return api.keyError(err)
+	}
+	if deleted < 1 {
+		return echo.NewHTTPError(http.StatusNotFound, "API key not found")
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (api *IngestAPI) keyError(err error) error {
+	api.o11y.Logger.Error("api key error", "error", err)
+	return echo.NewHTTPError(http.StatusInternalServerError, "API key query failed")
+}
@@ -0,0 +1,393 @@
+package picolytics
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/labstack/echo/v4"
+	"github.com/pashagolub/pgxmock/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIngestAPI(t *testing.T) {
+	o11yMock := &PicolyticsO11y{
+		Logger:  slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError})),
+		Metrics: setupMetrics(1, "", "", ""),
+	}
+	key := "pk_test"
+	ts := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	tests := []struct {
+		name         string
+		key          string
+		body         string
+		getMock      func() pgxmock.PgxPoolIface
+		expectedCode int
+		wantEvents   []PicolyticsEvent
+	}{
+		{
+			name: "batch",
+			key:  key,
+			body: `{"events":[` +
+				`{"n":"purchase","l":"https://www.example.com/checkout","p":{"plan":"pro"},"ip":"8.8.8.8","ua":"Mozilla/5.0","ts":"` + ts.Format(time.RFC3339) + `"},` +
+				`{"n":"load","l":"https://staging.example.com/api","ip":"2001:db8::1"}]}`,
+			getMock: func() pgxmock.PgxPoolIface {
+				mock, err := pgxmock.NewPool()
+				if err != nil {
+					t.Fatal(err)
+				}
+				mock.ExpectQuery("SELECT domain_name FROM api_keys").WithArgs(hashAPIKey(key)).
+					WillReturnRows(mock.NewRows([]string{"domain_name"}).AddRow("example.com"))
+				return mock
+			},
+			expectedCode: http.StatusAccepted,
+			wantEvents: []PicolyticsEvent{
+				{
+					Name:               "purchase",
+					Location:           "https://www.example.com/checkout",
+					Props:              map[string]interface{}{"plan": "pro"},
+					Origin:             "https://www.example.com/checkout",
+					Created:            ts,
+					ClientIpDONOTSTORE: "8.8.8.8",
+					UaDONOTSTORE:       "Mozilla/5.0",
+				},
+				{
+					Name:               "load",
+					Location:           "https://staging.example.com/api",
+					Origin:             "https://staging.example.com/api",
+					ClientIpDONOTSTORE: "2001:db8::1",
+				},
+			},
+		},
+		{
+			name: "device fields and long utm",
+			key:  key,
+			body: `{"events":[{"n":"purchase","l":"https://example.com/checkout","ip":"8.8.8.8","ua":"Mozilla/5.0","lang":"en-US",` +
+				`"sw":1920,"sh":1080,"pr":2,"pd":24,"tz":"Europe/Berlin","utm_campaign":"` + strings.Repeat("x", 300) + `"}]}`,
+			getMock: func() pgxmock.PgxPoolIface {
+				mock, err := pgxmock.NewPool()
+				if err != nil {
+					t.Fatal(err)
+				}
+				mock.ExpectQuery("SELECT domain_name FROM api_keys").WithArgs(hashAPIKey(key)).
+					WillReturnRows(mock.NewRows([]string{"domain_name"}).AddRow("example.com"))
+				return mock
+			},
+			expectedCode: http.StatusAccepted,
+			wantEvents: []PicolyticsEvent{
+				{
+					Name:               "purchase",
+					Location:           "https://example.com/checkout",
+					Origin:             "https://example.com/checkout",
+					UtmCampaign:        strings.Repeat("x", utmMaxLen),
+					Lang:               "en-US",
+					ScreenW:            1920,
+					ScreenH:            1080,
+					PixelRatio:         2,
+					PixelDepth:         24,
+					Timezone:           "Europe/Berlin",
+					ClientIpDONOTSTORE: "8.8.8.8",
+					UaDONOTSTORE:       "Mozilla/5.0",
+				},
+			},
+		},
+		{
+			name: "missing key",
+			body: `{"events":[{"n":"load","l":"https://example.com/","ip":"8.8.8.8"}]}`,
+			getMock: func() pgxmock.PgxPoolIface {
+				mock, err := pgxmock.NewPool()
+				if err != nil {
+					t.Fatal(err)
+				}
+				return mock
+			},
+			expectedCode: http.StatusUnauthorized,
+		},
+		{
+			name: "unknown key",
+			key:  key,
+			body: `{"events":[{"n":"load","l":"https://example.com/","ip":"8.8.8.8"}]}`,
+			getMock: func() pgxmock.PgxPoolIface {
+				mock, err := pgxmock.NewPool()
+				if err != nil {
+					t.Fatal(err)
+				}
+				mock.ExpectQuery("SELECT domain_name FROM api_keys").WithArgs(hashAPIKey(key)).
+					WillReturnError(pgx.ErrNoRows)
+				return mock
+			},
+			expectedCode: http.StatusUnauthorized,
+		},
+		{
+			name: "key for another site",
+			key:  key,
+			body: `{"events":[{"n":"load","l":"https://example.com/","ip":"8.8.8.8"},{"n":"load","l":"https://example.org/","ip":"8.8.8.8"}]}`,
+			getMock: func() pgxmock.PgxPoolIface {
+				mock, err := pgxmock.NewPool()
+				if err != nil {
+					t.Fatal(err)
+				}
+				mock.ExpectQuery("SELECT domain_name FROM api_keys").WithArgs(hashAPIKey(key)).
+					WillReturnRows(mock.NewRows([]string{"domain_name"}).AddRow("example.com"))
+				return mock
+			},
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name: "missing ip",
+			key:  key,
+			body: `{"events":[{"n":"load","l":"https://example.com/"}]}`,
+			getMock: func() pgxmock.PgxPoolIface {
+				mock, err := pgxmock.NewPool()
+				if err != nil {
+					t.Fatal(err)
+				}
+				mock.ExpectQuery("SELECT domain_name FROM api_keys").WithArgs(hashAPIKey(key)).
+					WillReturnRows(mock.NewRows([]string{"domain_name"}).AddRow("example.com"))
+				return mock
+			},
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name: "too old",
+			key:  key,
+			body: `{"events":[{"n":"load","l":"https://example.com/","ip":"8.8.8.8","ts":"2020-01-01T00:00:00Z"}]}`,
+			getMock: func() pgxmock.PgxPoolIface {
+				mock, err := pgxmock.NewPool()
+				if err != nil {
+					t.Fatal(err)
+				}
+				mock.ExpectQuery("SELECT domain_name FROM api_keys").WithArgs(hashAPIKey(key)).
+					WillReturnRows(mock.NewRows([]string{"domain_name"}).AddRow("example.com"))
+				return mock
+			},
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name: "empty batch",
+			key:  key,
+			body: `{"events":[]}`,
+			getMock: func() pgxmock.PgxPoolIface {
+				mock, err := pgxmock.NewPool()
+				if err != nil {
+					t.Fatal(err)
+				}
+				mock.ExpectQuery("SELECT domain_name FROM api_keys").WithArgs(hashAPIKey(key)).
+					WillReturnRows(mock.NewRows([]string{"domain_name"}).AddRow("example.com"))
+				return mock
+			},
+			expectedCode: http.StatusBadRequest,
+		},
+	}
+
+	sites := testSites(t, &Config{
+		BodyMaxSize:     1024,
+		ValidEventNames: []string{"load", "purchase"},
+		Sites: []SiteConfig{
+			{Domain: "example.com", Aliases: []string{"staging.example.com"}},
+			{Domain: "example.org"},
+		},
+	})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := tt.getMock()
+			defer mock.Close()
+			eventSaver := TestEventSaver{events: make(chan PicolyticsEvent, ingestMaxEvents)}
+			e := echo.New()
+			NewIngestAPI(mock, sites, eventSaver, o11yMock).register(e.Group("/api/v1/events"))
+
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/events", bytes.NewReader([]byte(tt.body)))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			if len(tt.key) > 0 {
+				req.Header.Set(echo.HeaderAuthorization, "Bearer "+tt.key)
+			}
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+			assert.Equal(t, tt.expectedCode, rec.Code, rec.Body.String())
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+
+			close(eventSaver.events)
+			gotEvents := []PicolyticsEvent{}
+			for event := range eventSaver.events {
+				if tt.wantEvents != nil && tt.wantEvents[len(gotEvents)].Created.IsZero() {
+					assert.WithinDuration(t, time.Now(), event.Created, time.Minute)
+					event.Created = time.Time{} // defaults to now
+				}
+				gotEvents = append(gotEvents, event)
+			}
+			if tt.wantEvents == nil {
+				assert.Empty(t, gotEvents)
+				return
+			}
+			assert.Equal(t, tt.wantEvents, gotEvents)
+		})
+	}
+}
+
+func TestIngestRateLimit(t *testing.T) {
+	o11yMock := &PicolyticsO11y{
+		Logger:  slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError})),
+		Metrics: setupMetrics(1, "", "", ""),
+	}
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mock.Close()
+	sites := testSites(t, &Config{BodyMaxSize: 1024, RequestRateLimit: 1, ValidEventNames: []string{"load"}})
+	eventSaver := TestEventSaver{events: make(chan PicolyticsEvent, 10)}
+	e := echo.New()
+	NewIngestAPI(mock, sites, eventSaver, o11yMock).register(e.Group("/api/v1/events"))
+
+	// requests are limited per key, not per IP
+	for i, tt := range []struct {
+		key          string
+		expectedCode int
+	}{
+		{key: "pk_one", expectedCode: http.StatusAccepted},
+		{key: "pk_one", expectedCode: http.StatusTooManyRequests},
+		{key: "pk_two", expectedCode: http.StatusAccepted},
+	} {
+		mock.ExpectQuery("SELECT domain_name FROM api_keys").WithArgs(hashAPIKey(tt.key)).
+			WillReturnRows(mock.NewRows([]string{"domain_name"}).AddRow("example.com"))
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/events", strings.NewReader(`{"events":[{"n":"load","l":"https://example.com/","ip":"8.8.8.8"}]}`))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set(echo.HeaderAuthorization, "Bearer "+tt.key)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		assert.Equal(t, tt.expectedCode, rec.Code, "request %d", i)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+	assert.Equal(t, float64(1), getCounterValue(o11yMock.Metrics.rateLimiterDrops))
+}
+
+func TestAPIKeys(t *testing.T) {
+	o11yMock := &PicolyticsO11y{
+		Logger:  slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError})),
+		Metrics: setupMetrics(1, "", "", ""),
+	}
+	created := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name         string
+		method       string
+		path         string
+		getMock      func() pgxmock.PgxPoolIface
+		expectedCode int
+		check        func(t *testing.T, body []byte)
+	}{
+		{
+			name:   "create",
+			method: http.MethodPost,
+			path:   "/api/v1/keys?domain=www.example.com&name=backend",
+			getMock: func() pgxmock.PgxPoolIface {
+				mock, err := pgxmock.NewPool()
+				if err != nil {
+					t.Fatal(err)
+				}
+				mock.ExpectQuery("INSERT INTO api_keys").WithArgs(pgxmock.AnyArg(), "example.com", "backend").
+					WillReturnRows(mock.NewRows([]string{"id", "created_at"}).AddRow(int32(1), newPGTimestamptz(created)))
+				return mock
+			},
+			expectedCode: http.StatusCreated,
+			check: func(t *testing.T, body []byte) {
+				var key apiKey
+				assert.NoError(t, json.Unmarshal(body, &key))
+				assert.True(t, strings.HasPrefix(key.Key, apiKeyPrefix))
+				assert.Equal(t, apiKey{ID: 1, Key: key.Key, Domain: "example.com", Name: "backend", CreatedAt: created}, key)
+			},
+		},
+		{
+			name:   "create for unknown site",
+			method: http.MethodPost,
+			path:   "/api/v1/keys?domain=example.net",
+			getMock: func() pgxmock.PgxPoolIface {
+				mock, err := pgxmock.NewPool()
+				if err != nil {
+					t.Fatal(err)
+				}
+				return mock
+			},
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:   "list",
+			method: http.MethodGet,
+			path:   "/api/v1/keys",
+			getMock: func() pgxmock.PgxPoolIface {
+				mock, err := pgxmock.NewPool()
+				if err != nil {
+					t.Fatal(err)
+				}
+				mock.ExpectQuery("SELECT id, domain_name, name, created_at FROM api_keys").
+					WillReturnRows(mock.NewRows([]string{"id", "domain_name", "name", "created_at"}).
+						AddRow(int32(1), "example.com", "backend", newPGTimestamptz(created)))
+				return mock
+			},
+			expectedCode: http.StatusOK,
+			check: func(t *testing.T, body []byte) {
+				assert.JSONEq(t, `[{"id":1,"domain":"example.com","name":"backend","created_at":"2024-01-01T00:00:00Z"}]`, string(body))
+			},
+		},
+		{
+			name:   "delete",
+			method: http.MethodDelete,
+			path:   "/api/v1/keys/1",
+			getMock: func() pgxmock.PgxPoolIface {
+				mock, err := pgxmock.NewPool()
+				if err != nil {
+					t.Fatal(err)
+				}
+				mock.ExpectExec("DELETE FROM api_keys").WithArgs(int32(1)).
+					WillReturnResult(pgxmock.NewResult("DELETE", 1))
+				return mock
+			},
+			expectedCode: http.StatusNoContent,
+		},
+		{
+			name:   "delete missing",
+			method: http.MethodDelete,
+			path:   "/api/v1/keys/2",
+			getMock: func() pgxmock.PgxPoolIface {
+				mock, err := pgxmock.NewPool()
+				if err != nil {
+					t.Fatal(err)
+				}
+				mock.ExpectExec("DELETE FROM api_keys").WithArgs(int32(2)).
+					WillReturnResult(pgxmock.NewResult("DELETE", 0))
+				return mock
+			},
+			expectedCode: http.StatusNotFound,
+		},
+	}
+
+	sites := testSites(t, &Config{Sites: []SiteConfig{{Domain: "example.com"}}})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := tt.getMock()
+			defer mock.Close()
+			e := echo.New()
+			NewIngestAPI(mock, sites, nil, o11yMock).registerKeys(e.Group("/api/v1/keys"))
+
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, httptest.NewRequest(tt.method, tt.path, nil))
+			assert.Equal(t, tt.expectedCode, rec.Code)
+			if tt.check != nil {
+				tt.check(t, rec.Body.Bytes())
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
@@ -20,6 +20,22 @@ type Metrics struct {
 	eventErrors      *prometheus.CounterVec
 	rateLimiterDrops prometheus.Counter
 
+	vitalsLCP *prometheus.HistogramVec
+	vitalsCLS *prometheus.HistogramVec
+	vitalsINP *prometheus.HistogramVec
+	vitalsFCP *prometheus.HistogramVec
+	jsErrors  *prometheus.CounterVec
+
+	goalConversions *prometheus.CounterVec
+
+	batchRejectedEvents prometheus.Counter
+
+	spoolBytes          prometheus.Gauge
+	spoolReplayedEvents prometheus.Counter
+
+	drainedEvents      prometheus.Counter
+	drainDroppedEvents prometheus.Counter
+
 	loadOne      prometheus.Gauge
 	loadFive     prometheus.Gauge
 	loadFifteen  prometheus.Gauge
@@ -73,6 +89,66 @@ func setupMetrics(queueSize float64, gitCommit, gitBranch, appVersion string) *M
 		Name:      "rate_limiter_drops",
 		Help:      "Number of dropped connections due to rate limits.",
 	})
+	// web vitals buckets include the "good" and "poor" thresholds
+	m.vitalsLCP = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "picolytics",
+		Name:      "web_vitals_lcp_seconds",
+		Help:      "Largest Contentful Paint by domain.",
+		Buckets:   []float64{.5, 1, 1.5, 2, 2.5, 3, 4, 6, 10},
+	}, []string{"domain"})
+	m.vitalsCLS = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "picolytics",
+		Name:      "web_vitals_cls",
+		Help:      "Cumulative Layout Shift by domain.",
+		Buckets:   []float64{.01, .05, .1, .15, .25, .5, 1},
+	}, []string{"domain"})
+	m.vitalsINP = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "picolytics",
+		Name:      "web_vitals_inp_seconds",
+		Help:      "Interaction to Next Paint by domain.",
+		Buckets:   []float64{.05, .1, .2, .3, .5, .75, 1, 2},
+	}, []string{"domain"})
+	m.vitalsFCP = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "picolytics",
+		Name:      "web_vitals_fcp_seconds",
+		Help:      "First Contentful Paint by domain.",
+		Buckets:   []float64{.5, 1, 1.5, 1.8, 2.5, 3, 4, 6, 10},
+	}, []string{"domain"})
+	m.jsErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "picolytics",
+		Name:      "js_errors",
+		Help:      "Number of Javascript errors reported by the tracker by domain.",
+	}, []string{"domain"})
+	m.goalConversions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "picolytics",
+		Name:      "goal_conversions",
+		Help:      "Number of sessions converted by goal.",
+	}, []string{"goal"})
+	m.spoolBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "picolytics",
+		Name:      "spool_bytes",
+		Help:      "Size of the on-disk event spool in bytes.",
+	})
+	m.spoolReplayedEvents = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "picolytics",
+		Name:      "spool_replayed_events",
+		Help:      "Number of events replayed from the on-disk spool at startup.",
+	})
+	m.batchRejectedEvents = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "picolytics",
+		Name:      "batch_rejected_events",
+		Help:      "Number of events rejected from partially accepted batches.",
+	})
+	m.drainedEvents = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "picolytics",
+		Name:      "drained_events",
+		Help:      "Number of queued events saved while draining the queue at shutdown.",
+	})
+	m.drainDroppedEvents = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "picolytics",
+		Name:      "drain_dropped_events",
+		Help:      "Number of queued events dropped because the queue could not be drained at shutdown.",
+	})
 
 	m.loadOne = prometheus.NewGauge(prometheus.GaugeOpts{
 		Namespace: "picolytics",
@@ -125,9 +201,33 @@ func setupMetrics(queueSize float64, gitCommit, gitBranch, appVersion string) *M
 	m.eventErrors.WithLabelValues("enrich").Add(0)
 	m.eventErrors.WithLabelValues("enqueue").Add(0)
 	m.eventErrors.WithLabelValues("queue_full").Add(0)
+	m.eventErrors.WithLabelValues("spool_full").Add(0)
+	m.eventErrors.WithLabelValues("spool_write").Add(0)
+	m.eventErrors.WithLabelValues("spool_corrupt").Add(0)
+	m.eventErrors.WithLabelValues("dead_letter").Add(0)
+	m.eventErrors.WithLabelValues("clickhouse").Add(0)
+	m.eventErrors.WithLabelValues("unknown_site").Add(0)
+	m.eventErrors.WithLabelValues("origin_mismatch").Add(0)
+	m.eventErrors.WithLabelValues("api_key").Add(0)
 	return &m
 }
 
+// observeVitals records an event's web vitals, if it has any
+func (m *Metrics) observeVitals(e *PicolyticsEvent) {
+	if e.LCP != nil {
+		m.vitalsLCP.WithLabelValues(e.Domain).Observe(float64(*e.LCP) / 1000)
+	}
+	if e.CLS != nil {
+		m.vitalsCLS.WithLabelValues(e.Domain).Observe(*e.CLS)
+	}
+	if e.INP != nil {
+		m.vitalsINP.WithLabelValues(e.Domain).Observe(float64(*e.INP) / 1000)
+	}
+	if e.FCP != nil {
+		m.vitalsFCP.WithLabelValues(e.Domain).Observe(float64(*e.FCP) / 1000)
+	}
+}
+
 func startMetrics(m *Metrics, disableHostMetrics bool) {
 	prometheus.MustRegister(
 		m.queueUtilization,
@@ -137,6 +237,17 @@ func startMetrics(m *Metrics, disableHostMetrics bool) {
 		m.ingestLatency,
 		m.eventErrors,
 		m.rateLimiterDrops,
+		m.vitalsLCP,
+		m.vitalsCLS,
+		m.vitalsINP,
+		m.vitalsFCP,
+		m.jsErrors,
+		m.goalConversions,
+		m.spoolBytes,
+		m.spoolReplayedEvents,
+		m.batchRejectedEvents,
+		m.drainedEvents,
+		m.drainDroppedEvents,
 	)
 
 	if !disableHostMetrics {
@@ -181,6 +292,17 @@ func stopMetrics(m *Metrics, disableHostMetrics bool) {
 	prometheus.Unregister(m.ingestLatency)
 	prometheus.Unregister(m.eventErrors)
 	prometheus.Unregister(m.rateLimiterDrops)
+	prometheus.Unregister(m.vitalsLCP)
+	prometheus.Unregister(m.vitalsCLS)
+	prometheus.Unregister(m.vitalsINP)
+	prometheus.Unregister(m.vitalsFCP)
+	prometheus.Unregister(m.jsErrors)
+	prometheus.Unregister(m.goalConversions)
+	prometheus.Unregister(m.spoolBytes)
+	prometheus.Unregister(m.spoolReplayedEvents)
+	prometheus.Unregister(m.batchRejectedEvents)
+	prometheus.Unregister(m.drainedEvents)
+	prometheus.Unregister(m.drainDroppedEvents)
 
 	if !disableHostMetrics {
 		prometheus.Unregister(m.cpuUsedPct)
@@ -0,0 +1,5 @@
+ALTER TABLE events ADD COLUMN props JSONB;
+
+---- create above / drop below ----
+
+ALTER TABLE events DROP COLUMN props;
@@ -0,0 +1,38 @@
+CREATE TABLE rollup_hourly_paths (
+    domain_id INT NOT NULL,
+    hour TIMESTAMPTZ NOT NULL,
+    path TEXT NOT NULL,
+    events BIGINT NOT NULL DEFAULT 0,
+    pageviews BIGINT NOT NULL DEFAULT 0,
+    visitors BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (domain_id, hour, path),
+    FOREIGN KEY (domain_id) REFERENCES domains(domain_id)
+);
+
+CREATE TABLE rollup_daily_sessions (
+    domain_id INT NOT NULL,
+    day DATE NOT NULL,
+    referrer_host TEXT NOT NULL,
+    country TEXT NOT NULL,
+    device_type TEXT NOT NULL,
+    sessions BIGINT NOT NULL DEFAULT 0,
+    visitors BIGINT NOT NULL DEFAULT 0,
+    bounces BIGINT NOT NULL DEFAULT 0,
+    duration_sum BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (domain_id, day, referrer_host, country, device_type),
+    FOREIGN KEY (domain_id) REFERENCES domains(domain_id)
+);
+
+CREATE TABLE rollup_watermarks (
+    rollup TEXT PRIMARY KEY,
+    rolled_up_to TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX idx_rollup_hourly_paths_hour ON rollup_hourly_paths(hour);
+CREATE INDEX idx_rollup_daily_sessions_day ON rollup_daily_sessions(day);
+
+---- create above / drop below ----
+
+DROP TABLE rollup_watermarks;
+DROP TABLE rollup_daily_sessions;
+DROP TABLE rollup_hourly_paths;
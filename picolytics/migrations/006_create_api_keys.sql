@@ -0,0 +1,11 @@
+CREATE TABLE api_keys (
+    id SERIAL PRIMARY KEY,
+    key_hash TEXT UNIQUE NOT NULL, ---- hex SHA-256 of the key, which is never stored ----
+    domain_name TEXT NOT NULL,
+    name TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+---- create above / drop below ----
+
+DROP TABLE api_keys;
@@ -0,0 +1,25 @@
+---- web vitals, only reported by vitals events: ----
+ALTER TABLE events ADD COLUMN lcp INT;
+ALTER TABLE events ADD COLUMN cls FLOAT;
+ALTER TABLE events ADD COLUMN inp INT;
+ALTER TABLE events ADD COLUMN fcp INT;
+
+---- 75th percentile of each vital, of the hour's vitals events: ----
+ALTER TABLE rollup_hourly_paths ADD COLUMN vitals BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE rollup_hourly_paths ADD COLUMN lcp_p75 INT;
+ALTER TABLE rollup_hourly_paths ADD COLUMN cls_p75 FLOAT;
+ALTER TABLE rollup_hourly_paths ADD COLUMN inp_p75 INT;
+ALTER TABLE rollup_hourly_paths ADD COLUMN fcp_p75 INT;
+
+---- create above / drop below ----
+
+ALTER TABLE rollup_hourly_paths DROP COLUMN fcp_p75;
+ALTER TABLE rollup_hourly_paths DROP COLUMN inp_p75;
+ALTER TABLE rollup_hourly_paths DROP COLUMN cls_p75;
+ALTER TABLE rollup_hourly_paths DROP COLUMN lcp_p75;
+ALTER TABLE rollup_hourly_paths DROP COLUMN vitals;
+
+ALTER TABLE events DROP COLUMN fcp;
+ALTER TABLE events DROP COLUMN inp;
+ALTER TABLE events DROP COLUMN cls;
+ALTER TABLE events DROP COLUMN lcp;
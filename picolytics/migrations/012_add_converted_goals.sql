@@ -0,0 +1,6 @@
+---- names of the configured goals reached during the session, set by the goal converter: ----
+ALTER TABLE sessions ADD COLUMN converted_goals TEXT[] NOT NULL DEFAULT '{}';
+
+---- create above / drop below ----
+
+ALTER TABLE sessions DROP COLUMN converted_goals;
@@ -0,0 +1,91 @@
+---- times are UTC text, formatted as sqliteTimeLayout, so they sort and compare as strings ----
+CREATE TABLE domains (
+    domain_id INTEGER PRIMARY KEY,
+    domain_name TEXT UNIQUE NOT NULL
+);
+
+CREATE TABLE sessions (
+    id INTEGER PRIMARY KEY,
+    ---- values updated with each event: ----
+    updated_at TEXT,
+    duration INTEGER DEFAULT 0,
+    bounce BOOLEAN NOT NULL DEFAULT TRUE,
+    exit_path TEXT NOT NULL DEFAULT '',
+    ---- static values from first event: ----
+    visitor_id TEXT,
+    created_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    domain_id INTEGER NOT NULL REFERENCES domains(domain_id),
+    entry_path TEXT NOT NULL,
+    ---- geoip lookup: ----
+    country TEXT,
+    latitude REAL,
+    longitude REAL,
+    subdivision TEXT,
+    city TEXT,
+    ---- useragent: ----
+    browser TEXT,
+    browser_version TEXT,
+    os TEXT,
+    os_version TEXT,
+    platform TEXT,
+    device_type TEXT,
+    bot BOOLEAN NOT NULL DEFAULT TRUE,
+    screen_w INTEGER,
+    screen_h INTEGER,
+    timezone TEXT,
+    pixel_ratio REAL,
+    pixel_depth INTEGER,
+    ---- query string args via javascript: ----
+    utm_source TEXT,
+    utm_medium TEXT,
+    utm_campaign TEXT,
+    utm_content TEXT,
+    utm_term TEXT
+);
+
+CREATE TABLE events (
+    id INTEGER PRIMARY KEY,
+    ---- event essentials ----
+    name TEXT NOT NULL,
+    domain_id INTEGER NOT NULL REFERENCES domains(domain_id),
+    path TEXT NOT NULL,
+    referrer TEXT NOT NULL,
+    visitor_id TEXT NOT NULL,
+    session_id INTEGER NOT NULL REFERENCES sessions(id),
+    ---- timing ----
+    load_time INTEGER NOT NULL DEFAULT 0,
+    ttfb INTEGER NOT NULL DEFAULT 0,
+    ---- custom event properties, as JSON ----
+    props TEXT,
+    created_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE salt (
+    salt TEXT NOT NULL,
+    created_at TEXT NOT NULL
+);
+
+CREATE TABLE autocert_cache (
+    key TEXT PRIMARY KEY,
+    data BLOB NOT NULL,
+    created_at TEXT DEFAULT CURRENT_TIMESTAMP,
+    updated_at TEXT DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_sessions_created_at ON sessions(created_at);
+CREATE INDEX idx_sessions_updated_at ON sessions(updated_at);
+CREATE INDEX idx_sessions_domain_id ON sessions(domain_id);
+CREATE INDEX idx_sessions_visitor_id ON sessions(visitor_id);
+
+CREATE INDEX idx_events_created_at ON events(created_at);
+CREATE INDEX idx_events_domain_id ON events(domain_id);
+CREATE INDEX idx_events_session_id ON events(session_id);
+CREATE INDEX idx_events_visitor_id ON events(visitor_id);
+
+---- create above / drop below ----
+
+DROP TABLE autocert_cache;
+DROP TABLE salt;
+DROP TABLE events;
+DROP TABLE sessions;
+DROP TABLE domains;
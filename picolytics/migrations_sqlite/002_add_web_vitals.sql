@@ -0,0 +1,12 @@
+---- web vitals, only reported by vitals events: ----
+ALTER TABLE events ADD COLUMN lcp INTEGER;
+ALTER TABLE events ADD COLUMN cls REAL;
+ALTER TABLE events ADD COLUMN inp INTEGER;
+ALTER TABLE events ADD COLUMN fcp INTEGER;
+
+---- create above / drop below ----
+
+ALTER TABLE events DROP COLUMN fcp;
+ALTER TABLE events DROP COLUMN inp;
+ALTER TABLE events DROP COLUMN cls;
+ALTER TABLE events DROP COLUMN lcp;
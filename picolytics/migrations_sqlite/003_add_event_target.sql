@@ -0,0 +1,6 @@
+---- link URL of outbound and download events: ----
+ALTER TABLE events ADD COLUMN target TEXT NOT NULL DEFAULT '';
+
+---- create above / drop below ----
+
+ALTER TABLE events DROP COLUMN target;
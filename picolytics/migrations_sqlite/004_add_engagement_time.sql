@@ -0,0 +1,8 @@
+---- active time reported by engagement events, and its total per session: ----
+ALTER TABLE events ADD COLUMN engaged_ms INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE sessions ADD COLUMN engaged_seconds INTEGER NOT NULL DEFAULT 0;
+
+---- create above / drop below ----
+
+ALTER TABLE sessions DROP COLUMN engaged_seconds;
+ALTER TABLE events DROP COLUMN engaged_ms;
@@ -0,0 +1,6 @@
+---- furthest percent of the page seen, reported once per pageview by engagement events: ----
+ALTER TABLE events ADD COLUMN scroll_depth INTEGER;
+
+---- create above / drop below ----
+
+ALTER TABLE events DROP COLUMN scroll_depth;
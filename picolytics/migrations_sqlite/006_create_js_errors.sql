@@ -0,0 +1,21 @@
+---- javascript errors from the tracker, grouped by fingerprint: ----
+CREATE TABLE js_errors (
+    fingerprint TEXT PRIMARY KEY, ---- hex xxhash of the domain, message, source, line, and column ----
+    domain_id INTEGER NOT NULL REFERENCES domains(domain_id),
+    message TEXT NOT NULL,
+    source TEXT NOT NULL,
+    line INTEGER NOT NULL DEFAULT 0,
+    col INTEGER NOT NULL DEFAULT 0,
+    stack TEXT NOT NULL DEFAULT '', ---- of the latest occurrence ----
+    path TEXT NOT NULL DEFAULT '', ---- of the latest occurrence ----
+    occurrences INTEGER NOT NULL DEFAULT 0,
+    first_seen TEXT NOT NULL,
+    last_seen TEXT NOT NULL
+);
+
+CREATE INDEX idx_js_errors_domain_id ON js_errors(domain_id);
+CREATE INDEX idx_js_errors_last_seen ON js_errors(last_seen);
+
+---- create above / drop below ----
+
+DROP TABLE js_errors;
@@ -0,0 +1,245 @@
+package picolytics
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// partitionedTables are range partitioned by created_at, when partitioning is enabled
+var partitionedTables = []string{"sessions", "events"}
+
+// partitionedSessionMaxLength limits how long partitioned sessions last, so finding a
+// visitor's session only searches the partitions since then.
+const partitionedSessionMaxLength = 24 * time.Hour
+
+// Partitioner manages partitions of the events and sessions tables: it converts the tables
+// to partitioned tables, creates partitions ahead of time, and drops expired partitions.
+// Rows outside every partition, e.g. from imported logs, go to a default partition.
+type Partitioner struct {
+	pool     PgxIface
+	interval string // "day" or "month"
+	ahead    int    // partitions created after the current one
+	o11y     *PicolyticsO11y
+}
+
+func NewPartitioner(pool PgxIface, interval string, o11y *PicolyticsO11y) *Partitioner {
+	return &Partitioner{pool: pool, interval: interval, ahead: partitionsAhead(interval), o11y: o11y}
+}
+
+// partitionsAhead returns how many partitions are created after the current one
+func partitionsAhead(interval string) int {
+	if interval == "day" {
+		return 7
+	}
+	return 2
+}
+
+// partitionsAheadHours returns the shortest time covered by the partitions ahead. They're
+// created when pruning, so pruning must run more often than this.
+func partitionsAheadHours(interval string) int {
+	if interval == "day" {
+		return partitionsAhead(interval) * 24
+	}
+	return partitionsAhead(interval) * 28 * 24
+}
+
+// partitionStart returns the start of the partition containing t
+func (p *Partitioner) partitionStart(t time.Time) time.Time {
+	t = t.UTC()
+	if p.interval == "day" {
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	}
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// nextPartition returns the start of the partition after the one starting at start
+func (p *Partitioner) nextPartition(start time.Time) time.Time {
+	if p.interval == "day" {
+		return start.AddDate(0, 0, 1)
+	}
+	return start.AddDate(0, 1, 0)
+}
+
+func (p *Partitioner) layout() string {
+	if p.interval == "day" {
+		return "2006_01_02"
+	}
+	return "2006_01"
+}
+
+// partitionName returns the name of a table's partition, e.g. events_p2024_01
+func (p *Partitioner) partitionName(table string, start time.Time) string {
+	return table + "_p" + start.Format(p.layout())
+}
+
+// parsePartitionName returns the start of a partition from its name, or false if it's not a
+// partition created by the Partitioner, e.g. the default partition.
+func (p *Partitioner) parsePartitionName(table, name string) (time.Time, bool) {
+	suffix, ok := strings.CutPrefix(name, table+"_p")
+	if !ok {
+		return time.Time{}, false
+	}
+	start, err := time.Parse(p.layout(), suffix)
+	return start, err == nil
+}
+
+// setup converts the tables if they're not partitioned yet, then creates upcoming partitions
+func (p *Partitioner) setup(ctx context.Context) error {
+	var partitioned bool
+	if err := p.pool.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM pg_partitioned_table WHERE partrelid = 'events'::regclass)`).Scan(&partitioned); err != nil {
+		return fmt.Errorf("error checking partitioning: %v", err)
+	}
+	if !partitioned {
+		if err := p.convert(ctx); err != nil {
+			return err
+		}
+	}
+	return p.createPartitions(ctx, time.Now())
+}
+
+// convert copies the events and sessions tables into partitioned tables, in one transaction.
+// Tables are locked while rows are copied, so large tables should be converted during quiet
+// hours. Partitioned tables can't have a foreign key from events to sessions, so it's dropped.
+func (p *Partitioner) convert(ctx context.Context) (err error) {
+	p.o11y.Logger.Info("Converting events and sessions to partitioned tables", "interval", p.interval)
+	start := time.Now()
+	tx, err := p.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("error starting partitioning: %v", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback(ctx)
+		}
+	}()
+	if _, err = tx.Exec(ctx, `LOCK TABLE events, sessions IN ACCESS EXCLUSIVE MODE`); err != nil {
+		return fmt.Errorf("error locking tables: %v", err)
+	}
+	if _, err = tx.Exec(ctx, `ALTER TABLE events DROP CONSTRAINT IF EXISTS events_session_id_fkey`); err != nil {
+		return fmt.Errorf("error dropping events foreign key: %v", err)
+	}
+	indexes := []string{}
+	for _, table := range partitionedTables {
+		old := table + "_unpartitioned"
+		// indexes are recreated on the partitioned table, except the primary key, which must include created_at
+		rows, err := tx.Query(ctx, `SELECT indexdef FROM pg_indexes WHERE schemaname = current_schema() AND tablename = $1 AND indexname <> $2`, table, table+"_pkey")
+		if err != nil {
+			return fmt.Errorf("error listing %s indexes: %v", table, err)
+		}
+		defs, err := pgx.CollectRows(rows, pgx.RowTo[string])
+		if err != nil {
+			return fmt.Errorf("error listing %s indexes: %v", table, err)
+		}
+		indexes = append(indexes, defs...)
+
+		var first time.Time
+		if err = tx.QueryRow(ctx, fmt.Sprintf(`SELECT COALESCE(MIN(created_at), CURRENT_TIMESTAMP) FROM %s`, table)).Scan(&first); err != nil {
+			return fmt.Errorf("error finding oldest %s: %v", table, err)
+		}
+		for _, stmt := range []string{
+			fmt.Sprintf(`ALTER TABLE %s RENAME TO %s`, table, old),
+			fmt.Sprintf(`ALTER INDEX %s_pkey RENAME TO %s_pkey`, table, old),
+			fmt.Sprintf(`CREATE TABLE %s (LIKE %s INCLUDING DEFAULTS INCLUDING CONSTRAINTS, PRIMARY KEY (id, created_at),
+				FOREIGN KEY (domain_id) REFERENCES domains(domain_id)) PARTITION BY RANGE (created_at)`, table, old),
+			fmt.Sprintf(`ALTER SEQUENCE %s_id_seq OWNED BY %s.id`, table, table),
+			fmt.Sprintf(`CREATE TABLE %s_default PARTITION OF %s DEFAULT`, table, table),
+		} {
+			if _, err = tx.Exec(ctx, stmt); err != nil {
+				return fmt.Errorf("error partitioning %s: %v", table, err)
+			}
+		}
+		if err = p.createTablePartitions(ctx, tx, table, first, time.Now()); err != nil {
+			return err
+		}
+		if _, err = tx.Exec(ctx, fmt.Sprintf(`INSERT INTO %s SELECT * FROM %s`, table, old)); err != nil {
+			return fmt.Errorf("error copying %s: %v", table, err)
+		}
+	}
+	for _, table := range []string{"events", "sessions"} {
+		if _, err = tx.Exec(ctx, fmt.Sprintf(`DROP TABLE %s_unpartitioned`, table)); err != nil {
+			return fmt.Errorf("error dropping unpartitioned %s: %v", table, err)
+		}
+	}
+	for _, def := range indexes {
+		if _, err = tx.Exec(ctx, def); err != nil {
+			return fmt.Errorf("error recreating index: %v", err)
+		}
+	}
+	if err = tx.Commit(ctx); err != nil {
+		return fmt.Errorf("error committing partitioning: %v", err)
+	}
+	p.o11y.Logger.Info("Converted events and sessions to partitioned tables", "duration", time.Since(start))
+	return nil
+}
+
+// createPartitions creates any missing partitions, from the current one through the ones ahead
+func (p *Partitioner) createPartitions(ctx context.Context, now time.Time) error {
+	for _, table := range partitionedTables {
+		if err := p.createTablePartitions(ctx, p.pool, table, now, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type pgExecer interface {
+	Exec(context.Context, string, ...interface{}) (pgconn.CommandTag, error)
+}
+
+// createTablePartitions creates partitions from the one containing from, through the ones ahead of now
+func (p *Partitioner) createTablePartitions(ctx context.Context, db pgExecer, table string, from, now time.Time) error {
+	last := p.partitionStart(now)
+	for i := 0; i < p.ahead; i++ {
+		last = p.nextPartition(last)
+	}
+	for start := p.partitionStart(from); !start.After(last); start = p.nextPartition(start) {
+		stmt := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s PARTITION OF %s FOR VALUES FROM ('%s') TO ('%s')`,
+			p.partitionName(table, start), table, start.Format(time.RFC3339), p.nextPartition(start).Format(time.RFC3339))
+		if _, err := db.Exec(ctx, stmt); err != nil {
+			return fmt.Errorf("error creating partition %s: %v", p.partitionName(table, start), err)
+		}
+	}
+	return nil
+}
+
+// prune creates upcoming partitions, then drops partitions that ended before the cutoff,
+// and deletes expired rows from the default partitions.
+func (p *Partitioner) prune(ctx context.Context, pruneDays int, now time.Time) error {
+	if err := p.createPartitions(ctx, now); err != nil {
+		return err
+	}
+	if pruneDays < 1 {
+		return nil
+	}
+	cutoff := now.AddDate(0, 0, -pruneDays)
+	for _, table := range partitionedTables {
+		rows, err := p.pool.Query(ctx, `SELECT c.relname::text FROM pg_inherits i JOIN pg_class c ON c.oid = i.inhrelid
+			WHERE i.inhparent = $1::regclass ORDER BY c.relname`, table)
+		if err != nil {
+			return fmt.Errorf("error listing %s partitions: %v", table, err)
+		}
+		names, err := pgx.CollectRows(rows, pgx.RowTo[string])
+		if err != nil {
+			return fmt.Errorf("error listing %s partitions: %v", table, err)
+		}
+		for _, name := range names {
+			start, ok := p.parsePartitionName(table, name)
+			if !ok || p.nextPartition(start).After(cutoff) {
+				continue
+			}
+			p.o11y.Logger.Debug("Dropping partition", "partition", name)
+			if _, err := p.pool.Exec(ctx, fmt.Sprintf(`DROP TABLE %s`, name)); err != nil {
+				return fmt.Errorf("error dropping partition %s: %v", name, err)
+			}
+		}
+		if _, err := p.pool.Exec(ctx, fmt.Sprintf(`DELETE FROM %s_default WHERE created_at <= $1`, table), cutoff); err != nil {
+			return fmt.Errorf("error pruning %s_default: %v", table, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package picolytics
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pashagolub/pgxmock/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPartitionNames(t *testing.T) {
+	tests := []struct {
+		name      string
+		interval  string
+		t         time.Time
+		wantName  string
+		wantStart time.Time
+		wantNext  time.Time
+	}{
+		{
+			name:      "month",
+			interval:  "month",
+			t:         time.Date(2024, 12, 31, 23, 59, 0, 0, time.UTC),
+			wantName:  "events_p2024_12",
+			wantStart: time.Date(2024, 12, 1, 0, 0, 0, 0, time.UTC),
+			wantNext:  time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:      "day",
+			interval:  "day",
+			t:         time.Date(2024, 2, 28, 13, 0, 0, 0, time.UTC),
+			wantName:  "events_p2024_02_28",
+			wantStart: time.Date(2024, 2, 28, 0, 0, 0, 0, time.UTC),
+			wantNext:  time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewPartitioner(nil, tt.interval, nil)
+			start := p.partitionStart(tt.t)
+			assert.Equal(t, tt.wantStart, start)
+			assert.Equal(t, tt.wantNext, p.nextPartition(start))
+			assert.Equal(t, tt.wantName, p.partitionName("events", start))
+
+			parsed, ok := p.parsePartitionName("events", tt.wantName)
+			assert.True(t, ok)
+			assert.Equal(t, tt.wantStart, parsed)
+			_, ok = p.parsePartitionName("events", "events_default")
+			assert.False(t, ok)
+			_, ok = p.parsePartitionName("events", "sessions_p2024_01")
+			assert.False(t, ok)
+		})
+	}
+}
+
+func TestPartitionerPrune(t *testing.T) {
+	o11yMock := &PicolyticsO11y{
+		Logger:  slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError})),
+		Metrics: setupMetrics(1, "", "", ""),
+	}
+	now := time.Date(2024, 4, 10, 12, 0, 0, 0, time.UTC)
+	expectCreates := func(mock pgxmock.PgxPoolIface) {
+		for _, table := range partitionedTables {
+			for _, month := range []string{"2024_04", "2024_05", "2024_06"} {
+				mock.ExpectExec("CREATE TABLE IF NOT EXISTS " + table + "_p" + month + " PARTITION OF " + table).
+					WillReturnResult(pgxmock.NewResult("CREATE TABLE", 0))
+			}
+		}
+	}
+	tests := []struct {
+		name      string
+		pruneDays int
+		getMock   func() pgxmock.PgxPoolIface
+		wantErr   error
+	}{
+		{
+			name:      "drop expired partitions",
+			pruneDays: 40,
+			getMock: func() pgxmock.PgxPoolIface {
+				mock, err := pgxmock.NewPool()
+				if err != nil {
+					t.Fatal(err)
+				}
+				expectCreates(mock)
+				for _, table := range partitionedTables {
+					// the cutoff is 2024-03-01 12:00, so only January and February have expired
+					mock.ExpectQuery("FROM pg_inherits").WithArgs(table).
+						WillReturnRows(mock.NewRows([]string{"relname"}).
+							AddRow(table + "_default").AddRow(table + "_p2024_01").AddRow(table + "_p2024_02").
+							AddRow(table + "_p2024_03").AddRow(table + "_p2024_04"))
+					mock.ExpectExec("DROP TABLE " + table + "_p2024_01").WillReturnResult(pgxmock.NewResult("DROP TABLE", 0))
+					mock.ExpectExec("DROP TABLE " + table + "_p2024_02").WillReturnResult(pgxmock.NewResult("DROP TABLE", 0))
+					mock.ExpectExec("DELETE FROM " + table + "_default").WithArgs(now.AddDate(0, 0, -40)).
+						WillReturnResult(pgxmock.NewResult("DELETE", 3))
+				}
+				return mock
+			},
+		},
+		{
+			name:      "create partitions without pruning",
+			pruneDays: 0,
+			getMock: func() pgxmock.PgxPoolIface {
+				mock, err := pgxmock.NewPool()
+				if err != nil {
+					t.Fatal(err)
+				}
+				expectCreates(mock)
+				return mock
+			},
+		},
+		{
+			name:      "create partition error",
+			pruneDays: 40,
+			getMock: func() pgxmock.PgxPoolIface {
+				mock, err := pgxmock.NewPool()
+				if err != nil {
+					t.Fatal(err)
+				}
+				mock.ExpectExec("CREATE TABLE IF NOT EXISTS sessions_p2024_04").WillReturnError(errors.New("boom"))
+				return mock
+			},
+			wantErr: errors.New("error creating partition sessions_p2024_04: boom"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := tt.getMock()
+			defer mock.Close()
+			p := NewPartitioner(mock, "month", o11yMock)
+			err := p.prune(context.Background(), tt.pruneDays, now)
+			assert.Equal(t, tt.wantErr, err)
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -17,14 +18,17 @@ import (
 
 type Picolytics struct {
 	api        EchoAPI
-	pool       PgxIface
+	store      EventStore
+	pool       PgxIface // nil unless storage is postgres
 	config     *Config
 	trackers   *Trackers
 	pruner     *Pruner
+	aggregator *Aggregator
+	goals      *GoalConverter
+	ingest     *IngestAPI
 	worker     *Worker
 	eventSaver EventSaver
 	quit       chan os.Signal
-	salter     Salter
 	admin      *echo.Echo
 
 	// exported
@@ -68,33 +72,46 @@ func New(config *Config, logHandler slog.Handler, pool PgxIface) (Picolytics, er
 
 	p.O11y.Metrics = setupMetrics(float64(p.config.QueueSize), p.config.GitCommit, p.config.GitBranch, p.config.AppVersion)
 
-	// database setup
-	if p.pool == nil { // allow for testing without postgres
-		p.pool, err = setupDB(p.config, p.O11y)
-		if err != nil {
-			return p, fmt.Errorf("db setup error: %v", err)
-		}
+	// site registry setup
+	sites, err := NewSites(p.config)
+	if err != nil {
+		return p, fmt.Errorf("config error: %v", err)
 	}
 
-	// salter setup
-	p.salter = NewDailySalt(p.pool)
+	// storage setup
+	p.store, err = NewEventStore(p.config, p.pool, sites, p.O11y) // a mock pool allows testing without postgres
+	if err != nil {
+		return p, fmt.Errorf("storage setup error: %v", err)
+	}
+	p.pool = pgPool(p.store)
 
 	// worker setup
-	p.worker, err = NewWorker(p.config, p.pool, p.O11y)
+	p.worker, err = NewWorker(p.config, p.store, p.O11y)
 	if err != nil {
 		return p, fmt.Errorf("worker setup error: %v", err)
 	}
 
 	// event saver setup
-	p.eventSaver = NewAsyncEventSaver(p.worker.events, p.salter, p.config.ValidEventNames, p.O11y)
+	queryParams, err := NewQueryParams(p.config.SourceParams, p.config.AllowedQueryParams)
+	if err != nil {
+		return p, fmt.Errorf("config error: %v", err)
+	}
+	p.eventSaver = NewAsyncEventSaver(p.worker.events, p.worker.spool, p.store, queryParams, sites, p.O11y)
 
 	// API setup
-	p.trackers = NewTrackers(p.eventSaver, p.config.BodyMaxSize)
+	p.trackers = NewTrackers(p.config, p.eventSaver, sites, p.O11y)
 	p.api, err = NewEchoAPI(p.config, p.O11y)
 	if err != nil {
 		return p, fmt.Errorf("error setting up API: %v", err)
 	}
 	p.api.E.POST("/p", p.trackers.recordPicolyticsEvent)
+	p.api.E.POST("/p/batch", p.trackers.recordPicolyticsBatch)
+	p.api.E.GET("/p.gif", p.trackers.recordPixelEvent(gifPixel))
+	p.api.E.GET("/p.png", p.trackers.recordPixelEvent(pngPixel))
+	if p.config.IngestEnabled {
+		p.ingest = NewIngestAPI(p.pool, sites, p.eventSaver, p.O11y)
+		p.ingest.register(p.api.E.Group("/api/v1/events"))
+	}
 	p.api.E.GET("/robots.txt", func(c echo.Context) error { return c.String(http.StatusOK, "User-agent: *\nDisallow: /\n") })
 	p.api.E.GET("/", func(c echo.Context) error {
 		if len(p.config.RootRedirect) > 0 {
@@ -104,7 +121,6 @@ func New(config *Config, logHandler slog.Handler, pool PgxIface) (Picolytics, er
 	})
 
 	// Setup Autotls manager
-	var acmeCache *PostgresAutocertCache
 	if p.config.AutotlsEnabled {
 		p.O11y.Logger.Debug(fmt.Sprintf("Autotls enabled for: %s", p.config.AutotlsHost))
 		acmeClient := &acme.Client{}
@@ -112,22 +128,48 @@ func New(config *Config, logHandler slog.Handler, pool PgxIface) (Picolytics, er
 			p.O11y.Logger.Info("Autotls using STAGING letsencrypt service for TLS certificate")
 			acmeClient.DirectoryURL = "https://acme-staging-v02.api.letsencrypt.org/directory"
 		}
-		acmeCache = NewPostgresCache(p.pool)
 		p.api.E.AutoTLSManager = autocert.Manager{
 			Prompt:     autocert.AcceptTOS,
-			Cache:      acmeCache,
+			Cache:      autocertCache(p.store),
 			Client:     acmeClient,
 			HostPolicy: autocert.HostWhitelist(p.config.AutotlsHost),
 		}
 	}
 
-	p.pruner, err = NewPruner(p.config, p.pool, p.O11y)
+	p.pruner, err = NewPruner(p.config, p.store, p.O11y)
 	if err != nil {
 		return p, fmt.Errorf("pruner setup error: %v", err)
 	}
 
+	if p.config.RollupsEnabled {
+		p.aggregator, err = NewAggregator(p.config, p.pool, p.O11y)
+		if err != nil {
+			return p, fmt.Errorf("aggregator setup error: %v", err)
+		}
+		p.worker.onSaved = append(p.worker.onSaved, p.aggregator.late.saved)
+	}
+
+	if len(p.config.Goals) > 0 {
+		p.goals, err = NewGoalConverter(p.config, p.pool, p.O11y)
+		if err != nil {
+			return p, fmt.Errorf("goals setup error: %v", err)
+		}
+		p.worker.onSaved = append(p.worker.onSaved, p.goals.late.saved)
+	}
+
 	if len(p.config.AdminListen) > 0 {
 		p.admin = NewAdminAPI(config.Debug)
+		if p.pool != nil { // these APIs query postgres directly
+			if !p.config.ClickhouseEventsOnly { // stats are queried from events in postgres
+				NewStatsAPI(p.pool, p.O11y).register(p.admin.Group("/api/v1/stats"))
+			}
+			if p.aggregator != nil {
+				p.aggregator.register(p.admin.Group("/api/v1/rollups"))
+			}
+			if p.ingest != nil {
+				p.ingest.registerKeys(p.admin.Group("/api/v1/keys"))
+			}
+		}
 	}
 
 	// exit signal handling
@@ -147,6 +189,12 @@ func (p *Picolytics) Run() {
 	startMetrics(p.O11y.Metrics, p.config.DisableHostMetrics)
 	go p.worker.processQueuedEvents()
 	go p.pruner.prune()
+	if p.aggregator != nil {
+		go p.aggregator.aggregate()
+	}
+	if p.goals != nil {
+		go p.goals.convert()
+	}
 	go p.runAdmin()
 }
 
@@ -154,32 +202,41 @@ func (p *Picolytics) Shutdown() {
 	p.quit <- os.Interrupt
 }
 
+// shutdownGrace is how long shutdown may take after the drain timeout, before exiting anyway
+const shutdownGrace = 2 * time.Second
+
+// HandleShutdown drains in order: stop accepting events, wait for in-flight events
+// to be queued, then save the queue to the database, within the drain timeout.
 func (p *Picolytics) HandleShutdown() {
 	<-p.quit
 	p.O11y.Logger.Info("Picolytics shutdown via signal")
 
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	drainTimeout := time.Duration(p.config.DrainTimeoutSec) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
 	defer cancel()
 	done := make(chan struct{})
-	step := ""
+	var step atomic.Value // the shutdown step in progress, logged if shutdown times out
 	go func() {
-		step = "stopMetrics"
+		step.Store("api.Shutdown")
+		if err := p.api.Shutdown(ctx); err != nil {
+			p.O11y.Logger.Warn("error shutting down API server", "error", err)
+		}
+		step.Store("trackers.wait")
+		p.trackers.wait()
+		step.Store("worker.Shutdown")
+		p.worker.Shutdown(ctx)
+		step.Store("stopMetrics")
 		stopMetrics(p.O11y.Metrics, p.config.DisableHostMetrics)
-		step = "api.Shutdown"
-		p.api.Shutdown(ctx)
-		step = "worker.Shutdown"
-		p.worker.Shutdown()
-		step = "pool.Close"
-		p.pool.Close()
-		step = "done"
+		step.Store("store.Close")
+		p.store.Close()
 		close(done)
 	}()
 
 	select {
 	case <-done:
 		p.O11y.Logger.Debug("Picolytics shutdown completed")
-	case <-ctx.Done():
-		p.O11y.Logger.Warn(fmt.Sprintf("Picolytics shutdown timed out at %s", step))
+	case <-time.After(drainTimeout + shutdownGrace):
+		p.O11y.Logger.Warn(fmt.Sprintf("Picolytics shutdown timed out at %s", step.Load()))
 		os.Exit(1)
 	}
 }
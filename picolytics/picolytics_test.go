@@ -8,6 +8,7 @@ import (
 	"io"
 	"log"
 	"log/slog"
+	"net"
 	"net/http"
 	"regexp"
 	"strings"
@@ -15,8 +16,8 @@ import (
 	"testing"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
-	"github.com/jackc/pgx/v5/pgtype"
 	"github.com/pashagolub/pgxmock/v3"
 	"github.com/prometheus/client_golang/prometheus"
 	dto "github.com/prometheus/client_model/go"
@@ -87,6 +88,7 @@ func TestPicolyticsIntegration(t *testing.T) {
 	baseConfig.BatchMaxMsec = 1
 	baseConfig.BatchMaxSize = 1
 	baseConfig.QueueSize = 1
+	baseConfig.DrainTimeoutSec = 1
 	baseConfig.ListenAddr = "localhost:8080"
 
 	sessionID := int64(123456)
@@ -202,11 +204,12 @@ func TestPicolyticsIntegration(t *testing.T) {
 				if !strings.Contains(string(body), "window.document.currentScript.src.split") {
 					return fmt.Errorf("body missing script")
 				}
-				if res.ContentLength < 800 {
-					return fmt.Errorf("expected content length > 800, got %d", res.ContentLength)
+				// larger scripts are streamed without a content length
+				if len(body) < 800 {
+					return fmt.Errorf("expected script length > 800, got %d", len(body))
 				}
-				if res.ContentLength > 1000 {
-					return fmt.Errorf("expected content length < 1000, got %d", res.ContentLength)
+				if len(body) > 8192 {
+					return fmt.Errorf("expected script length < 8192, got %d", len(body))
 				}
 				return nil
 			},
@@ -258,6 +261,34 @@ func TestPicolyticsIntegration(t *testing.T) {
 				return nil
 			},
 		},
+		{
+			name: "admin server without postgres has no stats api",
+			getReq: func() *http.Request {
+				req, err := http.NewRequest("GET", "http://localhost:8082/api/v1/stats/summary", nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return req
+			},
+			getConfig: func() *Config {
+				c := baseConfig
+				c.Storage = "memory"
+				c.PruneDays = 1
+				c.AdminListen = "localhost:8082"
+				return &c
+			},
+			getMock: func() pgxmock.PgxPoolIface {
+				mock, err := pgxmock.NewPool()
+				if err != nil {
+					t.Fatal(err)
+				}
+				return mock
+			},
+			expectedCode: http.StatusNotFound,
+			check: func(res *http.Response, messages []string, metrics *Metrics, config *Config) error {
+				return nil
+			},
+		},
 		{
 			name: "empty js tracking event",
 			getReq: func() *http.Request {
@@ -337,18 +368,29 @@ func TestPicolyticsIntegration(t *testing.T) {
 				mock.ExpectQuery(`INSERT INTO domains .domain_name. VALUES`).
 					WithArgs("example.com").
 					WillReturnRows(mock.NewRows([]string{"domain_id"}).AddRow(int32(domainID)))
-				mock.ExpectBeginTx(pgx.TxOptions{})
-				mock.ExpectQuery(`SELECT id FROM sessions WHERE visitor_id`).
-					WithArgs(
-						pgxmock.AnyArg(), // this arg is visitor_id, which varies based on time, salt, client IP, and UA
-						pgtype.Interval{Microseconds: 1800000000, Days: 0, Months: 0, Valid: true}).
-					WillReturnRows(mock.NewRows([]string{"session_id"}).AddRow(sessionID))
-				mock.ExpectExec("UPDATE sessions SET bounce").
-					WithArgs("/", sessionID, "load").
-					WillReturnResult(pgxmock.NewResult("UPDATE", 1))
-				mock.ExpectCommit()
+				saltBytes := uuid.MustParse(dbSalt) // the salter uses the raw UUID bytes
+				visitorID := createVisitID(&PicolyticsEvent{
+					Domain:             "example.com",
+					ClientIpDONOTSTORE: "127.0.0.1",
+					UaDONOTSTORE: "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) " +
+						"AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0.4472.114 Safari/537.36",
+					Lang:       "en-US,en;q=0.9",
+					Timezone:   "Europe/Paris",
+					ScreenW:    1920,
+					ScreenH:    1080,
+					PixelDepth: 24,
+					PixelRatio: 1.5,
+				}, TestDBSalter{salt: string(saltBytes[:])}, nil)
+				sessionArgs := anyArgs(33)
+				sessionArgs[0] = []string{visitorID}
+				sessionArgs[2] = []string{"/"}
+				sessionArgs[3] = []string{"/"}
+				sessionArgs[28] = []int32{30}
+				mock.ExpectQuery(`WITH batch AS`).
+					WithArgs(sessionArgs...).
+					WillReturnRows(mock.NewRows([]string{"id", "visitor_id"}).AddRow(sessionID, newPGText(visitorID)))
 				mock.ExpectCopyFrom(pgx.Identifier{"events"}, []string{"domain_id", "session_id", "visitor_id",
-					"name", "path", "referrer", "load_time", "ttfb"}).WillReturnResult(1)
+					"name", "path", "referrer", "load_time", "ttfb", "props", "created_at", "lcp", "cls", "inp", "fcp", "target", "engaged_ms", "scroll_depth"}).WillReturnResult(1)
 				return mock
 			},
 			expectedCode: http.StatusAccepted,
@@ -392,6 +434,10 @@ func TestPicolyticsIntegration(t *testing.T) {
 			}
 
 			p.Run()
+			waitForListener(t, p.config.ListenAddr)
+			if len(p.config.AdminListen) > 0 {
+				waitForListener(t, p.config.AdminListen)
+			}
 
 			// run tests here
 			var res *http.Response
@@ -418,6 +464,14 @@ func TestPicolyticsIntegration(t *testing.T) {
 					t.Error("expected non-nil response")
 					return
 				}
+				// the client timeout covers reading the body, so read it before shutdown
+				body, err := io.ReadAll(res.Body)
+				res.Body.Close()
+				if err != nil {
+					t.Errorf("expected no response body error, got %s", err)
+					return
+				}
+				res.Body = io.NopCloser(bytes.NewReader(body))
 				assert.Equal(t, tt.expectedCode, res.StatusCode, fmt.Sprintf("expected status code %v", tt.expectedCode))
 			}()
 			p.HandleShutdown()
@@ -429,6 +483,28 @@ func TestPicolyticsIntegration(t *testing.T) {
 	}
 }
 
+// waitForListener blocks until the server started by Run is accepting connections
+func waitForListener(t *testing.T, addr string) {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for listener on %s", addr)
+}
+
+type TestDBSalter struct {
+	salt string
+}
+
+func (s TestDBSalter) getSalt() (string, error) {
+	return s.salt, nil
+}
+
 func getCounterValue(counter prometheus.Counter) float64 {
 	var metric dto.Metric
 	if err := counter.Write(&metric); err != nil {
@@ -437,3 +513,12 @@ func getCounterValue(counter prometheus.Counter) float64 {
 	}
 	return metric.Counter.GetValue()
 }
+
+func getGaugeValue(gauge prometheus.Gauge) float64 {
+	var metric dto.Metric
+	if err := gauge.Write(&metric); err != nil {
+		log.Printf("Error writing metric: %v", err)
+		return 0
+	}
+	return metric.Gauge.GetValue()
+}
@@ -13,46 +13,73 @@ ON CONFLICT (domain_name) DO UPDATE
 SET domain_name = EXCLUDED.domain_name
 RETURNING domain_id;
 
--- name: GetSession :one
-SELECT id FROM sessions
-WHERE visitor_id = $1
-AND updated_at > CURRENT_TIMESTAMP - $2::interval
-ORDER by updated_at DESC
-LIMIT 1;
-
----- MUST call this in a transaction after GetSession ----
--- name: CreateSession :one
-INSERT INTO sessions (
-    updated_at, bounce, domain_id, exit_path, ---- values updated with each event ----
-    visitor_id, entry_path, ---- static values from first event ---- 
-    country, latitude, longitude, subdivision, city, ---- geoip lookup ----
-    browser, browser_version, os, os_version, platform, device_type, bot, screen_w, screen_h, timezone, pixel_ratio, pixel_depth, ---- useragent ----
-    utm_source, utm_medium, utm_campaign, utm_content, utm_term ---- query string ----
-) VALUES (
-  CURRENT_TIMESTAMP, TRUE, $1, $2,
-  $3, $4,
-  $5, $6, $7, $8, $9,
-  $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21,
-  $22, $23, $24, $25, $26
+-- name: UpsertSessions :many
+WITH batch AS (
+    SELECT * FROM unnest(
+        @visitor_ids::text[], @domain_ids::int[], @entry_paths::text[], @exit_paths::text[],
+        @engaged::boolean[], @engaged_after_entry::boolean[],
+        @countries::text[], @latitudes::float8[], @longitudes::float8[], @subdivisions::text[], @cities::text[],
+        @browsers::text[], @browser_versions::text[], @oses::text[], @os_versions::text[], @platforms::text[], @device_types::text[],
+        @bots::boolean[], @screen_ws::int[], @screen_hs::int[], @timezones::text[], @pixel_ratios::float8[], @pixel_depths::int[],
+        @utm_sources::text[], @utm_mediums::text[], @utm_campaigns::text[], @utm_contents::text[], @utm_terms::text[], @session_timeout_mins::int[],
+        @first_event_times::timestamptz[], @last_event_times::timestamptz[], @engaged_ms::int[]
+    ) AS b(
+        visitor_id, domain_id, entry_path, exit_path,
+        engaged, engaged_after_entry,
+        country, latitude, longitude, subdivision, city,
+        browser, browser_version, os, os_version, platform, device_type,
+        bot, screen_w, screen_h, timezone, pixel_ratio, pixel_depth,
+        utm_source, utm_medium, utm_campaign, utm_content, utm_term, session_timeout_min,
+        first_event_time, last_event_time, engaged_ms
+    )
+), existing AS (
+    SELECT DISTINCT ON (sessions.visitor_id) sessions.id, sessions.visitor_id
+    FROM sessions JOIN batch ON sessions.visitor_id = batch.visitor_id
+    WHERE sessions.updated_at > batch.first_event_time - make_interval(mins => batch.session_timeout_min)
+    AND sessions.updated_at <= batch.first_event_time + make_interval(mins => batch.session_timeout_min)
+    -- partitioned sessions are bounded, so only recent partitions are searched
+    AND sessions.created_at >= @created_after::timestamptz
+    ORDER BY sessions.visitor_id, sessions.updated_at DESC
+), updated AS (
+    UPDATE sessions
+    SET
+        bounce = CASE WHEN batch.engaged THEN FALSE ELSE sessions.bounce END,
+        updated_at = GREATEST(sessions.updated_at, batch.last_event_time),
+        exit_path = batch.exit_path,
+        duration = EXTRACT(EPOCH FROM (GREATEST(sessions.updated_at, batch.last_event_time) - sessions.created_at)),
+        engaged_seconds = sessions.engaged_seconds + ROUND(batch.engaged_ms / 1000.0)
+    FROM existing JOIN batch ON batch.visitor_id = existing.visitor_id
+    WHERE sessions.id = existing.id
+    RETURNING sessions.id, sessions.visitor_id
+), created AS (
+    INSERT INTO sessions (
+        created_at, updated_at, bounce, domain_id, exit_path,
+        visitor_id, entry_path,
+        country, latitude, longitude, subdivision, city,
+        browser, browser_version, os, os_version, platform, device_type, bot, screen_w, screen_h, timezone, pixel_ratio, pixel_depth,
+        utm_source, utm_medium, utm_campaign, utm_content, utm_term, engaged_seconds
+    )
+    SELECT
+        batch.first_event_time, batch.last_event_time, NOT batch.engaged_after_entry, batch.domain_id, batch.exit_path,
+        batch.visitor_id, batch.entry_path,
+        batch.country, batch.latitude, batch.longitude, batch.subdivision, batch.city,
+        batch.browser, batch.browser_version, batch.os, batch.os_version, batch.platform, batch.device_type, batch.bot, batch.screen_w, batch.screen_h, batch.timezone, batch.pixel_ratio, batch.pixel_depth,
+        batch.utm_source, batch.utm_medium, batch.utm_campaign, batch.utm_content, batch.utm_term, ROUND(batch.engaged_ms / 1000.0)
+    FROM batch
+    WHERE NOT EXISTS (SELECT 1 FROM existing WHERE existing.visitor_id = batch.visitor_id)
+    RETURNING sessions.id, sessions.visitor_id
 )
-RETURNING id;
-
----- MUST call this in a transaction after GetSession ----
--- name: UpdateSession :exec
-UPDATE sessions 
-SET 
-    bounce = CASE WHEN @event_name::text NOT IN ('hidden', 'ping') THEN FALSE ELSE bounce END,
-    updated_at = CURRENT_TIMESTAMP,
-    exit_path = $1,
-    duration = EXTRACT(EPOCH FROM (CURRENT_TIMESTAMP - created_at))
-WHERE id = $2;
+SELECT id, visitor_id FROM updated
+UNION ALL
+SELECT id, visitor_id FROM created;
 
 -- name: CreateEvents :copyfrom
 INSERT INTO events (
   domain_id, session_id, visitor_id, name, path, referrer,
-  load_time, ttfb
+  load_time, ttfb, props, created_at,
+  lcp, cls, inp, fcp, target, engaged_ms, scroll_depth
 ) VALUES (
-  $1, $2, $3, $4, $5, $6, $7, $8
+  $1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17
 );
 
 -- name: PruneSessions :exec
@@ -61,6 +88,22 @@ DELETE FROM sessions WHERE updated_at <= CURRENT_TIMESTAMP - @the_interval::inte
 -- name: PruneEvents :exec
 DELETE FROM events WHERE created_at <= CURRENT_TIMESTAMP - @the_interval::interval;
 
+-- name: UpsertJSError :exec
+INSERT INTO js_errors (
+    fingerprint, domain_id, message, source, line, col, stack, path, occurrences, first_seen, last_seen
+) VALUES (
+    $1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11
+)
+ON CONFLICT (fingerprint) DO UPDATE SET
+    stack = EXCLUDED.stack,
+    path = EXCLUDED.path,
+    occurrences = js_errors.occurrences + EXCLUDED.occurrences,
+    first_seen = LEAST(js_errors.first_seen, EXCLUDED.first_seen),
+    last_seen = GREATEST(js_errors.last_seen, EXCLUDED.last_seen);
+
+-- name: PruneJSErrors :exec
+DELETE FROM js_errors WHERE last_seen <= CURRENT_TIMESTAMP - @the_interval::interval;
+
 -- name: UpdateSalt :exec
 DO $$
 BEGIN
@@ -84,3 +127,288 @@ SELECT data FROM autocert_cache WHERE key = $1;
 
 -- name: AutocertCacheDelete :exec
 DELETE FROM autocert_cache WHERE key = $1;
+
+-- name: StatsSummary :one
+WITH filtered_sessions AS (
+    SELECT sessions.id, sessions.visitor_id, sessions.bounce, sessions.duration
+    FROM sessions
+    JOIN domains ON domains.domain_id = sessions.domain_id
+    WHERE (@domain::text = '' OR domains.domain_name = @domain::text)
+    AND sessions.created_at >= @start_time::timestamptz
+    AND sessions.created_at < @end_time::timestamptz
+    AND (@include_bots::boolean OR NOT sessions.bot)
+)
+SELECT
+    COUNT(DISTINCT visitor_id)::bigint AS visitors,
+    COUNT(*)::bigint AS sessions,
+    (SELECT COUNT(*) FROM events
+        JOIN filtered_sessions ON filtered_sessions.id = events.session_id
+        WHERE events.name IN ('load', 'pageview')
+    )::bigint AS pageviews,
+    COALESCE(AVG(CASE WHEN bounce THEN 1.0 ELSE 0.0 END), 0)::float8 AS bounce_rate,
+    COALESCE(AVG(duration), 0)::float8 AS avg_duration
+FROM filtered_sessions;
+
+-- name: StatsTopPaths :many
+SELECT
+    events.path,
+    COUNT(*)::bigint AS pageviews,
+    COUNT(DISTINCT events.visitor_id)::bigint AS visitors
+FROM events
+JOIN domains ON domains.domain_id = events.domain_id
+JOIN sessions ON sessions.id = events.session_id
+WHERE events.name IN ('load', 'pageview')
+AND (@domain::text = '' OR domains.domain_name = @domain::text)
+AND events.created_at >= @start_time::timestamptz
+AND events.created_at < @end_time::timestamptz
+AND (@include_bots::boolean OR NOT sessions.bot)
+GROUP BY events.path
+ORDER BY pageviews DESC, events.path
+LIMIT @row_limit::int;
+
+-- name: StatsTopReferrers :many
+SELECT
+    events.referrer,
+    COUNT(DISTINCT events.session_id)::bigint AS sessions,
+    COUNT(DISTINCT events.visitor_id)::bigint AS visitors
+FROM events
+JOIN domains ON domains.domain_id = events.domain_id
+JOIN sessions ON sessions.id = events.session_id
+WHERE events.name = 'load'
+AND events.referrer != ''
+AND (@domain::text = '' OR domains.domain_name = @domain::text)
+AND events.created_at >= @start_time::timestamptz
+AND events.created_at < @end_time::timestamptz
+AND (@include_bots::boolean OR NOT sessions.bot)
+GROUP BY events.referrer
+ORDER BY sessions DESC, events.referrer
+LIMIT @row_limit::int;
+
+---- field must be one of the session columns in the CASE below ----
+-- name: StatsSessionBreakdown :many
+SELECT
+    COALESCE(CASE @field::text
+        WHEN 'country' THEN sessions.country
+        WHEN 'browser' THEN sessions.browser
+        WHEN 'os' THEN sessions.os
+        WHEN 'device_type' THEN sessions.device_type
+        WHEN 'entry_path' THEN sessions.entry_path
+        WHEN 'exit_path' THEN sessions.exit_path
+        WHEN 'utm_source' THEN sessions.utm_source
+        WHEN 'utm_medium' THEN sessions.utm_medium
+        WHEN 'utm_campaign' THEN sessions.utm_campaign
+        WHEN 'utm_content' THEN sessions.utm_content
+        WHEN 'utm_term' THEN sessions.utm_term
+    END, '')::text AS value,
+    COUNT(DISTINCT sessions.visitor_id)::bigint AS visitors,
+    COUNT(*)::bigint AS sessions,
+    COALESCE(AVG(CASE WHEN sessions.bounce THEN 1.0 ELSE 0.0 END), 0)::float8 AS bounce_rate
+FROM sessions
+JOIN domains ON domains.domain_id = sessions.domain_id
+WHERE (@domain::text = '' OR domains.domain_name = @domain::text)
+AND sessions.created_at >= @start_time::timestamptz
+AND sessions.created_at < @end_time::timestamptz
+AND (@include_bots::boolean OR NOT sessions.bot)
+GROUP BY value
+ORDER BY sessions DESC, value
+LIMIT @row_limit::int;
+
+---- pageviews are counted by their scroll depth reports, one per pageview ----
+-- name: StatsScrollDepth :many
+SELECT
+    events.path,
+    COUNT(*)::bigint AS pageviews,
+    AVG(events.scroll_depth)::float8 AS avg_depth,
+    COUNT(*) FILTER (WHERE events.scroll_depth >= 25)::bigint AS reached_25,
+    COUNT(*) FILTER (WHERE events.scroll_depth >= 50)::bigint AS reached_50,
+    COUNT(*) FILTER (WHERE events.scroll_depth >= 75)::bigint AS reached_75,
+    COUNT(*) FILTER (WHERE events.scroll_depth >= 100)::bigint AS reached_100
+FROM events
+JOIN domains ON domains.domain_id = events.domain_id
+JOIN sessions ON sessions.id = events.session_id
+WHERE events.scroll_depth IS NOT NULL
+AND (@domain::text = '' OR domains.domain_name = @domain::text)
+AND events.created_at >= @start_time::timestamptz
+AND events.created_at < @end_time::timestamptz
+AND (@include_bots::boolean OR NOT sessions.bot)
+GROUP BY events.path
+ORDER BY pageviews DESC, events.path
+LIMIT @row_limit::int;
+---- field must be one of the session columns in the CASE below, or referrer: the host of the session's first referrer ----
+-- name: StatsConversions :many
+SELECT
+    COALESCE(CASE @field::text
+        WHEN 'country' THEN sessions.country
+        WHEN 'referrer' THEN substring(entry.referrer from '^[a-zA-Z][a-zA-Z0-9+.-]*://([^/:?#]+)')
+        WHEN 'utm_source' THEN sessions.utm_source
+        WHEN 'utm_medium' THEN sessions.utm_medium
+        WHEN 'utm_campaign' THEN sessions.utm_campaign
+        WHEN 'utm_content' THEN sessions.utm_content
+        WHEN 'utm_term' THEN sessions.utm_term
+    END, '')::text AS value,
+    COUNT(*)::bigint AS sessions,
+    COUNT(*) FILTER (WHERE @goal::text = ANY(sessions.converted_goals))::bigint AS conversions,
+    COALESCE(AVG(CASE WHEN @goal::text = ANY(sessions.converted_goals) THEN 1.0 ELSE 0.0 END), 0)::float8 AS conversion_rate
+FROM sessions
+JOIN domains ON domains.domain_id = sessions.domain_id
+LEFT JOIN LATERAL (
+    SELECT events.referrer FROM events
+    WHERE @field::text = 'referrer'
+    AND events.session_id = sessions.id
+    ORDER BY events.id
+    LIMIT 1
+) AS entry ON TRUE
+WHERE (@domain::text = '' OR domains.domain_name = @domain::text)
+AND sessions.created_at >= @start_time::timestamptz
+AND sessions.created_at < @end_time::timestamptz
+AND (@include_bots::boolean OR NOT sessions.bot)
+GROUP BY value
+ORDER BY conversions DESC, sessions DESC, value
+LIMIT @row_limit::int;
+
+---- conversion rates are of all sessions in the range ----
+-- name: StatsGoals :many
+WITH filtered_sessions AS (
+    SELECT sessions.visitor_id, sessions.converted_goals
+    FROM sessions
+    JOIN domains ON domains.domain_id = sessions.domain_id
+    WHERE (@domain::text = '' OR domains.domain_name = @domain::text)
+    AND sessions.created_at >= @start_time::timestamptz
+    AND sessions.created_at < @end_time::timestamptz
+    AND (@include_bots::boolean OR NOT sessions.bot)
+)
+SELECT
+    goal::text AS goal,
+    COUNT(*)::bigint AS conversions,
+    COUNT(DISTINCT filtered_sessions.visitor_id)::bigint AS visitors,
+    (COUNT(*)::float8 / (SELECT COUNT(*) FROM filtered_sessions))::float8 AS conversion_rate
+FROM filtered_sessions, unnest(filtered_sessions.converted_goals) AS goal
+GROUP BY goal
+ORDER BY conversions DESC, goal
+LIMIT @row_limit::int;
+
+-- name: GetRollupWatermark :one
+SELECT rolled_up_to FROM rollup_watermarks WHERE rollup = $1;
+
+-- name: SetRollupWatermark :exec
+INSERT INTO rollup_watermarks (rollup, rolled_up_to)
+VALUES ($1, $2)
+ON CONFLICT (rollup) DO UPDATE SET rolled_up_to = EXCLUDED.rolled_up_to;
+
+-- name: RewindRollupWatermark :exec
+UPDATE rollup_watermarks SET rolled_up_to = LEAST(rolled_up_to, $2)
+WHERE rollup = $1;
+
+-- name: GetRollupStartTime :one
+SELECT LEAST(
+    COALESCE((SELECT MIN(created_at) FROM events), CURRENT_TIMESTAMP),
+    COALESCE((SELECT MIN(created_at) FROM sessions), CURRENT_TIMESTAMP)
+)::timestamptz AS start_time;
+
+-- name: RollupHourlyPaths :exec
+INSERT INTO rollup_hourly_paths (domain_id, hour, path, events, pageviews, visitors, vitals, lcp_p75, cls_p75, inp_p75, fcp_p75)
+SELECT
+    domain_id,
+    date_trunc('hour', created_at),
+    path,
+    COUNT(*),
+    COUNT(*) FILTER (WHERE name IN ('load', 'pageview')),
+    COUNT(DISTINCT visitor_id),
+    COUNT(*) FILTER (WHERE name = 'vitals'),
+    percentile_cont(0.75) WITHIN GROUP (ORDER BY lcp)::int,
+    percentile_cont(0.75) WITHIN GROUP (ORDER BY cls),
+    percentile_cont(0.75) WITHIN GROUP (ORDER BY inp)::int,
+    percentile_cont(0.75) WITHIN GROUP (ORDER BY fcp)::int
+FROM events
+WHERE created_at >= @start_time::timestamptz
+AND created_at < @end_time::timestamptz
+GROUP BY domain_id, date_trunc('hour', created_at), path
+ON CONFLICT (domain_id, hour, path) DO UPDATE SET
+    events = EXCLUDED.events,
+    pageviews = EXCLUDED.pageviews,
+    visitors = EXCLUDED.visitors,
+    vitals = EXCLUDED.vitals,
+    lcp_p75 = EXCLUDED.lcp_p75,
+    cls_p75 = EXCLUDED.cls_p75,
+    inp_p75 = EXCLUDED.inp_p75,
+    fcp_p75 = EXCLUDED.fcp_p75;
+
+---- the session referrer is the referrer of its first event ----
+-- name: RollupDailySessions :exec
+INSERT INTO rollup_daily_sessions (domain_id, day, referrer_host, country, device_type, sessions, visitors, bounces, duration_sum)
+SELECT
+    sessions.domain_id,
+    (sessions.created_at AT TIME ZONE 'UTC')::date,
+    COALESCE(substring(entry.referrer from '^[a-zA-Z][a-zA-Z0-9+.-]*://([^/:?#]+)'), ''),
+    COALESCE(sessions.country, ''),
+    COALESCE(sessions.device_type, ''),
+    COUNT(*),
+    COUNT(DISTINCT sessions.visitor_id),
+    COUNT(*) FILTER (WHERE sessions.bounce),
+    COALESCE(SUM(sessions.duration), 0)
+FROM sessions
+LEFT JOIN LATERAL (
+    SELECT events.referrer FROM events
+    WHERE events.session_id = sessions.id
+    ORDER BY events.id
+    LIMIT 1
+) AS entry ON TRUE
+WHERE sessions.created_at >= @start_time::timestamptz
+AND sessions.created_at < @end_time::timestamptz
+AND NOT sessions.bot
+GROUP BY 1, 2, 3, 4, 5
+ON CONFLICT (domain_id, day, referrer_host, country, device_type) DO UPDATE SET
+    sessions = EXCLUDED.sessions,
+    visitors = EXCLUDED.visitors,
+    bounces = EXCLUDED.bounces,
+    duration_sum = EXCLUDED.duration_sum;
+
+-- name: DeleteRollupHourlyPaths :exec
+DELETE FROM rollup_hourly_paths
+WHERE hour >= @start_time::timestamptz
+AND hour < @end_time::timestamptz;
+
+-- name: DeleteRollupDailySessions :exec
+DELETE FROM rollup_daily_sessions
+WHERE day >= (@start_time::timestamptz AT TIME ZONE 'UTC')::date
+AND day < (@end_time::timestamptz AT TIME ZONE 'UTC')::date;
+
+-- name: PruneRollupHourlyPaths :exec
+DELETE FROM rollup_hourly_paths WHERE hour <= CURRENT_TIMESTAMP - @the_interval::interval;
+
+-- name: PruneRollupDailySessions :exec
+DELETE FROM rollup_daily_sessions WHERE day <= (CURRENT_TIMESTAMP - @the_interval::interval)::date;
+
+-- name: CreateAPIKey :one
+INSERT INTO api_keys (key_hash, domain_name, name) VALUES ($1, $2, $3)
+RETURNING id, created_at;
+
+-- name: GetAPIKeyDomain :one
+SELECT domain_name FROM api_keys WHERE key_hash = $1;
+
+-- name: ListAPIKeys :many
+SELECT id, domain_name, name, created_at FROM api_keys ORDER BY id;
+
+-- name: DeleteAPIKey :execrows
+DELETE FROM api_keys WHERE id = $1;
+
+---- fails if postgres can't compile the regex ----
+-- name: CheckPathRegex :one
+SELECT '' ~ @path_regex::text AS matches;
+
+---- path goals match pageviews, event goals match events by name ----
+-- name: ConvertGoal :execrows
+UPDATE sessions
+SET converted_goals = array_append(sessions.converted_goals, @goal::text)
+WHERE NOT (@goal::text = ANY(sessions.converted_goals))
+AND sessions.id IN (
+    SELECT events.session_id FROM events
+    JOIN domains ON domains.domain_id = events.domain_id
+    WHERE events.created_at >= @start_time::timestamptz
+    AND events.created_at < @end_time::timestamptz
+    AND (@domain::text = '' OR domains.domain_name = @domain::text)
+    AND CASE WHEN @event_name::text = ''
+        THEN events.name IN ('load', 'pageview') AND events.path ~ @path_regex::text
+        ELSE events.name = @event_name::text
+    END
+);
@@ -0,0 +1,311 @@
+package picolytics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/labstack/echo/v4"
+
+	"github.com/nmcclain/picolytics/picolytics/db"
+)
+
+var errRollupPruned = errors.New("raw data may have been pruned")
+
+// rollup describes one rollup table. Rows are grouped into buckets, and each
+// bucket is recomputed in full, so folding is always done on bucket boundaries.
+type rollup struct {
+	name   string
+	bucket time.Duration
+	lag    time.Duration // how long to wait for a bucket's raw rows to settle
+	chunk  time.Duration // max range folded in one transaction
+	fold   func(context.Context, *db.Queries, pgtype.Timestamptz, pgtype.Timestamptz) error
+	clear  func(context.Context, *db.Queries, pgtype.Timestamptz, pgtype.Timestamptz) error
+}
+
+// Aggregator incrementally folds events and sessions into the rollup tables.
+// Each rollup keeps a watermark: everything before it has been folded. Events can be
+// saved after their buckets are folded, so the buckets since the oldest event saved since
+// the last fold are refolded too. At startup, the whole late window is refolded, since
+// events saved before a restart may not have been refolded.
+type Aggregator struct {
+	config     *Config
+	pool       PgxIface
+	o11y       *PicolyticsO11y
+	client     *db.Queries
+	rollups    []rollup
+	lateWindow time.Duration
+	late       lateEvents
+	lock       sync.Mutex
+}
+
+// lateWindow is the age of the oldest events accepted from clients, so events can be
+// saved this long after their time.
+func lateWindow(config *Config) time.Duration {
+	if batchMaxAge := time.Duration(config.BatchMaxAgeHours) * time.Hour; batchMaxAge > ingestMaxAge {
+		return batchMaxAge
+	}
+	return ingestMaxAge
+}
+
+// lateEvents tracks the oldest event saved since it was last taken, so periods that
+// have already been processed can be reprocessed, e.g. after a spool replay.
+type lateEvents struct {
+	lock  sync.Mutex
+	since time.Time
+}
+
+// saved records the oldest event time in a batch of saved events.
+func (l *lateEvents) saved(oldest time.Time) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.since.IsZero() || oldest.Before(l.since) {
+		l.since = oldest
+	}
+}
+
+// take returns the oldest event time saved since it was last taken, or zero if none were.
+func (l *lateEvents) take() time.Time {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	since := l.since
+	l.since = time.Time{}
+	return since
+}
+
+func NewAggregator(config *Config, pool PgxIface, o11y *PicolyticsO11y) (*Aggregator, error) {
+	a := Aggregator{
+		config: config,
+		pool:   pool,
+		o11y:   o11y,
+	}
+	a.client = db.New(a.pool)
+	a.lateWindow = lateWindow(config)
+	sessionTimeoutMin := config.SessionTimeoutMin
+	for _, sc := range config.Sites {
+		if sc.SessionTimeoutMin > sessionTimeoutMin {
+			sessionTimeoutMin = sc.SessionTimeoutMin
+		}
+	}
+	a.rollups = []rollup{
+		{
+			name:   "hourly_paths",
+			bucket: time.Hour,
+			lag:    5 * time.Minute, // events are batched and saved within seconds
+			chunk:  24 * time.Hour,
+			fold: func(ctx context.Context, q *db.Queries, start, end pgtype.Timestamptz) error {
+				return q.RollupHourlyPaths(ctx, db.RollupHourlyPathsParams{StartTime: start, EndTime: end})
+			},
+			clear: func(ctx context.Context, q *db.Queries, start, end pgtype.Timestamptz) error {
+				return q.DeleteRollupHourlyPaths(ctx, db.DeleteRollupHourlyPathsParams{StartTime: start, EndTime: end})
+			},
+		},
+		{
+			name:   "daily_sessions",
+			bucket: 24 * time.Hour,
+			// sessions keep changing until they time out
+			lag:   time.Duration(sessionTimeoutMin)*time.Minute + 5*time.Minute,
+			chunk: 7 * 24 * time.Hour,
+			fold: func(ctx context.Context, q *db.Queries, start, end pgtype.Timestamptz) error {
+				return q.RollupDailySessions(ctx, db.RollupDailySessionsParams{StartTime: start, EndTime: end})
+			},
+			clear: func(ctx context.Context, q *db.Queries, start, end pgtype.Timestamptz) error {
+				return q.DeleteRollupDailySessions(ctx, db.DeleteRollupDailySessionsParams{StartTime: start, EndTime: end})
+			},
+		},
+	}
+	return &a, nil
+}
+
+func (a *Aggregator) aggregate() {
+	a.late.saved(time.Now().Add(-a.lateWindow))
+	ticker := time.NewTicker(time.Minute * time.Duration(a.config.RollupCheckMin))
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := a.foldAll(context.Background(), time.Now()); err != nil {
+			a.o11y.Logger.Error("rollup error", "error", err)
+		}
+	}
+}
+
+// foldAll refolds the buckets that events saved since the last fold may have changed,
+// then folds every rollup up to the last bucket that has settled by now.
+func (a *Aggregator) foldAll(ctx context.Context, now time.Time) (err error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	lateSince := a.late.take()
+	defer func() {
+		if err != nil && !lateSince.IsZero() {
+			a.late.saved(lateSince) // try again next time
+		}
+	}()
+	for _, r := range a.rollups {
+		watermark, err := a.watermark(ctx, r)
+		if err != nil {
+			return fmt.Errorf("error getting %s watermark: %v", r.name, err)
+		}
+		for start := a.refoldStart(now, r, lateSince); !lateSince.IsZero() && start.Before(watermark); {
+			next := start.Add(r.chunk)
+			if next.After(watermark) {
+				next = watermark
+			}
+			if err := a.foldRange(ctx, r, start, next, foldRefold); err != nil {
+				return fmt.Errorf("error refolding %s rollup: %v", r.name, err)
+			}
+			a.o11y.Logger.Debug("Refolded rollup", "rollup", r.name, "from", start, "to", next)
+			start = next
+		}
+		end := now.Add(-r.lag).Truncate(r.bucket)
+		for watermark.Before(end) {
+			next := watermark.Add(r.chunk)
+			if next.After(end) {
+				next = end
+			}
+			if err := a.foldRange(ctx, r, watermark, next, foldIncremental); err != nil {
+				return fmt.Errorf("error folding %s rollup: %v", r.name, err)
+			}
+			a.o11y.Logger.Debug("Folded rollup", "rollup", r.name, "from", watermark, "to", next)
+			watermark = next
+		}
+	}
+	return nil
+}
+
+// refoldStart returns the oldest bucket that the events saved since the last fold may have
+// changed, allowing for the rollup's lag. Buckets whose raw rows may have been pruned are
+// left alone, since they'd be refolded with partial counts.
+func (a *Aggregator) refoldStart(now time.Time, r rollup, lateSince time.Time) time.Time {
+	start := lateSince.Add(-r.lag).Truncate(r.bucket)
+	if a.config.PruneDays > 0 {
+		pruned := now.AddDate(0, 0, -a.config.PruneDays).Truncate(r.bucket).Add(r.bucket)
+		if start.Before(pruned) {
+			start = pruned
+		}
+	}
+	return start
+}
+
+// watermark returns where to resume folding. New rollups start at the oldest raw row.
+func (a *Aggregator) watermark(ctx context.Context, r rollup) (time.Time, error) {
+	watermark, err := a.client.GetRollupWatermark(ctx, r.name)
+	if err == nil {
+		return watermark.Time, nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return time.Time{}, err
+	}
+	start, err := a.client.GetRollupStartTime(ctx)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return start.Time.UTC().Truncate(r.bucket), nil
+}
+
+type foldMode int
+
+const (
+	foldIncremental foldMode = iota // folds new buckets, and advances the watermark
+	foldRefold                      // recomputes folded buckets, which late events may have changed
+	foldRebuild                     // clears folded buckets, then recomputes them
+)
+
+// foldRange recomputes the buckets in [start, end) in one transaction.
+func (a *Aggregator) foldRange(ctx context.Context, r rollup, start, end time.Time, mode foldMode) (err error) {
+	tx, err := a.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback(ctx)
+		}
+	}()
+	txClient := a.client.WithTx(tx)
+	if mode == foldRebuild {
+		if err = r.clear(ctx, txClient, newPGTimestamptz(start), newPGTimestamptz(end)); err != nil {
+			return err
+		}
+	}
+	if err = r.fold(ctx, txClient, newPGTimestamptz(start), newPGTimestamptz(end)); err != nil {
+		return err
+	}
+	if mode == foldIncremental {
+		if err = txClient.SetRollupWatermark(ctx, db.SetRollupWatermarkParams{Rollup: r.name, RolledUpTo: newPGTimestamptz(end)}); err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+// Rebuild recomputes the rollups between from and to, e.g. after correcting raw rows.
+// The range is widened to bucket boundaries, and never extends past the watermark.
+// Ranges whose raw rows may have been pruned are refused, since they can't be rebuilt.
+func (a *Aggregator) Rebuild(ctx context.Context, from, to time.Time) error {
+	if a.config.PruneDays > 0 {
+		pruned := time.Now().AddDate(0, 0, -a.config.PruneDays)
+		if from.Before(pruned) {
+			return fmt.Errorf("%w before %s", errRollupPruned, pruned.UTC().Format(time.RFC3339))
+		}
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for _, r := range a.rollups {
+		watermark, err := a.client.GetRollupWatermark(ctx, r.name)
+		if errors.Is(err, pgx.ErrNoRows) {
+			continue // nothing folded yet
+		} else if err != nil {
+			return fmt.Errorf("error getting %s watermark: %v", r.name, err)
+		}
+		start := from.UTC().Truncate(r.bucket)
+		end := to.UTC().Truncate(r.bucket)
+		if end.Before(to) {
+			end = end.Add(r.bucket)
+		}
+		if end.After(watermark.Time) {
+			end = watermark.Time
+		}
+		for start.Before(end) {
+			next := start.Add(r.chunk)
+			if next.After(end) {
+				next = end
+			}
+			if err := a.foldRange(ctx, r, start, next, foldRebuild); err != nil {
+				return fmt.Errorf("error rebuilding %s rollup: %v", r.name, err)
+			}
+			start = next
+		}
+		a.o11y.Logger.Info("Rebuilt rollup", "rollup", r.name, "from", from, "to", end)
+	}
+	return nil
+}
+
+// register adds the rollup admin endpoints.
+func (a *Aggregator) register(g *echo.Group) {
+	g.POST("/rebuild", a.rebuild)
+}
+
+func (a *Aggregator) rebuild(c echo.Context) error {
+	from, err := parseStatsTime(c.QueryParam("from"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid from: %v", err))
+	}
+	to, err := parseStatsTime(c.QueryParam("to"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid to: %v", err))
+	}
+	if !from.Before(to) {
+		return echo.NewHTTPError(http.StatusBadRequest, "from must be before to")
+	}
+	if err := a.Rebuild(c.Request().Context(), from, to); errors.Is(err, errRollupPruned) {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	} else if err != nil {
+		a.o11y.Logger.Error("rollup rebuild error", "error", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("Rollup rebuild failed: %v", err))
+	}
+	return c.String(http.StatusOK, "OK")
+}
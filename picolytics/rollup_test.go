@@ -0,0 +1,303 @@
+package picolytics
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/labstack/echo/v4"
+	"github.com/pashagolub/pgxmock/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFoldAll(t *testing.T) {
+	o11yMock := &PicolyticsO11y{
+		Logger:  slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError})),
+		Metrics: setupMetrics(1, "", "", ""),
+	}
+	ts := func(day, hour int) interface{} {
+		return newPGTimestamptz(time.Date(2024, 1, day, hour, 0, 0, 0, time.UTC))
+	}
+	now := time.Date(2024, 1, 3, 12, 2, 0, 0, time.UTC)
+	tests := []struct {
+		name      string
+		pruneDays int
+		late      time.Time // oldest event saved since the last fold
+		getMock   func() pgxmock.PgxPoolIface
+		wantErr   error
+	}{
+		{
+			name: "fold from watermark and start time",
+			getMock: func() pgxmock.PgxPoolIface {
+				mock, err := pgxmock.NewPool()
+				if err != nil {
+					t.Fatal(err)
+				}
+				// hourly paths resume at their watermark, and stop before the lag
+				mock.ExpectQuery("SELECT rolled_up_to FROM rollup_watermarks").WithArgs("hourly_paths").
+					WillReturnRows(mock.NewRows([]string{"rolled_up_to"}).AddRow(ts(3, 9)))
+				mock.ExpectBegin()
+				mock.ExpectExec("INSERT INTO rollup_hourly_paths").WithArgs(ts(3, 9), ts(3, 11)).
+					WillReturnResult(pgxmock.NewResult("INSERT", 3))
+				mock.ExpectExec("INSERT INTO rollup_watermarks").WithArgs("hourly_paths", ts(3, 11)).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				mock.ExpectCommit()
+				// daily sessions start at the day of the oldest raw row
+				mock.ExpectQuery("SELECT rolled_up_to FROM rollup_watermarks").WithArgs("daily_sessions").
+					WillReturnError(pgx.ErrNoRows)
+				mock.ExpectQuery("SELECT LEAST").
+					WillReturnRows(mock.NewRows([]string{"start_time"}).AddRow(ts(1, 13)))
+				mock.ExpectBegin()
+				mock.ExpectExec("INSERT INTO rollup_daily_sessions").WithArgs(ts(1, 0), ts(3, 0)).
+					WillReturnResult(pgxmock.NewResult("INSERT", 2))
+				mock.ExpectExec("INSERT INTO rollup_watermarks").WithArgs("daily_sessions", ts(3, 0)).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				mock.ExpectCommit()
+				return mock
+			},
+		},
+		{
+			name: "fold in chunks",
+			getMock: func() pgxmock.PgxPoolIface {
+				mock, err := pgxmock.NewPool()
+				if err != nil {
+					t.Fatal(err)
+				}
+				mock.ExpectQuery("SELECT rolled_up_to FROM rollup_watermarks").WithArgs("hourly_paths").
+					WillReturnRows(mock.NewRows([]string{"rolled_up_to"}).AddRow(ts(2, 0)))
+				for _, chunk := range [][]interface{}{{ts(2, 0), ts(3, 0)}, {ts(3, 0), ts(3, 11)}} {
+					mock.ExpectBegin()
+					mock.ExpectExec("INSERT INTO rollup_hourly_paths").WithArgs(chunk...).
+						WillReturnResult(pgxmock.NewResult("INSERT", 3))
+					mock.ExpectExec("INSERT INTO rollup_watermarks").WithArgs("hourly_paths", chunk[1]).
+						WillReturnResult(pgxmock.NewResult("INSERT", 1))
+					mock.ExpectCommit()
+				}
+				// without events saved since the last fold, nothing is refolded
+				mock.ExpectQuery("SELECT rolled_up_to FROM rollup_watermarks").WithArgs("daily_sessions").
+					WillReturnRows(mock.NewRows([]string{"rolled_up_to"}).AddRow(ts(3, 0)))
+				return mock
+			},
+		},
+		{
+			name: "late event in an already folded bucket",
+			late: time.Date(2024, 1, 1, 5, 30, 0, 0, time.UTC),
+			getMock: func() pgxmock.PgxPoolIface {
+				mock, err := pgxmock.NewPool()
+				if err != nil {
+					t.Fatal(err)
+				}
+				// refolded from the late event's bucket, without moving the watermark
+				mock.ExpectQuery("SELECT rolled_up_to FROM rollup_watermarks").WithArgs("hourly_paths").
+					WillReturnRows(mock.NewRows([]string{"rolled_up_to"}).AddRow(ts(3, 11)))
+				for _, chunk := range [][]interface{}{{ts(1, 5), ts(2, 5)}, {ts(2, 5), ts(3, 5)}, {ts(3, 5), ts(3, 11)}} {
+					mock.ExpectBegin()
+					mock.ExpectExec("INSERT INTO rollup_hourly_paths").WithArgs(chunk...).
+						WillReturnResult(pgxmock.NewResult("INSERT", 3))
+					mock.ExpectCommit()
+				}
+				mock.ExpectQuery("SELECT rolled_up_to FROM rollup_watermarks").WithArgs("daily_sessions").
+					WillReturnRows(mock.NewRows([]string{"rolled_up_to"}).AddRow(ts(3, 0)))
+				mock.ExpectBegin()
+				mock.ExpectExec("INSERT INTO rollup_daily_sessions").WithArgs(ts(1, 0), ts(3, 0)).
+					WillReturnResult(pgxmock.NewResult("INSERT", 2))
+				mock.ExpectCommit()
+				return mock
+			},
+		},
+		{
+			name:      "buckets with pruned raw rows aren't refolded",
+			pruneDays: 2,
+			late:      time.Date(2024, 1, 1, 5, 30, 0, 0, time.UTC),
+			getMock: func() pgxmock.PgxPoolIface {
+				mock, err := pgxmock.NewPool()
+				if err != nil {
+					t.Fatal(err)
+				}
+				mock.ExpectQuery("SELECT rolled_up_to FROM rollup_watermarks").WithArgs("hourly_paths").
+					WillReturnRows(mock.NewRows([]string{"rolled_up_to"}).AddRow(ts(3, 11)))
+				for _, chunk := range [][]interface{}{{ts(1, 13), ts(2, 13)}, {ts(2, 13), ts(3, 11)}} {
+					mock.ExpectBegin()
+					mock.ExpectExec("INSERT INTO rollup_hourly_paths").WithArgs(chunk...).
+						WillReturnResult(pgxmock.NewResult("INSERT", 3))
+					mock.ExpectCommit()
+				}
+				mock.ExpectQuery("SELECT rolled_up_to FROM rollup_watermarks").WithArgs("daily_sessions").
+					WillReturnRows(mock.NewRows([]string{"rolled_up_to"}).AddRow(ts(3, 0)))
+				mock.ExpectBegin()
+				mock.ExpectExec("INSERT INTO rollup_daily_sessions").WithArgs(ts(2, 0), ts(3, 0)).
+					WillReturnResult(pgxmock.NewResult("INSERT", 2))
+				mock.ExpectCommit()
+				return mock
+			},
+		},
+		{
+			name: "db failure",
+			late: time.Date(2024, 1, 2, 11, 30, 0, 0, time.UTC),
+			getMock: func() pgxmock.PgxPoolIface {
+				mock, err := pgxmock.NewPool()
+				if err != nil {
+					t.Fatal(err)
+				}
+				mock.ExpectQuery("SELECT rolled_up_to FROM rollup_watermarks").WithArgs("hourly_paths").
+					WillReturnRows(mock.NewRows([]string{"rolled_up_to"}).AddRow(ts(3, 9)))
+				mock.ExpectBegin()
+				mock.ExpectExec("INSERT INTO rollup_hourly_paths").WithArgs(ts(2, 11), ts(3, 9)).
+					WillReturnError(os.ErrDeadlineExceeded)
+				mock.ExpectRollback()
+				return mock
+			},
+			wantErr: errors.New("error refolding hourly_paths rollup: i/o timeout"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := tt.getMock()
+			defer mock.Close()
+			a, err := NewAggregator(&Config{SessionTimeoutMin: 30, PruneDays: tt.pruneDays}, mock, o11yMock)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.late.IsZero() {
+				a.late.saved(tt.late)
+			}
+			err = a.foldAll(context.Background(), now)
+			assert.Equal(t, tt.wantErr, err)
+			if tt.wantErr == nil {
+				assert.True(t, a.late.since.IsZero(), "late events are refolded once")
+			} else {
+				assert.Equal(t, tt.late, a.late.since, "late events are refolded again after an error")
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestRebuildRollups(t *testing.T) {
+	o11yMock := &PicolyticsO11y{
+		Logger:  slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError})),
+		Metrics: setupMetrics(1, "", "", ""),
+	}
+	ts := func(day, hour int) interface{} {
+		return newPGTimestamptz(time.Date(2024, 1, day, hour, 0, 0, 0, time.UTC))
+	}
+	tests := []struct {
+		name         string
+		path         string
+		pruneDays    int
+		getMock      func() pgxmock.PgxPoolIface
+		expectedCode int
+	}{
+		{
+			name: "rebuild up to watermark",
+			path: "/api/v1/rollups/rebuild?from=2024-01-02T10:30:00Z&to=2024-01-02T12:00:00Z",
+			getMock: func() pgxmock.PgxPoolIface {
+				mock, err := pgxmock.NewPool()
+				if err != nil {
+					t.Fatal(err)
+				}
+				mock.ExpectQuery("SELECT rolled_up_to FROM rollup_watermarks").WithArgs("hourly_paths").
+					WillReturnRows(mock.NewRows([]string{"rolled_up_to"}).AddRow(ts(2, 11)))
+				mock.ExpectBegin()
+				mock.ExpectExec("DELETE FROM rollup_hourly_paths").WithArgs(ts(2, 10), ts(2, 11)).
+					WillReturnResult(pgxmock.NewResult("DELETE", 3))
+				mock.ExpectExec("INSERT INTO rollup_hourly_paths").WithArgs(ts(2, 10), ts(2, 11)).
+					WillReturnResult(pgxmock.NewResult("INSERT", 3))
+				mock.ExpectCommit()
+				// today's sessions haven't been folded yet
+				mock.ExpectQuery("SELECT rolled_up_to FROM rollup_watermarks").WithArgs("daily_sessions").
+					WillReturnRows(mock.NewRows([]string{"rolled_up_to"}).AddRow(ts(2, 0)))
+				return mock
+			},
+			expectedCode: http.StatusOK,
+		},
+		{
+			name: "nothing folded",
+			path: "/api/v1/rollups/rebuild?from=2024-01-01&to=2024-01-02",
+			getMock: func() pgxmock.PgxPoolIface {
+				mock, err := pgxmock.NewPool()
+				if err != nil {
+					t.Fatal(err)
+				}
+				mock.ExpectQuery("SELECT rolled_up_to FROM rollup_watermarks").WithArgs("hourly_paths").
+					WillReturnError(pgx.ErrNoRows)
+				mock.ExpectQuery("SELECT rolled_up_to FROM rollup_watermarks").WithArgs("daily_sessions").
+					WillReturnError(pgx.ErrNoRows)
+				return mock
+			},
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:      "raw data pruned",
+			path:      "/api/v1/rollups/rebuild?from=2000-01-01&to=2000-01-02",
+			pruneDays: 30,
+			getMock: func() pgxmock.PgxPoolIface {
+				mock, err := pgxmock.NewPool()
+				if err != nil {
+					t.Fatal(err)
+				}
+				return mock
+			},
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name: "missing range",
+			path: "/api/v1/rollups/rebuild?from=2024-01-01",
+			getMock: func() pgxmock.PgxPoolIface {
+				mock, err := pgxmock.NewPool()
+				if err != nil {
+					t.Fatal(err)
+				}
+				return mock
+			},
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name: "db failure",
+			path: "/api/v1/rollups/rebuild?from=2024-01-02T10:30:00Z&to=2024-01-02T12:00:00Z",
+			getMock: func() pgxmock.PgxPoolIface {
+				mock, err := pgxmock.NewPool()
+				if err != nil {
+					t.Fatal(err)
+				}
+				mock.ExpectQuery("SELECT rolled_up_to FROM rollup_watermarks").WithArgs("hourly_paths").
+					WillReturnRows(mock.NewRows([]string{"rolled_up_to"}).AddRow(ts(2, 11)))
+				mock.ExpectBegin()
+				mock.ExpectExec("DELETE FROM rollup_hourly_paths").WithArgs(ts(2, 10), ts(2, 11)).
+					WillReturnError(os.ErrDeadlineExceeded)
+				mock.ExpectRollback()
+				return mock
+			},
+			expectedCode: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := tt.getMock()
+			defer mock.Close()
+			a, err := NewAggregator(&Config{SessionTimeoutMin: 30, PruneDays: tt.pruneDays}, mock, o11yMock)
+			if err != nil {
+				t.Fatal(err)
+			}
+			e := echo.New()
+			a.register(e.Group("/api/v1/rollups"))
+
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, tt.path, nil))
+			assert.Equal(t, tt.expectedCode, rec.Code)
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,201 @@
+package picolytics
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/labstack/echo/v4/middleware"
+	"golang.org/x/time/rate"
+)
+
+// SiteConfig registers a domain, and any other hostnames that should be recorded as that domain.
+// The remaining fields optionally override the global settings for the site.
+type SiteConfig struct {
+	Domain            string   `mapstructure:"domain"`
+	Aliases           []string `mapstructure:"aliases"`
+	CorsOrigins       []string `mapstructure:"corsOrigins"`
+	RequestRateLimit  int      `mapstructure:"requestRateLimit"`
+	SessionTimeoutMin int      `mapstructure:"sessionTimeoutMin"`
+	ValidEventNames   []string `mapstructure:"validEventNames"`
+	BodyMaxSize       int64    `mapstructure:"bodyMaxSize"`
+}
+
+var (
+	errUnknownSite    = errors.New("unknown site")
+	errOriginMismatch = errors.New("origin does not match site")
+)
+
+// site holds the effective settings for a site: its overrides, or the global settings.
+type site struct {
+	domain            string
+	corsOrigins       []string                    // if empty, any origin allowed by the CORS middleware
+	rateLimiter       middleware.RateLimiterStore // nil if disabled
+	sessionTimeoutMin int
+	validEventNames   []string
+	bodyMaxSize       int64
+}
+
+// Sites maps registered hostnames to their site. If no sites are registered,
+// every hostname is accepted with the global settings.
+type Sites struct {
+	hosts        map[string]*site // hostname -> site
+	defaults     *site
+	verifyOrigin bool
+	maxBodySize  int64 // largest body size of any site
+}
+
+func NewSites(config *Config) (*Sites, error) {
+	s := Sites{
+		hosts: map[string]*site{},
+		defaults: &site{
+			rateLimiter:       newRateLimiter(config.RequestRateLimit),
+			sessionTimeoutMin: config.SessionTimeoutMin,
+			validEventNames:   config.ValidEventNames,
+			bodyMaxSize:       config.BodyMaxSize,
+		},
+		verifyOrigin: config.VerifyOrigin,
+		maxBodySize:  config.BodyMaxSize,
+	}
+	if s.verifyOrigin && len(config.Sites) < 1 {
+		return nil, fmt.Errorf("verifyOrigin requires sites")
+	}
+	for _, sc := range config.Sites {
+		domain := siteHost(sc.Domain)
+		if len(domain) < 1 {
+			return nil, fmt.Errorf("site missing domain")
+		}
+		st := *s.defaults
+		st.domain = domain
+		if len(sc.CorsOrigins) > 0 {
+			st.corsOrigins = sc.CorsOrigins
+		}
+		if sc.RequestRateLimit > 0 {
+			st.rateLimiter = newRateLimiter(sc.RequestRateLimit)
+		}
+		if sc.SessionTimeoutMin > 0 {
+			st.sessionTimeoutMin = sc.SessionTimeoutMin
+		}
+		if len(sc.ValidEventNames) > 0 {
+			st.validEventNames = sc.ValidEventNames
+		}
+		if sc.BodyMaxSize > 0 {
+			st.bodyMaxSize = sc.BodyMaxSize
+			if st.bodyMaxSize > s.maxBodySize {
+				s.maxBodySize = st.bodyMaxSize
+			}
+		}
+		for _, host := range append([]string{domain}, sc.Aliases...) {
+			host = siteHost(host)
+			if existing, ok := s.hosts[host]; ok && existing != &st {
+				return nil, fmt.Errorf("host %s registered for both %s and %s", host, existing.domain, domain)
+			}
+			s.hosts[host] = &st
+		}
+	}
+	return &s, nil
+}
+
+// see: https://echo.labstack.com/docs/middleware/rate-limiter
+// The default in-memory implementation is focused on correctness and may not be the best option for a high number of concurrent requests or a large number of different identifiers (>16k).
+func newRateLimiter(limit int) middleware.RateLimiterStore {
+	if limit < 1 { // allow disabling rate limiter
+		return nil
+	}
+	return middleware.NewRateLimiterMemoryStore(rate.Limit(limit))
+}
+
+// siteHost normalizes hostnames the same way extractDomainPath does
+func siteHost(host string) string {
+	return strings.TrimPrefix(strings.ToLower(strings.TrimSpace(host)), "www.")
+}
+
+// lookup returns the site for a hostname, or false if it's not registered.
+func (s *Sites) lookup(host string) (*site, bool) {
+	if len(s.hosts) < 1 {
+		return s.defaults, true
+	}
+	st, ok := s.hosts[siteHost(host)]
+	return st, ok
+}
+
+// forLocation returns the settings for an event URL, before the event is parsed.
+// Unregistered or invalid URLs get the global settings, and are rejected later.
+func (s *Sites) forLocation(location string) *site {
+	u, err := url.Parse(location)
+	if err != nil {
+		return s.defaults
+	}
+	if st, ok := s.lookup(u.Hostname()); ok {
+		return st
+	}
+	return s.defaults
+}
+
+// forEvent returns the settings for an event before it's parsed: those of its domain
+// override if it has one, or else of its URL.
+func (s *Sites) forEvent(event *PicolyticsEvent) *site {
+	if len(event.DomainOverride) < 1 {
+		return s.forLocation(event.Location)
+	}
+	if st, ok := s.lookup(event.DomainOverride); ok {
+		return st
+	}
+	return s.defaults
+}
+
+// resolve replaces the event domain with its registered domain, and checks the
+// request origin if configured, except for pixel events, which can't send one.
+// Events for unregistered hosts are rejected.
+func (s *Sites) resolve(event *PicolyticsEvent) error {
+	st, ok := s.lookup(event.Domain)
+	if !ok {
+		return fmt.Errorf("%w: %s", errUnknownSite, event.Domain)
+	}
+	if s.verifyOrigin && !event.pixel {
+		origin, err := url.Parse(event.Origin)
+		if err != nil {
+			return fmt.Errorf("%w: %q for %s", errOriginMismatch, event.Origin, st.domain)
+		}
+		if originSite, ok := s.hosts[siteHost(origin.Hostname())]; !ok || originSite != st {
+			return fmt.Errorf("%w: %q for %s", errOriginMismatch, event.Origin, st.domain)
+		}
+	}
+	if len(st.domain) > 0 {
+		event.Domain = st.domain
+	}
+	return nil
+}
+
+// sessionTimeoutMin returns the session timeout for a resolved event domain
+func (s *Sites) sessionTimeoutMin(domain string) int {
+	if st, ok := s.hosts[domain]; ok {
+		return st.sessionTimeoutMin
+	}
+	return s.defaults.sessionTimeoutMin
+}
+
+// allowsOrigin checks the request Origin against the site's CORS origins, if it has any.
+// Requests without an Origin header, e.g. from servers, are allowed.
+func (st *site) allowsOrigin(origin string) bool {
+	if len(st.corsOrigins) < 1 || len(origin) < 1 {
+		return true
+	}
+	for _, o := range st.corsOrigins {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// allCorsOrigins returns the origins allowed by the CORS middleware: the global
+// origins, plus each site's origins. Sites' origins are enforced per event.
+func allCorsOrigins(config *Config) []string {
+	origins := append([]string{}, config.CorsOrigins...)
+	for _, sc := range config.Sites {
+		origins = append(origins, sc.CorsOrigins...)
+	}
+	return origins
+}
@@ -0,0 +1,204 @@
+package picolytics
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testSites returns the sites for a test config
+func testSites(t testing.TB, config *Config) *Sites {
+	sites, err := NewSites(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sites
+}
+
+func TestNewSites(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    Config
+		wantHosts map[string]string // host -> domain
+		wantErr   bool
+	}{
+		{
+			name:      "no sites",
+			wantHosts: map[string]string{},
+		},
+		{
+			name: "domains and aliases",
+			config: Config{Sites: []SiteConfig{
+				{Domain: "Example.com", Aliases: []string{"www.example.com", "staging.example.com"}},
+				{Domain: "example.org"},
+			}},
+			wantHosts: map[string]string{
+				"example.com":         "example.com",
+				"staging.example.com": "example.com",
+				"example.org":         "example.org",
+			},
+		},
+		{
+			name:    "missing domain",
+			config:  Config{Sites: []SiteConfig{{Aliases: []string{"example.com"}}}},
+			wantErr: true,
+		},
+		{
+			name: "duplicate alias",
+			config: Config{Sites: []SiteConfig{
+				{Domain: "example.com", Aliases: []string{"staging.example.com"}},
+				{Domain: "example.org", Aliases: []string{"staging.example.com"}},
+			}},
+			wantErr: true,
+		},
+		{
+			name:    "verify origin without sites",
+			config:  Config{VerifyOrigin: true},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sites, err := NewSites(&tt.config)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			gotHosts := map[string]string{}
+			for host, site := range sites.hosts {
+				gotHosts[host] = site.domain
+			}
+			assert.Equal(t, tt.wantHosts, gotHosts)
+		})
+	}
+}
+
+func TestSiteOverrides(t *testing.T) {
+	sites := testSites(t, &Config{
+		RequestRateLimit:  10,
+		SessionTimeoutMin: 30,
+		ValidEventNames:   []string{"load"},
+		BodyMaxSize:       2048,
+		Sites: []SiteConfig{
+			{
+				Domain:            "app.example.com",
+				CorsOrigins:       []string{"https://app.example.com"},
+				RequestRateLimit:  100,
+				SessionTimeoutMin: 120,
+				ValidEventNames:   []string{"load", "signup"},
+				BodyMaxSize:       4096,
+			},
+			{Domain: "example.com"},
+		},
+	})
+
+	app, ok := sites.lookup("app.example.com")
+	assert.True(t, ok)
+	assert.Equal(t, []string{"https://app.example.com"}, app.corsOrigins)
+	assert.NotSame(t, sites.defaults.rateLimiter, app.rateLimiter)
+	assert.Equal(t, 120, app.sessionTimeoutMin)
+	assert.Equal(t, []string{"load", "signup"}, app.validEventNames)
+	assert.Equal(t, int64(4096), app.bodyMaxSize)
+
+	marketing, ok := sites.lookup("www.example.com")
+	assert.True(t, ok)
+	assert.Empty(t, marketing.corsOrigins)
+	assert.Same(t, sites.defaults.rateLimiter, marketing.rateLimiter)
+	assert.Equal(t, 30, marketing.sessionTimeoutMin)
+	assert.Equal(t, []string{"load"}, marketing.validEventNames)
+	assert.Equal(t, int64(2048), marketing.bodyMaxSize)
+
+	assert.Equal(t, int64(4096), sites.maxBodySize)
+	assert.Equal(t, 120, sites.sessionTimeoutMin("app.example.com"))
+	assert.Equal(t, 30, sites.sessionTimeoutMin("example.com"))
+	assert.Same(t, app, sites.forLocation("https://app.example.com/login"))
+	assert.Same(t, sites.defaults, sites.forLocation("https://spam.example.net/"))
+
+	assert.True(t, app.allowsOrigin("https://app.example.com"))
+	assert.True(t, app.allowsOrigin(""))
+	assert.False(t, app.allowsOrigin("https://example.com"))
+	assert.True(t, marketing.allowsOrigin("https://anywhere.example.net"))
+}
+
+func TestSitesResolve(t *testing.T) {
+	sites := []SiteConfig{{Domain: "example.com", Aliases: []string{"staging.example.com"}}, {Domain: "example.org"}}
+	tests := []struct {
+		name         string
+		verifyOrigin bool
+		noSites      bool
+		event        PicolyticsEvent
+		wantDomain   string
+		wantErr      error
+	}{
+		{
+			name:       "registered domain",
+			event:      PicolyticsEvent{Domain: "example.com"},
+			wantDomain: "example.com",
+		},
+		{
+			name:       "alias",
+			event:      PicolyticsEvent{Domain: "Staging.Example.com"},
+			wantDomain: "example.com",
+		},
+		{
+			name:    "unknown site",
+			event:   PicolyticsEvent{Domain: "spam.example.net"},
+			wantErr: errUnknownSite,
+		},
+		{
+			name:       "no sites configured",
+			noSites:    true,
+			event:      PicolyticsEvent{Domain: "spam.example.net"},
+			wantDomain: "spam.example.net",
+		},
+		{
+			name:         "matching origin",
+			verifyOrigin: true,
+			event:        PicolyticsEvent{Domain: "staging.example.com", Origin: "https://www.example.com"},
+			wantDomain:   "example.com",
+		},
+		{
+			name:         "matching referer",
+			verifyOrigin: true,
+			event:        PicolyticsEvent{Domain: "example.org", Origin: "https://example.org/some/page?q=1"},
+			wantDomain:   "example.org",
+		},
+		{
+			name:         "origin from another site",
+			verifyOrigin: true,
+			event:        PicolyticsEvent{Domain: "example.com", Origin: "https://example.org"},
+			wantErr:      errOriginMismatch,
+		},
+		{
+			name:         "missing origin",
+			verifyOrigin: true,
+			event:        PicolyticsEvent{Domain: "example.com"},
+			wantErr:      errOriginMismatch,
+		},
+		{
+			name:         "pixel without origin",
+			verifyOrigin: true,
+			event:        PicolyticsEvent{Domain: "staging.example.com", pixel: true},
+			wantDomain:   "example.com",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{Sites: sites, VerifyOrigin: tt.verifyOrigin}
+			if tt.noSites {
+				config.Sites = nil
+			}
+			err := testSites(t, config).resolve(&tt.event)
+			if tt.wantErr != nil {
+				assert.True(t, errors.Is(err, tt.wantErr), "unexpected error: %v", err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantDomain, tt.event.Domain)
+		})
+	}
+}
@@ -0,0 +1,415 @@
+package picolytics
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Spool is an optional write-ahead log for queued events.
+//
+// Events are appended to checksummed segment files by the AsyncEventSaver, and
+// fed to the Worker queue in order. The Worker acknowledges each saved batch,
+// which persists a checkpoint and removes fully-saved segments. Anything after
+// the checkpoint is replayed at startup, so queued events survive restarts and
+// database outages.
+//
+// Events are enriched before they're written, so the client IP and user agent
+// are never written to disk.
+type Spool struct {
+	dir             string
+	maxBytes        int64
+	segmentMaxBytes int64
+	o11y            *PicolyticsO11y
+	prepare         func(PicolyticsEvent) PicolyticsEvent // enriches the event and strips the client IP and user agent
+
+	lock       sync.Mutex
+	writer     *os.File
+	writeSeq   uint64
+	writeSize  int64
+	totalBytes int64
+	replaySeq  uint64 // segments before this existed at startup
+	notify     chan struct{}
+	done       chan struct{}
+	closeOnce  sync.Once
+}
+
+type spoolPosition struct {
+	seq    uint64
+	offset int64
+}
+
+const (
+	spoolSegmentExt       = ".seg"
+	spoolCheckpointFile   = "checkpoint"
+	spoolDeadLetterFile   = "deadletter.ndjson"
+	spoolRecordHeaderSize = 8 // 4 byte length + 4 byte crc32c
+	spoolRecordMaxSize    = 1024 * 1024
+	spoolSyncInterval     = time.Second
+)
+
+var spoolCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+var errSpoolFull = errors.New("event spool full")
+
+func NewSpool(dir string, maxBytes, segmentMaxBytes int64, o11y *PicolyticsO11y) (*Spool, error) {
+	s := Spool{
+		dir:             dir,
+		maxBytes:        maxBytes,
+		segmentMaxBytes: segmentMaxBytes,
+		o11y:            o11y,
+		notify:          make(chan struct{}, 1),
+		done:            make(chan struct{}),
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("error creating spool dir: %v", err)
+	}
+	segments, err := s.segments()
+	if err != nil {
+		return nil, err
+	}
+	for _, seq := range segments {
+		info, err := os.Stat(s.segmentPath(seq))
+		if err != nil {
+			return nil, fmt.Errorf("error reading spool segment: %v", err)
+		}
+		s.totalBytes += info.Size()
+	}
+	// always start a new segment, so segments from a previous run are immutable
+	s.replaySeq = 1
+	if len(segments) > 0 {
+		s.replaySeq = segments[len(segments)-1] + 1
+		o11y.Logger.Info("Replaying spooled events", "segments", len(segments), "bytes", s.totalBytes)
+	}
+	if err := s.openSegment(s.replaySeq); err != nil {
+		return nil, err
+	}
+	o11y.Metrics.spoolBytes.Set(float64(s.totalBytes))
+	return &s, nil
+}
+
+// append writes an event to the current segment, rotating segments as needed
+func (s *Spool) append(event PicolyticsEvent) error {
+	if s.prepare != nil {
+		event = s.prepare(event)
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("error encoding spool record: %v", err)
+	}
+	if len(payload) > spoolRecordMaxSize {
+		return fmt.Errorf("spool record too large: %d bytes", len(payload))
+	}
+	record := make([]byte, spoolRecordHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(record[4:8], crc32.Checksum(payload, spoolCRCTable))
+	copy(record[spoolRecordHeaderSize:], payload)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.totalBytes+int64(len(record)) > s.maxBytes {
+		return errSpoolFull
+	}
+	if s.writeSize > 0 && s.writeSize+int64(len(record)) > s.segmentMaxBytes {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	if _, err := s.writer.Write(record); err != nil {
+		_ = s.writer.Truncate(s.writeSize) // don't leave a partial record behind
+		return fmt.Errorf("error writing spool record: %v", err)
+	}
+	s.writeSize += int64(len(record))
+	s.totalBytes += int64(len(record))
+	s.o11y.Metrics.spoolBytes.Set(float64(s.totalBytes))
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// feed reads spooled events from the last checkpoint and sends them to the worker queue, until close is called
+func (s *Spool) feed(events chan<- PicolyticsEvent) {
+	pos, err := s.readCheckpoint()
+	if err != nil {
+		s.o11y.Logger.Error("error reading spool checkpoint, replaying all segments", "error", err)
+	}
+	ticker := time.NewTicker(spoolSyncInterval)
+	defer ticker.Stop()
+	var f *os.File
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+	}()
+
+	for {
+		if f == nil {
+			if pos, err = s.nextSegment(pos); err != nil {
+				s.o11y.Logger.Error("error finding spool segment", "error", err)
+			} else if f, err = os.Open(s.segmentPath(pos.seq)); err != nil {
+				s.o11y.Logger.Error("error opening spool segment", "error", err)
+				f = nil
+			}
+		}
+		if f != nil {
+			event, next, done, err := s.readRecord(f, pos)
+			if err != nil && !errors.Is(err, io.EOF) {
+				s.o11y.Metrics.eventErrors.WithLabelValues("spool_corrupt").Add(1)
+				s.o11y.Logger.Error("corrupt spool segment, skipping remainder", "segment", pos.seq, "offset", pos.offset, "error", err)
+			}
+			if done { // move on to the next segment
+				f.Close()
+				f = nil
+				pos = spoolPosition{seq: pos.seq + 1}
+				continue
+			}
+			if err == nil {
+				event.spoolPos = next
+				if pos.seq < s.replaySeq {
+					s.o11y.Metrics.spoolReplayedEvents.Inc()
+				}
+				select {
+				case events <- event:
+					pos = next
+					continue
+				case <-s.done:
+					return
+				}
+			}
+		}
+
+		select {
+		case <-s.notify:
+		case <-ticker.C:
+			s.sync()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// readRecord reads the record at pos, returning the position of the following record.
+// done is true when the segment has no more records to read.
+func (s *Spool) readRecord(f *os.File, pos spoolPosition) (event PicolyticsEvent, next spoolPosition, done bool, err error) {
+	s.lock.Lock() // records are written whole while holding the lock
+	defer s.lock.Unlock()
+	current := pos.seq == s.writeSeq
+	defer func() {
+		if err != nil && !errors.Is(err, io.EOF) && current {
+			// stop writing after a corrupt record, so the reader can skip past it
+			if rotateErr := s.rotate(); rotateErr != nil {
+				s.o11y.Logger.Error("error rotating spool segment", "error", rotateErr)
+			}
+		}
+	}()
+
+	header := make([]byte, spoolRecordHeaderSize)
+	n, err := f.ReadAt(header, pos.offset)
+	if err != nil {
+		if errors.Is(err, io.EOF) && n == 0 {
+			return event, pos, !current, err
+		}
+		return event, pos, true, fmt.Errorf("truncated record header: %v", err)
+	}
+	size := binary.LittleEndian.Uint32(header[0:4])
+	if size > spoolRecordMaxSize {
+		return event, pos, true, fmt.Errorf("invalid record size: %d", size)
+	}
+	payload := make([]byte, size)
+	if _, err := f.ReadAt(payload, pos.offset+spoolRecordHeaderSize); err != nil {
+		return event, pos, true, fmt.Errorf("truncated record: %v", err)
+	}
+	if crc32.Checksum(payload, spoolCRCTable) != binary.LittleEndian.Uint32(header[4:8]) {
+		return event, pos, true, fmt.Errorf("checksum mismatch")
+	}
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return event, pos, true, fmt.Errorf("error decoding record: %v", err)
+	}
+	return event, spoolPosition{seq: pos.seq, offset: pos.offset + spoolRecordHeaderSize + int64(size)}, false, nil
+}
+
+// ack records that every event up to pos has been saved, and removes fully-saved segments
+func (s *Spool) ack(pos spoolPosition) error {
+	if err := s.writeCheckpoint(pos); err != nil {
+		return err
+	}
+	segments, err := s.segments()
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, seq := range segments {
+		if seq >= pos.seq || seq >= s.writeSeq {
+			break
+		}
+		path := s.segmentPath(seq)
+		info, err := os.Stat(path)
+		if err != nil {
+			return fmt.Errorf("error reading spool segment: %v", err)
+		}
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("error removing spool segment: %v", err)
+		}
+		s.totalBytes -= info.Size()
+	}
+	s.o11y.Metrics.spoolBytes.Set(float64(s.totalBytes))
+	return nil
+}
+
+// deadLetter appends events that can't be saved to the dead letter file, one JSON
+// object per line with the error that rejected them, so they can be inspected and
+// re-sent. The caller acknowledges them.
+func (s *Spool) deadLetter(events []PicolyticsEvent, cause error) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, e := range events {
+		if err := enc.Encode(struct {
+			Error string          `json:"error"`
+			Event PicolyticsEvent `json:"event"`
+		}{cause.Error(), e}); err != nil {
+			return fmt.Errorf("error encoding dead letter record: %v", err)
+		}
+	}
+	f, err := os.OpenFile(filepath.Join(s.dir, spoolDeadLetterFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("error opening dead letter file: %v", err)
+	}
+	defer f.Close()
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("error writing dead letter file: %v", err)
+	}
+	return f.Sync()
+}
+
+func (s *Spool) sync() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.writer.Sync(); err != nil {
+		s.o11y.Logger.Warn("error syncing spool segment", "error", err)
+	}
+}
+
+// close stops feeding events and closes the current segment
+func (s *Spool) close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		_ = s.writer.Sync()
+		_ = s.writer.Close()
+	})
+}
+
+// rotate closes the current segment and starts a new one; must be called with the lock held
+func (s *Spool) rotate() error {
+	if err := s.writer.Sync(); err != nil {
+		return fmt.Errorf("error syncing spool segment: %v", err)
+	}
+	if err := s.writer.Close(); err != nil {
+		return fmt.Errorf("error closing spool segment: %v", err)
+	}
+	return s.openSegment(s.writeSeq + 1)
+}
+
+// must be called with the lock held, or before the spool is shared
+func (s *Spool) openSegment(seq uint64) error {
+	f, err := os.OpenFile(s.segmentPath(seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("error opening spool segment: %v", err)
+	}
+	s.writer = f
+	s.writeSeq = seq
+	s.writeSize = 0
+	return nil
+}
+
+// nextSegment returns pos if its segment exists, or the start of the next existing segment
+func (s *Spool) nextSegment(pos spoolPosition) (spoolPosition, error) {
+	segments, err := s.segments()
+	if err != nil {
+		return pos, err
+	}
+	for _, seq := range segments {
+		if seq == pos.seq {
+			return pos, nil
+		}
+		if seq > pos.seq {
+			return spoolPosition{seq: seq}, nil
+		}
+	}
+	return pos, fmt.Errorf("no spool segment at or after %d", pos.seq)
+}
+
+// segments returns the sequence numbers of all segment files, in order
+func (s *Spool) segments() ([]uint64, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading spool dir: %v", err)
+	}
+	segments := []uint64{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, spoolSegmentExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, spoolSegmentExt), 16, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, seq)
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	return segments, nil
+}
+
+func (s *Spool) segmentPath(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%016x%s", seq, spoolSegmentExt))
+}
+
+func (s *Spool) readCheckpoint() (spoolPosition, error) {
+	pos := spoolPosition{}
+	data, err := os.ReadFile(filepath.Join(s.dir, spoolCheckpointFile))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return pos, nil
+		}
+		return pos, err
+	}
+	if len(data) != 20 || crc32.Checksum(data[:16], spoolCRCTable) != binary.LittleEndian.Uint32(data[16:]) {
+		return pos, fmt.Errorf("invalid checkpoint")
+	}
+	pos.seq = binary.LittleEndian.Uint64(data[0:8])
+	pos.offset = int64(binary.LittleEndian.Uint64(data[8:16]))
+	return pos, nil
+}
+
+// writeCheckpoint atomically replaces the checkpoint file
+func (s *Spool) writeCheckpoint(pos spoolPosition) error {
+	data := make([]byte, 20)
+	binary.LittleEndian.PutUint64(data[0:8], pos.seq)
+	binary.LittleEndian.PutUint64(data[8:16], uint64(pos.offset))
+	binary.LittleEndian.PutUint32(data[16:20], crc32.Checksum(data[:16], spoolCRCTable))
+	tmp := filepath.Join(s.dir, spoolCheckpointFile+".tmp")
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("error writing spool checkpoint: %v", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(s.dir, spoolCheckpointFile)); err != nil {
+		return fmt.Errorf("error writing spool checkpoint: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package picolytics
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestSpool(t *testing.T, dir string, maxBytes, segmentMaxBytes int64) *Spool {
+	o11yMock := &PicolyticsO11y{
+		Logger:  slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError})),
+		Metrics: setupMetrics(1, "", "", ""),
+	}
+	s, err := NewSpool(dir, maxBytes, segmentMaxBytes, o11yMock)
+	if err != nil {
+		t.Fatalf("NewSpool returned an error: %v", err)
+	}
+	return s
+}
+
+func readSpooled(t *testing.T, events chan PicolyticsEvent, count int) []PicolyticsEvent {
+	got := []PicolyticsEvent{}
+	for i := 0; i < count; i++ {
+		select {
+		case e := <-events:
+			got = append(got, e)
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for spooled event %d", i)
+		}
+	}
+	return got
+}
+
+func TestSpoolAppendFeedAck(t *testing.T) {
+	dir := t.TempDir()
+	s := newTestSpool(t, dir, 1024*1024, 256) // small segments to force rotation
+	events := make(chan PicolyticsEvent, 10)
+	go s.feed(events)
+	defer s.close()
+
+	for _, path := range []string{"/one", "/two", "/three", "/four"} {
+		assert.NoError(t, s.append(PicolyticsEvent{Name: "load", Path: path, ClientIpDONOTSTORE: "8.8.8.8"}))
+	}
+	got := readSpooled(t, events, 4)
+	for i, path := range []string{"/one", "/two", "/three", "/four"} {
+		assert.Equal(t, path, got[i].Path)
+		assert.Equal(t, "8.8.8.8", got[i].ClientIpDONOTSTORE)
+	}
+	segments, err := s.segments()
+	assert.NoError(t, err)
+	assert.Greater(t, len(segments), 1, "expected segment rotation")
+
+	assert.NoError(t, s.ack(got[3].spoolPos))
+	remaining, err := s.segments()
+	assert.NoError(t, err)
+	assert.Equal(t, segments[len(segments)-1], remaining[0], "expected acknowledged segments to be removed")
+	assert.Equal(t, float64(s.totalBytes), getGaugeValue(s.o11y.Metrics.spoolBytes))
+}
+
+func TestSpoolReplay(t *testing.T) {
+	dir := t.TempDir()
+	s := newTestSpool(t, dir, 1024*1024, 1024*1024)
+	events := make(chan PicolyticsEvent, 10)
+	go s.feed(events)
+	for _, path := range []string{"/one", "/two", "/three"} {
+		assert.NoError(t, s.append(PicolyticsEvent{Name: "load", Path: path}))
+	}
+	got := readSpooled(t, events, 3)
+	assert.NoError(t, s.ack(got[0].spoolPos)) // only the first event was saved
+	s.close()
+
+	restarted := newTestSpool(t, dir, 1024*1024, 1024*1024)
+	replayed := make(chan PicolyticsEvent, 10)
+	go restarted.feed(replayed)
+	defer restarted.close()
+	got = readSpooled(t, replayed, 2)
+	assert.Equal(t, "/two", got[0].Path)
+	assert.Equal(t, "/three", got[1].Path)
+	assert.Equal(t, float64(2), getCounterValue(restarted.o11y.Metrics.spoolReplayedEvents))
+
+	// new events follow the replayed ones
+	assert.NoError(t, restarted.append(PicolyticsEvent{Name: "load", Path: "/four"}))
+	got = readSpooled(t, replayed, 1)
+	assert.Equal(t, "/four", got[0].Path)
+}
+
+func TestSpoolCorruptSegment(t *testing.T) {
+	dir := t.TempDir()
+	s := newTestSpool(t, dir, 1024*1024, 1024*1024)
+	assert.NoError(t, s.append(PicolyticsEvent{Name: "load", Path: "/one"}))
+	assert.NoError(t, s.append(PicolyticsEvent{Name: "load", Path: "/two"}))
+	s.close()
+
+	// flip a byte in the second record's payload
+	path := s.segmentPath(1)
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	data[len(data)-2] ^= 0xff
+	assert.NoError(t, os.WriteFile(path, data, 0600))
+
+	restarted := newTestSpool(t, dir, 1024*1024, 1024*1024)
+	events := make(chan PicolyticsEvent, 10)
+	go restarted.feed(events)
+	defer restarted.close()
+	assert.NoError(t, restarted.append(PicolyticsEvent{Name: "load", Path: "/three"}))
+
+	got := readSpooled(t, events, 2)
+	assert.Equal(t, "/one", got[0].Path)
+	assert.Equal(t, "/three", got[1].Path)
+	m, err := restarted.o11y.Metrics.eventErrors.GetMetricWithLabelValues("spool_corrupt")
+	assert.NoError(t, err)
+	assert.Equal(t, float64(1), getCounterValue(m))
+}
+
+func TestSpoolFull(t *testing.T) {
+	payload, err := json.Marshal(PicolyticsEvent{Name: "load"})
+	assert.NoError(t, err)
+	recordSize := int64(spoolRecordHeaderSize + len(payload))
+	s := newTestSpool(t, t.TempDir(), recordSize*3/2, recordSize*3/2)
+	defer s.close()
+	assert.NoError(t, s.append(PicolyticsEvent{Name: "load"}))
+	assert.Equal(t, errSpoolFull, s.append(PicolyticsEvent{Name: "load"}))
+}
+
+func TestSpoolPreparesEvents(t *testing.T) {
+	o11yMock := &PicolyticsO11y{
+		Logger:  slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError})),
+		Metrics: setupMetrics(1, "", "", ""),
+	}
+	dir := t.TempDir()
+	w, err := NewWorker(&Config{
+		GeoIPFile:         "../etc/geoip-city-test.mmdb",
+		QueueSize:         10,
+		SpoolDir:          dir,
+		SpoolMaxBytes:     1024 * 1024,
+		SpoolSegmentBytes: 1024 * 1024,
+	}, nil, o11yMock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.geo.Close()
+	defer w.spool.close()
+	go w.spool.feed(w.events)
+
+	ua := "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36"
+	assert.NoError(t, w.spool.append(PicolyticsEvent{Name: "load", Path: "/one", ClientIpDONOTSTORE: "1.0.1.1", UaDONOTSTORE: ua}))
+	got := readSpooled(t, w.events, 1)
+	assert.Equal(t, "CN", got[0].Country)
+	assert.Equal(t, "Chrome", got[0].Browser)
+	assert.Empty(t, got[0].ClientIpDONOTSTORE)
+	assert.Empty(t, got[0].UaDONOTSTORE)
+	assert.Equal(t, got[0], w.queuedEvent(got[0]), "spooled events are only prepared once")
+
+	data, err := os.ReadFile(w.spool.segmentPath(1))
+	assert.NoError(t, err)
+	assert.NotContains(t, string(data), "1.0.1.1")
+	assert.NotContains(t, string(data), "Mozilla")
+}
@@ -0,0 +1,388 @@
+package picolytics
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/nmcclain/picolytics/picolytics/db"
+)
+
+// StatsAPI serves read-only aggregate stats as JSON. It's registered on the admin server,
+// which should not be exposed to the internet.
+type StatsAPI struct {
+	client *db.Queries
+	o11y   *PicolyticsO11y
+}
+
+func NewStatsAPI(pool PgxIface, o11y *PicolyticsO11y) *StatsAPI {
+	return &StatsAPI{
+		client: db.New(pool),
+		o11y:   o11y,
+	}
+}
+
+const (
+	statsDefaultDays  = 30
+	statsDefaultLimit = 10
+	statsMaxLimit     = 1000
+)
+
+// session columns available via StatsSessionBreakdown, by URL path
+var statsBreakdownFields = map[string]string{
+	"countries": "country",
+	"browsers":  "browser",
+	"os":        "os",
+	"devices":   "device_type",
+	"entries":   "entry_path",
+	"exits":     "exit_path",
+}
+
+var statsUtmParams = map[string]bool{"source": true, "medium": true, "campaign": true, "content": true, "term": true}
+
+// StatsConversions fields, by URL path
+var statsConversionFields = map[string]string{
+	"countries":    "country",
+	"referrers":    "referrer",
+	"utm_source":   "utm_source",
+	"utm_medium":   "utm_medium",
+	"utm_campaign": "utm_campaign",
+	"utm_content":  "utm_content",
+	"utm_term":     "utm_term",
+}
+
+func (s *StatsAPI) register(g *echo.Group) {
+	g.GET("/summary", s.summary)
+	g.GET("/paths", s.topPaths)
+	g.GET("/referrers", s.topReferrers)
+	g.GET("/scroll", s.scrollDepth)
+	for path, field := range statsBreakdownFields {
+		g.GET("/"+path, s.breakdown(field))
+	}
+	g.GET("/utm/:param", s.utm)
+	g.GET("/goals", s.goals)
+	g.GET("/goals/:goal/:field", s.conversions)
+}
+
+type statsFilter struct {
+	domain      string
+	from, to    time.Time
+	includeBots bool
+	limit       int32
+}
+
+type statsResponse struct {
+	Domain  string      `json:"domain"`
+	From    time.Time   `json:"from"`
+	To      time.Time   `json:"to"`
+	Results interface{} `json:"results"`
+}
+
+type statsSummary struct {
+	Visitors    int64   `json:"visitors"`
+	Sessions    int64   `json:"sessions"`
+	Pageviews   int64   `json:"pageviews"`
+	BounceRate  float64 `json:"bounce_rate"`
+	AvgDuration float64 `json:"avg_duration"`
+}
+
+type statsPath struct {
+	Path      string `json:"path"`
+	Pageviews int64  `json:"pageviews"`
+	Visitors  int64  `json:"visitors"`
+}
+
+type statsReferrer struct {
+	Referrer string `json:"referrer"`
+	Sessions int64  `json:"sessions"`
+	Visitors int64  `json:"visitors"`
+}
+
+// statsScrollDepth has the average scroll depth of a path's pageviews, and how many
+// reached each quarter of the page
+type statsScrollDepth struct {
+	Path       string  `json:"path"`
+	Pageviews  int64   `json:"pageviews"`
+	AvgDepth   float64 `json:"avg_depth"`
+	Reached25  int64   `json:"reached_25"`
+	Reached50  int64   `json:"reached_50"`
+	Reached75  int64   `json:"reached_75"`
+	Reached100 int64   `json:"reached_100"`
+}
+
+type statsGoal struct {
+	Goal           string  `json:"goal"`
+	Conversions    int64   `json:"conversions"`
+	Visitors       int64   `json:"visitors"`
+	ConversionRate float64 `json:"conversion_rate"`
+}
+
+type statsConversions struct {
+	Value          string  `json:"value"`
+	Sessions       int64   `json:"sessions"`
+	Conversions    int64   `json:"conversions"`
+	ConversionRate float64 `json:"conversion_rate"`
+}
+
+type statsBreakdown struct {
+	Value      string  `json:"value"`
+	Visitors   int64   `json:"visitors"`
+	Sessions   int64   `json:"sessions"`
+	BounceRate float64 `json:"bounce_rate"`
+}
+
+func (s *StatsAPI) summary(c echo.Context) error {
+	f, err := parseStatsFilter(c)
+	if err != nil {
+		return err
+	}
+	row, err := s.client.StatsSummary(c.Request().Context(), db.StatsSummaryParams{
+		Domain:      f.domain,
+		StartTime:   newPGTimestamptz(f.from),
+		EndTime:     newPGTimestamptz(f.to),
+		IncludeBots: f.includeBots,
+	})
+	if err != nil {
+		return s.queryError(err)
+	}
+	return f.respond(c, statsSummary{
+		Visitors:    row.Visitors,
+		Sessions:    row.Sessions,
+		Pageviews:   row.Pageviews,
+		BounceRate:  row.BounceRate,
+		AvgDuration: row.AvgDuration,
+	})
+}
+
+func (s *StatsAPI) topPaths(c echo.Context) error {
+	f, err := parseStatsFilter(c)
+	if err != nil {
+		return err
+	}
+	rows, err := s.client.StatsTopPaths(c.Request().Context(), db.StatsTopPathsParams{
+		Domain:      f.domain,
+		StartTime:   newPGTimestamptz(f.from),
+		EndTime:     newPGTimestamptz(f.to),
+		IncludeBots: f.includeBots,
+		RowLimit:    f.limit,
+	})
+	if err != nil {
+		return s.queryError(err)
+	}
+	results := []statsPath{}
+	for _, row := range rows {
+		results = append(results, statsPath{Path: row.Path, Pageviews: row.Pageviews, Visitors: row.Visitors})
+	}
+	return f.respond(c, results)
+}
+
+func (s *StatsAPI) topReferrers(c echo.Context) error {
+	f, err := parseStatsFilter(c)
+	if err != nil {
+		return err
+	}
+	rows, err := s.client.StatsTopReferrers(c.Request().Context(), db.StatsTopReferrersParams{
+		Domain:      f.domain,
+		StartTime:   newPGTimestamptz(f.from),
+		EndTime:     newPGTimestamptz(f.to),
+		IncludeBots: f.includeBots,
+		RowLimit:    f.limit,
+	})
+	if err != nil {
+		return s.queryError(err)
+	}
+	results := []statsReferrer{}
+	for _, row := range rows {
+		results = append(results, statsReferrer{Referrer: row.Referrer, Sessions: row.Sessions, Visitors: row.Visitors})
+	}
+	return f.respond(c, results)
+}
+
+func (s *StatsAPI) scrollDepth(c echo.Context) error {
+	f, err := parseStatsFilter(c)
+	if err != nil {
+		return err
+	}
+	rows, err := s.client.StatsScrollDepth(c.Request().Context(), db.StatsScrollDepthParams{
+		Domain:      f.domain,
+		StartTime:   newPGTimestamptz(f.from),
+		EndTime:     newPGTimestamptz(f.to),
+		IncludeBots: f.includeBots,
+		RowLimit:    f.limit,
+	})
+	if err != nil {
+		return s.queryError(err)
+	}
+	results := []statsScrollDepth{}
+	for _, row := range rows {
+		results = append(results, statsScrollDepth{
+			Path:       row.Path,
+			Pageviews:  row.Pageviews,
+			AvgDepth:   row.AvgDepth,
+			Reached25:  row.Reached25,
+			Reached50:  row.Reached50,
+			Reached75:  row.Reached75,
+			Reached100: row.Reached100,
+		})
+	}
+	return f.respond(c, results)
+}
+
+func (s *StatsAPI) breakdown(field string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		f, err := parseStatsFilter(c)
+		if err != nil {
+			return err
+		}
+		return s.sessionBreakdown(c, f, field)
+	}
+}
+
+func (s *StatsAPI) utm(c echo.Context) error {
+	param := c.Param("param")
+	if !statsUtmParams[param] {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("unknown utm parameter: %s", param))
+	}
+	f, err := parseStatsFilter(c)
+	if err != nil {
+		return err
+	}
+	return s.sessionBreakdown(c, f, "utm_"+param)
+}
+
+func (s *StatsAPI) sessionBreakdown(c echo.Context, f statsFilter, field string) error {
+	rows, err := s.client.StatsSessionBreakdown(c.Request().Context(), db.StatsSessionBreakdownParams{
+		Field:       field,
+		Domain:      f.domain,
+		StartTime:   newPGTimestamptz(f.from),
+		EndTime:     newPGTimestamptz(f.to),
+		IncludeBots: f.includeBots,
+		RowLimit:    f.limit,
+	})
+	if err != nil {
+		return s.queryError(err)
+	}
+	results := []statsBreakdown{}
+	for _, row := range rows {
+		results = append(results, statsBreakdown{Value: row.Value, Visitors: row.Visitors, Sessions: row.Sessions, BounceRate: row.BounceRate})
+	}
+	return f.respond(c, results)
+}
+
+func (s *StatsAPI) goals(c echo.Context) error {
+	f, err := parseStatsFilter(c)
+	if err != nil {
+		return err
+	}
+	rows, err := s.client.StatsGoals(c.Request().Context(), db.StatsGoalsParams{
+		Domain:      f.domain,
+		StartTime:   newPGTimestamptz(f.from),
+		EndTime:     newPGTimestamptz(f.to),
+		IncludeBots: f.includeBots,
+		RowLimit:    f.limit,
+	})
+	if err != nil {
+		return s.queryError(err)
+	}
+	results := []statsGoal{}
+	for _, row := range rows {
+		results = append(results, statsGoal{Goal: row.Goal, Conversions: row.Conversions, Visitors: row.Visitors, ConversionRate: row.ConversionRate})
+	}
+	return f.respond(c, results)
+}
+
+func (s *StatsAPI) conversions(c echo.Context) error {
+	field, ok := statsConversionFields[c.Param("field")]
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("unknown conversion breakdown: %s", c.Param("field")))
+	}
+	goal, err := url.PathUnescape(c.Param("goal"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid goal: %s", c.Param("goal")))
+	}
+	f, err := parseStatsFilter(c)
+	if err != nil {
+		return err
+	}
+	rows, err := s.client.StatsConversions(c.Request().Context(), db.StatsConversionsParams{
+		Field:       field,
+		Goal:        goal,
+		Domain:      f.domain,
+		StartTime:   newPGTimestamptz(f.from),
+		EndTime:     newPGTimestamptz(f.to),
+		IncludeBots: f.includeBots,
+		RowLimit:    f.limit,
+	})
+	if err != nil {
+		return s.queryError(err)
+	}
+	results := []statsConversions{}
+	for _, row := range rows {
+		results = append(results, statsConversions{Value: row.Value, Sessions: row.Sessions, Conversions: row.Conversions, ConversionRate: row.ConversionRate})
+	}
+	return f.respond(c, results)
+}
+
+func (s *StatsAPI) queryError(err error) error {
+	s.o11y.Logger.Error("stats query error", "error", err)
+	return echo.NewHTTPError(http.StatusInternalServerError, "Stats query failed")
+}
+
+func (f statsFilter) respond(c echo.Context, results interface{}) error {
+	return c.JSON(http.StatusOK, statsResponse{
+		Domain:  f.domain,
+		From:    f.from,
+		To:      f.to,
+		Results: results,
+	})
+}
+
+// parseStatsFilter reads the domain, from, to, bots, and limit query parameters.
+// The time range defaults to the last 30 days.
+func parseStatsFilter(c echo.Context) (statsFilter, error) {
+	f := statsFilter{
+		domain: c.QueryParam("domain"),
+		to:     time.Now().UTC(),
+		limit:  statsDefaultLimit,
+	}
+	var err error
+	if to := c.QueryParam("to"); len(to) > 0 {
+		if f.to, err = parseStatsTime(to); err != nil {
+			return f, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid to: %v", err))
+		}
+	}
+	f.from = f.to.AddDate(0, 0, -statsDefaultDays)
+	if from := c.QueryParam("from"); len(from) > 0 {
+		if f.from, err = parseStatsTime(from); err != nil {
+			return f, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid from: %v", err))
+		}
+	}
+	if !f.from.Before(f.to) {
+		return f, echo.NewHTTPError(http.StatusBadRequest, "from must be before to")
+	}
+	if bots := c.QueryParam("bots"); len(bots) > 0 {
+		if f.includeBots, err = strconv.ParseBool(bots); err != nil {
+			return f, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid bots: %s", bots))
+		}
+	}
+	if limit := c.QueryParam("limit"); len(limit) > 0 {
+		l, err := strconv.Atoi(limit)
+		if err != nil || l < 1 || l > statsMaxLimit {
+			return f, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", statsMaxLimit))
+		}
+		f.limit = int32(l)
+	}
+	return f, nil
+}
+
+// parseStatsTime accepts RFC3339 timestamps or dates, which are UTC midnight
+func parseStatsTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", value)
+}
@@ -0,0 +1,263 @@
+package picolytics
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pashagolub/pgxmock/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseStatsFilter(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		want    statsFilter
+		wantErr bool
+	}{
+		{
+			name:  "explicit range",
+			query: "domain=example.com&from=2024-01-01&to=2024-02-01T12:00:00Z&bots=true&limit=25",
+			want: statsFilter{
+				domain:      "example.com",
+				from:        time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+				to:          time.Date(2024, 2, 1, 12, 0, 0, 0, time.UTC),
+				includeBots: true,
+				limit:       25,
+			},
+		},
+		{
+			name:  "default from",
+			query: "to=2024-02-01",
+			want: statsFilter{
+				from:  time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC),
+				to:    time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC),
+				limit: statsDefaultLimit,
+			},
+		},
+		{
+			name:    "invalid from",
+			query:   "from=yesterday",
+			wantErr: true,
+		},
+		{
+			name:    "from after to",
+			query:   "from=2024-02-01&to=2024-01-01",
+			wantErr: true,
+		},
+		{
+			name:    "limit too large",
+			query:   "limit=1001",
+			wantErr: true,
+		},
+		{
+			name:    "invalid bots",
+			query:   "bots=maybe",
+			wantErr: true,
+		},
+	}
+
+	e := echo.New()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/stats/summary?"+tt.query, nil)
+			c := e.NewContext(req, httptest.NewRecorder())
+			got, err := parseStatsFilter(c)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestStatsAPI(t *testing.T) {
+	o11yMock := &PicolyticsO11y{
+		Logger:  slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError})),
+		Metrics: setupMetrics(1, "", "", ""),
+	}
+	tests := []struct {
+		name         string
+		path         string
+		getMock      func() pgxmock.PgxPoolIface
+		expectedCode int
+		expectedBody string
+	}{
+		{
+			name: "summary",
+			path: "/api/v1/stats/summary?domain=example.com&from=2024-01-01&to=2024-02-01",
+			getMock: func() pgxmock.PgxPoolIface {
+				mock, err := pgxmock.NewPool()
+				if err != nil {
+					t.Fatal(err)
+				}
+				mock.ExpectQuery("WITH filtered_sessions AS").
+					WithArgs("example.com", newPGTimestamptz(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)),
+						newPGTimestamptz(time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)), false).
+					WillReturnRows(mock.NewRows([]string{"visitors", "sessions", "pageviews", "bounce_rate", "avg_duration"}).
+						AddRow(int64(10), int64(12), int64(30), 0.5, 42.0))
+				return mock
+			},
+			expectedCode: http.StatusOK,
+			expectedBody: `{"domain":"example.com","from":"2024-01-01T00:00:00Z","to":"2024-02-01T00:00:00Z",` +
+				`"results":{"visitors":10,"sessions":12,"pageviews":30,"bounce_rate":0.5,"avg_duration":42}}`,
+		},
+		{
+			name: "utm breakdown",
+			path: "/api/v1/stats/utm/source?from=2024-01-01&to=2024-02-01&limit=5",
+			getMock: func() pgxmock.PgxPoolIface {
+				mock, err := pgxmock.NewPool()
+				if err != nil {
+					t.Fatal(err)
+				}
+				mock.ExpectQuery("SELECT COALESCE.CASE").
+					WithArgs("utm_source", "", newPGTimestamptz(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)),
+						newPGTimestamptz(time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)), false, int32(5)).
+					WillReturnRows(mock.NewRows([]string{"value", "visitors", "sessions", "bounce_rate"}).
+						AddRow("newsletter", int64(3), int64(4), 0.25))
+				return mock
+			},
+			expectedCode: http.StatusOK,
+			expectedBody: `{"domain":"","from":"2024-01-01T00:00:00Z","to":"2024-02-01T00:00:00Z",` +
+				`"results":[{"value":"newsletter","visitors":3,"sessions":4,"bounce_rate":0.25}]}`,
+		},
+		{
+			name: "empty top paths",
+			path: "/api/v1/stats/paths?from=2024-01-01&to=2024-02-01",
+			getMock: func() pgxmock.PgxPoolIface {
+				mock, err := pgxmock.NewPool()
+				if err != nil {
+					t.Fatal(err)
+				}
+				mock.ExpectQuery("SELECT events.path").
+					WithArgs(anyArgs(5)...).
+					WillReturnRows(mock.NewRows([]string{"path", "pageviews", "visitors"}))
+				return mock
+			},
+			expectedCode: http.StatusOK,
+			expectedBody: `{"domain":"","from":"2024-01-01T00:00:00Z","to":"2024-02-01T00:00:00Z","results":[]}`,
+		},
+		{
+			name: "scroll depth",
+			path: "/api/v1/stats/scroll?domain=example.com&from=2024-01-01&to=2024-02-01",
+			getMock: func() pgxmock.PgxPoolIface {
+				mock, err := pgxmock.NewPool()
+				if err != nil {
+					t.Fatal(err)
+				}
+				mock.ExpectQuery("WHERE events.scroll_depth IS NOT NULL").
+					WithArgs("example.com", newPGTimestamptz(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)),
+						newPGTimestamptz(time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)), false, int32(statsDefaultLimit)).
+					WillReturnRows(mock.NewRows([]string{"path", "pageviews", "avg_depth", "reached_25", "reached_50", "reached_75", "reached_100"}).
+						AddRow("/blog/post", int64(8), 62.5, int64(8), int64(6), int64(3), int64(1)))
+				return mock
+			},
+			expectedCode: http.StatusOK,
+			expectedBody: `{"domain":"example.com","from":"2024-01-01T00:00:00Z","to":"2024-02-01T00:00:00Z",` +
+				`"results":[{"path":"/blog/post","pageviews":8,"avg_depth":62.5,"reached_25":8,"reached_50":6,"reached_75":3,"reached_100":1}]}`,
+		},
+		{
+			name: "goals",
+			path: "/api/v1/stats/goals?from=2024-01-01&to=2024-02-01",
+			getMock: func() pgxmock.PgxPoolIface {
+				mock, err := pgxmock.NewPool()
+				if err != nil {
+					t.Fatal(err)
+				}
+				mock.ExpectQuery("unnest.filtered_sessions.converted_goals.").
+					WithArgs("", newPGTimestamptz(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)),
+						newPGTimestamptz(time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)), false, int32(statsDefaultLimit)).
+					WillReturnRows(mock.NewRows([]string{"goal", "conversions", "visitors", "conversion_rate"}).
+						AddRow("signup", int64(5), int64(4), 0.125))
+				return mock
+			},
+			expectedCode: http.StatusOK,
+			expectedBody: `{"domain":"","from":"2024-01-01T00:00:00Z","to":"2024-02-01T00:00:00Z",` +
+				`"results":[{"goal":"signup","conversions":5,"visitors":4,"conversion_rate":0.125}]}`,
+		},
+		{
+			name: "conversions by referrer",
+			path: "/api/v1/stats/goals/free%20trial/referrers?domain=example.com&from=2024-01-01&to=2024-02-01",
+			getMock: func() pgxmock.PgxPoolIface {
+				mock, err := pgxmock.NewPool()
+				if err != nil {
+					t.Fatal(err)
+				}
+				mock.ExpectQuery("ANY.sessions.converted_goals.").
+					WithArgs("referrer", "free trial", "example.com", newPGTimestamptz(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)),
+						newPGTimestamptz(time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)), false, int32(statsDefaultLimit)).
+					WillReturnRows(mock.NewRows([]string{"value", "sessions", "conversions", "conversion_rate"}).
+						AddRow("news.ycombinator.com", int64(20), int64(5), 0.25))
+				return mock
+			},
+			expectedCode: http.StatusOK,
+			expectedBody: `{"domain":"example.com","from":"2024-01-01T00:00:00Z","to":"2024-02-01T00:00:00Z",` +
+				`"results":[{"value":"news.ycombinator.com","sessions":20,"conversions":5,"conversion_rate":0.25}]}`,
+		},
+		{
+			name: "unknown conversion breakdown",
+			path: "/api/v1/stats/goals/signup/browsers",
+			getMock: func() pgxmock.PgxPoolIface {
+				mock, err := pgxmock.NewPool()
+				if err != nil {
+					t.Fatal(err)
+				}
+				return mock
+			},
+			expectedCode: http.StatusNotFound,
+		},
+		{
+			name: "unknown utm parameter",
+			path: "/api/v1/stats/utm/nope",
+			getMock: func() pgxmock.PgxPoolIface {
+				mock, err := pgxmock.NewPool()
+				if err != nil {
+					t.Fatal(err)
+				}
+				return mock
+			},
+			expectedCode: http.StatusNotFound,
+		},
+		{
+			name: "db failure",
+			path: "/api/v1/stats/referrers",
+			getMock: func() pgxmock.PgxPoolIface {
+				mock, err := pgxmock.NewPool()
+				if err != nil {
+					t.Fatal(err)
+				}
+				mock.ExpectQuery("SELECT events.referrer").
+					WithArgs(anyArgs(5)...).
+					WillReturnError(os.ErrDeadlineExceeded)
+				return mock
+			},
+			expectedCode: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := tt.getMock()
+			defer mock.Close()
+			e := echo.New()
+			NewStatsAPI(mock, o11yMock).register(e.Group("/api/v1/stats"))
+
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			assert.Equal(t, tt.expectedCode, rec.Code)
+			if len(tt.expectedBody) > 0 {
+				assert.JSONEq(t, tt.expectedBody, rec.Body.String())
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package picolytics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+	"golang.org/x/crypto/acme/autocert"
+
+	"github.com/nmcclain/picolytics/picolytics/db"
+)
+
+// EventStore is a storage backend for events and sessions. The Worker saves batches
+// of enriched events to it, the Pruner prunes it, and visitor IDs are hashed with its salt.
+type EventStore interface {
+	Salter
+	// SaveEvents resolves each visitor's session, extending a session active within the
+	// site's session timeout or starting a new one, then saves the batch of events.
+	SaveEvents(ctx context.Context, events []PicolyticsEvent) error
+	// Prune deletes events and sessions older than pruneDays, and any rollups older than
+	// rollupPruneDays. Zero days keeps data forever. It's called every pruneCheckHours,
+	// so stores can do other maintenance too.
+	Prune(ctx context.Context, pruneDays, rollupPruneDays int) error
+	Close()
+}
+
+var storageBackends = map[string]bool{"postgres": true, "sqlite": true, "memory": true}
+
+// NewEventStore returns the storage backend selected by config. The pool is only used by
+// the postgres backend, which connects and runs migrations if it's nil.
+func NewEventStore(config *Config, pool PgxIface, sites *Sites, o11y *PicolyticsO11y) (EventStore, error) {
+	switch config.Storage {
+	case "memory":
+		return NewMemoryStore(sites), nil
+	case "sqlite":
+		return NewSQLiteStore(config.SqlitePath, sites, o11y)
+	case "postgres":
+		if pool == nil {
+			var err error
+			pool, err = setupDB(config, o11y)
+			if err != nil {
+				return nil, fmt.Errorf("db setup error: %v", err)
+			}
+		}
+		store := NewPostgresStore(pool, sites)
+		store.skipEvents = config.ClickhouseEventsOnly
+		if len(config.PartitionInterval) > 0 {
+			store.partitioner = NewPartitioner(pool, config.PartitionInterval, o11y)
+			store.maxSessionLength = partitionedSessionMaxLength
+			if err := store.partitioner.setup(context.Background()); err != nil {
+				return nil, fmt.Errorf("partitioning error: %v", err)
+			}
+		}
+		return store, nil
+	}
+	return nil, fmt.Errorf("invalid storage: %s", config.Storage)
+}
+
+// PostgresStore is the default storage backend.
+type PostgresStore struct {
+	*DailySalt
+	pool        PgxIface
+	sites       *Sites
+	skipEvents  bool         // only domains and sessions are saved, when events go to ClickHouse
+	partitioner *Partitioner // nil unless events and sessions are partitioned
+	// sessions aren't extended past this, so their lookup can skip older partitions
+	maxSessionLength time.Duration
+}
+
+func NewPostgresStore(pool PgxIface, sites *Sites) *PostgresStore {
+	return &PostgresStore{
+		DailySalt: NewDailySalt(pool),
+		pool:      pool,
+		sites:     sites,
+	}
+}
+
+func (s *PostgresStore) SaveEvents(ctx context.Context, events []PicolyticsEvent) error {
+	client := db.New(s.pool)
+	eventDomains, err := upsertDomains(ctx, client, events)
+	if err != nil {
+		return err
+	}
+
+	eventSessions, err := upsertSessions(ctx, client, events, eventDomains, s.sites, s.maxSessionLength)
+	if err != nil {
+		return err
+	}
+
+	if err := upsertJSErrors(ctx, client, events, eventDomains); err != nil {
+		return err
+	}
+
+	if s.skipEvents {
+		return nil
+	}
+	return createEvents(ctx, client, events, eventDomains, eventSessions)
+}
+
+const microsecondsPerDay = 24 * 60 * 60 * 1000000
+
+func (s *PostgresStore) Prune(ctx context.Context, pruneDays, rollupPruneDays int) error {
+	client := db.New(s.pool)
+	var errs []error
+	if s.partitioner != nil {
+		if err := s.partitioner.prune(ctx, pruneDays, time.Now()); err != nil {
+			errs = append(errs, err)
+		}
+	} else if pruneDays > 0 {
+		if err := client.PruneEvents(ctx, pgtype.Interval{Microseconds: int64(pruneDays * microsecondsPerDay)}); err != nil {
+			errs = append(errs, fmt.Errorf("prune events error: %v", err))
+		}
+		if err := client.PruneSessions(ctx, pgtype.Interval{Microseconds: int64(pruneDays * microsecondsPerDay)}); err != nil {
+			errs = append(errs, fmt.Errorf("prune sessions error: %v", err))
+		}
+	}
+	if pruneDays > 0 {
+		if err := client.PruneJSErrors(ctx, pgtype.Interval{Microseconds: int64(pruneDays * microsecondsPerDay)}); err != nil {
+			errs = append(errs, fmt.Errorf("prune js errors error: %v", err))
+		}
+	}
+	// rollups are pruned separately, so they can outlive the raw rows
+	if rollupPruneDays > 0 {
+		if err := client.PruneRollupHourlyPaths(ctx, pgtype.Interval{Microseconds: int64(rollupPruneDays * microsecondsPerDay)}); err != nil {
+			errs = append(errs, fmt.Errorf("prune rollups error: %v", err))
+		}
+		if err := client.PruneRollupDailySessions(ctx, pgtype.Interval{Microseconds: int64(rollupPruneDays * microsecondsPerDay)}); err != nil {
+			errs = append(errs, fmt.Errorf("prune rollups error: %v", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *PostgresStore) Close() {
+	s.pool.Close()
+}
+
+// autocertCache returns a certificate cache in the store, or nil if it has none
+func autocertCache(store EventStore) autocert.Cache {
+	switch s := store.(type) {
+	case *PostgresStore:
+		return NewPostgresCache(s.pool)
+	case *SQLiteStore:
+		return s
+	}
+	return nil
+}
+
+// pgPool returns the store's pool for the features that query postgres directly, or
+// nil if the store isn't postgres.
+func pgPool(store EventStore) PgxIface {
+	if s, ok := store.(*PostgresStore); ok {
+		return s.pool
+	}
+	return nil
+}
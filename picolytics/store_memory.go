@@ -0,0 +1,105 @@
+package picolytics
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// MemoryStore keeps events and sessions in memory, for demos and tests. Nothing
+// survives a restart, and memory use grows until pruned, so pruneDays is required.
+type MemoryStore struct {
+	sites       *Sites
+	lock        sync.Mutex
+	salt        string
+	saltCreated time.Time
+	nextID      int64
+	sessions    []*memorySession
+	latest      map[string]*memorySession // domain + visitorID -> visitor's latest session
+	events      []memoryEvent
+}
+
+type memorySession struct {
+	id        int64
+	domain    string
+	visitorID string
+	createdAt time.Time
+	updatedAt time.Time
+	events    int
+}
+
+type memoryEvent struct {
+	PicolyticsEvent
+	sessionID int64
+}
+
+func NewMemoryStore(sites *Sites) *MemoryStore {
+	return &MemoryStore{
+		sites:  sites,
+		latest: map[string]*memorySession{},
+	}
+}
+
+// getSalt rotates the salt daily, like DailySalt
+func (s *MemoryStore) getSalt() (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.saltCreated.Before(time.Now().Add(-24 * time.Hour)) {
+		s.salt = uuid.NewString()
+		s.saltCreated = time.Now()
+	}
+	return s.salt, nil
+}
+
+func (s *MemoryStore) SaveEvents(ctx context.Context, events []PicolyticsEvent) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, e := range events {
+		key := e.Domain + e.VisitorID
+		timeout := time.Duration(s.sites.sessionTimeoutMin(e.Domain)) * time.Minute
+		session, ok := s.latest[key]
+		if !ok || !session.updatedAt.After(e.Created.Add(-timeout)) {
+			s.nextID++
+			session = &memorySession{id: s.nextID, domain: e.Domain, visitorID: e.VisitorID, createdAt: e.Created}
+			s.sessions = append(s.sessions, session)
+			s.latest[key] = session
+		}
+		if e.Created.After(session.updatedAt) {
+			session.updatedAt = e.Created
+		}
+		session.events++
+		s.events = append(s.events, memoryEvent{PicolyticsEvent: e, sessionID: session.id})
+	}
+	return nil
+}
+
+// Prune has no rollups to prune
+func (s *MemoryStore) Prune(ctx context.Context, pruneDays, rollupPruneDays int) error {
+	if pruneDays < 1 {
+		return nil
+	}
+	cutoff := time.Now().AddDate(0, 0, -pruneDays)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	events := s.events[:0]
+	for _, e := range s.events {
+		if e.Created.After(cutoff) {
+			events = append(events, e)
+		}
+	}
+	s.events = events
+	sessions := s.sessions[:0]
+	for _, session := range s.sessions {
+		if session.updatedAt.After(cutoff) {
+			sessions = append(sessions, session)
+		} else if s.latest[session.domain+session.visitorID] == session {
+			delete(s.latest, session.domain+session.visitorID)
+		}
+	}
+	s.sessions = sessions
+	return nil
+}
+
+func (s *MemoryStore) Close() {}
@@ -0,0 +1,49 @@
+package picolytics
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryStore(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now().Truncate(time.Second)
+	store := NewMemoryStore(testSites(t, &Config{
+		SessionTimeoutMin: 30,
+		Sites:             []SiteConfig{{Domain: "example.com"}, {Domain: "app.example.com", SessionTimeoutMin: 120}},
+	}))
+
+	salt, err := store.getSalt()
+	assert.NoError(t, err)
+	assert.NotEmpty(t, salt)
+	again, _ := store.getSalt()
+	assert.Equal(t, salt, again)
+
+	events := []PicolyticsEvent{
+		{Name: "load", Domain: "example.com", VisitorID: "a", Created: now.Add(-100 * 24 * time.Hour)},
+		{Name: "load", Domain: "example.com", VisitorID: "a", Created: now.Add(-2 * time.Hour)},
+		{Name: "load", Domain: "example.com", VisitorID: "a", Created: now.Add(-100 * time.Minute)},
+		{Name: "load", Domain: "example.com", VisitorID: "a", Created: now.Add(-time.Hour)}, // timed out
+		{Name: "load", Domain: "app.example.com", VisitorID: "a", Created: now.Add(-2 * time.Hour)},
+		{Name: "load", Domain: "app.example.com", VisitorID: "a", Created: now.Add(-time.Hour)}, // site timeout
+	}
+	assert.NoError(t, store.SaveEvents(ctx, events[:3]))
+	assert.NoError(t, store.SaveEvents(ctx, events[3:]))
+
+	sessionIDs := []int64{}
+	for _, e := range store.events {
+		sessionIDs = append(sessionIDs, e.sessionID)
+	}
+	assert.Equal(t, []int64{1, 2, 2, 3, 4, 4}, sessionIDs)
+	assert.Len(t, store.sessions, 4)
+	assert.Equal(t, now.Add(-100*time.Minute), store.sessions[1].updatedAt)
+	assert.Equal(t, 2, store.sessions[3].events)
+
+	assert.NoError(t, store.Prune(ctx, 30, 0))
+	assert.Len(t, store.events, 5)
+	assert.Len(t, store.sessions, 3)
+	assert.Equal(t, int64(2), store.sessions[0].id)
+}
@@ -0,0 +1,314 @@
+package picolytics
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/acme/autocert"
+	_ "modernc.org/sqlite" // pure-Go driver, registered as "sqlite"
+)
+
+//go:embed migrations_sqlite
+var sqliteMigrationsFiles embed.FS
+
+// sqliteTimeLayout formats UTC times so they sort and compare as strings, and work with SQLite's date functions
+const sqliteTimeLayout = "2006-01-02 15:04:05.000000"
+
+// SQLiteStore keeps the same schema as postgres in a single file, for small single-box deployments.
+// Writes are serialized on one connection, which suits SQLite's single writer.
+type SQLiteStore struct {
+	db    *sql.DB
+	sites *Sites
+
+	lock        sync.Mutex // guards the cached salt
+	salt        string
+	saltCreated time.Time
+}
+
+func NewSQLiteStore(path string, sites *Sites, o11y *PicolyticsO11y) (*SQLiteStore, error) {
+	dsn := "file:" + path + "?_pragma=foreign_keys(1)&_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)&_txlock=immediate"
+	sqlDB, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("error opening sqlite database: %v", err)
+	}
+	sqlDB.SetMaxOpenConns(1)
+	s := SQLiteStore{
+		db:    sqlDB,
+		sites: sites,
+		salt:  uuid.NewString(), // this would only be used incase the salt query never works
+	}
+	if err := s.migrate(context.Background(), o11y); err != nil {
+		sqlDB.Close()
+		return nil, err
+	}
+	return &s, nil
+}
+
+// migrate applies the embedded migrations newer than the database's user_version, the
+// same way tern does for postgres.
+func (s *SQLiteStore) migrate(ctx context.Context, o11y *PicolyticsO11y) error {
+	var version int
+	if err := s.db.QueryRowContext(ctx, "PRAGMA user_version").Scan(&version); err != nil {
+		return fmt.Errorf("error reading schema version: %v", err)
+	}
+	migrationsFS, err := fs.Sub(sqliteMigrationsFiles, "migrations_sqlite")
+	if err != nil {
+		return fmt.Errorf("error accessing embedded migrations files: %v", err)
+	}
+	files, err := fs.Glob(migrationsFS, "*.sql")
+	if err != nil {
+		return fmt.Errorf("error loading migrations: %v", err)
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		n, err := strconv.Atoi(strings.SplitN(file, "_", 2)[0])
+		if err != nil {
+			return fmt.Errorf("invalid migration name: %s", file)
+		}
+		if n <= version {
+			continue
+		}
+		migration, err := fs.ReadFile(migrationsFS, file)
+		if err != nil {
+			return fmt.Errorf("error loading migrations: %v", err)
+		}
+		up, _, _ := strings.Cut(string(migration), "---- create above / drop below ----")
+		o11y.Logger.Debug("Running migration", "file", file)
+		tx, err := s.db.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("error executing migrations: %v", err)
+		}
+		if _, err := tx.ExecContext(ctx, up); err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("error executing migration %s: %v", file, err)
+		}
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf("PRAGMA user_version = %d", n)); err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("error executing migration %s: %v", file, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("error executing migration %s: %v", file, err)
+		}
+	}
+	return nil
+}
+
+func sqliteTime(t time.Time) string {
+	return t.UTC().Format(sqliteTimeLayout)
+}
+
+// getSalt rotates the salt daily, like DailySalt
+func (s *SQLiteStore) getSalt() (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.saltCreated.Before(time.Now().Add(-24 * time.Hour)) {
+		return s.salt, nil
+	}
+	ctx := context.Background()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return s.salt, err
+	}
+	defer tx.Rollback()
+	now := time.Now()
+	var salt, created string
+	err = tx.QueryRowContext(ctx, "SELECT salt, created_at FROM salt LIMIT 1").Scan(&salt, &created)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return s.salt, err
+	}
+	createdAt, _ := time.Parse(sqliteTimeLayout, created)
+	if errors.Is(err, sql.ErrNoRows) || createdAt.Before(now.Add(-24*time.Hour)) {
+		salt, createdAt = uuid.NewString(), now
+		if _, err := tx.ExecContext(ctx, "DELETE FROM salt"); err != nil {
+			return s.salt, err
+		}
+		if _, err := tx.ExecContext(ctx, "INSERT INTO salt (salt, created_at) VALUES (?, ?)", salt, sqliteTime(now)); err != nil {
+			return s.salt, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return s.salt, fmt.Errorf("salter error committing transaction: %v", err)
+	}
+	s.salt, s.saltCreated = salt, createdAt
+	return s.salt, nil
+}
+
+// SaveEvents saves the batch in one transaction, resolving sessions one visitor at a time
+// with the same rules as the postgres UpsertSessions query.
+func (s *SQLiteStore) SaveEvents(ctx context.Context, events []PicolyticsEvent) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	eventDomains := EventDomains{} // domain-> domainID
+	for _, e := range events {
+		if _, ok := eventDomains[e.Domain]; ok {
+			continue
+		}
+		var domainID int32
+		if err := tx.QueryRowContext(ctx, `INSERT INTO domains (domain_name) VALUES (?)
+			ON CONFLICT (domain_name) DO UPDATE SET domain_name = excluded.domain_name
+			RETURNING domain_id`, e.Domain).Scan(&domainID); err != nil {
+			return fmt.Errorf("error upserting domain %s: %v", e.Domain, err)
+		}
+		eventDomains[e.Domain] = domainID
+	}
+
+	eventSessions := make(EventSessions, len(events))
+	for _, v := range groupVisitors(events, s.sites) {
+		sessionID, err := s.upsertSession(ctx, tx, v, eventDomains[v.first.Domain])
+		if err != nil {
+			return fmt.Errorf("error upserting sessions: %v", err)
+		}
+		for _, i := range v.events {
+			eventSessions[i] = sessionID
+		}
+	}
+
+	for _, g := range groupJSErrors(events) {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO js_errors (
+			fingerprint, domain_id, message, source, line, col, stack, path, occurrences, first_seen, last_seen
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (fingerprint) DO UPDATE SET
+			stack = excluded.stack,
+			path = excluded.path,
+			occurrences = js_errors.occurrences + excluded.occurrences,
+			first_seen = MIN(js_errors.first_seen, excluded.first_seen),
+			last_seen = MAX(js_errors.last_seen, excluded.last_seen)`,
+			g.fingerprint, eventDomains[g.first.Domain], g.first.ErrorMessage, g.first.ErrorSource, g.first.ErrorLine, g.first.ErrorColumn,
+			g.latest.ErrorStack, g.latest.Path, g.occurrences, sqliteTime(g.firstTime), sqliteTime(g.lastTime)); err != nil {
+			return fmt.Errorf("error upserting js error %s: %v", g.fingerprint, err)
+		}
+	}
+
+	insert, err := tx.PrepareContext(ctx, `INSERT INTO events (
+		domain_id, session_id, visitor_id, name, path, referrer, load_time, ttfb, props, created_at,
+		lcp, cls, inp, fcp, target, engaged_ms, scroll_depth
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return fmt.Errorf("error writing event to db: %v", err)
+	}
+	defer insert.Close()
+	for i, e := range events {
+		var props interface{} // NULL without props, like postgres
+		if e.Props != nil {
+			b, err := json.Marshal(e.Props)
+			if err != nil {
+				return fmt.Errorf("error writing event to db: %v", err)
+			}
+			props = string(b)
+		}
+		if _, err := insert.ExecContext(ctx, eventDomains[e.Domain], eventSessions[i], e.VisitorID,
+			e.Name, e.Path, e.Referrer, e.LoadTime, e.TTFB, props, sqliteTime(e.Created),
+			e.LCP, e.CLS, e.INP, e.FCP, e.Target, e.EngagedMs, e.ScrollDepth); err != nil {
+			return fmt.Errorf("error writing event to db: %v", err)
+		}
+	}
+	return tx.Commit()
+}
+
+// upsertSession extends the visitor's session if it was active within the site's session
+// timeout of their first event in the group, or creates a new session.
+func (s *SQLiteStore) upsertSession(ctx context.Context, tx *sql.Tx, v *visitorEvents, domainID int32) (int64, error) {
+	e := v.first
+	timeout := time.Duration(s.sites.sessionTimeoutMin(e.Domain)) * time.Minute
+	var sessionID int64
+	err := tx.QueryRowContext(ctx, `SELECT id FROM sessions
+		WHERE visitor_id = ? AND updated_at > ? AND updated_at <= ?
+		ORDER BY updated_at DESC LIMIT 1`, e.VisitorID, sqliteTime(v.firstTime.Add(-timeout)), sqliteTime(v.firstTime.Add(timeout))).Scan(&sessionID)
+	if err == nil {
+		_, err = tx.ExecContext(ctx, `UPDATE sessions
+			SET
+				bounce = CASE WHEN ?1 THEN FALSE ELSE bounce END,
+				updated_at = MAX(updated_at, ?2),
+				exit_path = ?3,
+				duration = CAST(ROUND((julianday(MAX(updated_at, ?2)) - julianday(created_at)) * 86400) AS INTEGER),
+				engaged_seconds = engaged_seconds + CAST(ROUND(?5 / 1000.0) AS INTEGER)
+			WHERE id = ?4`, v.engaged, sqliteTime(v.lastTime), v.exitPath, sessionID, v.engagedMs)
+		return sessionID, err
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return 0, err
+	}
+	err = tx.QueryRowContext(ctx, `INSERT INTO sessions (
+		created_at, updated_at, bounce, domain_id, exit_path,
+		visitor_id, entry_path,
+		country, latitude, longitude, subdivision, city,
+		browser, browser_version, os, os_version, platform, device_type, bot, screen_w, screen_h, timezone, pixel_ratio, pixel_depth,
+		utm_source, utm_medium, utm_campaign, utm_content, utm_term, engaged_seconds
+	) VALUES (
+		?, ?, ?, ?, ?,
+		?, ?,
+		?, ?, ?, ?, ?,
+		?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?,
+		?, ?, ?, ?, ?, CAST(ROUND(? / 1000.0) AS INTEGER)
+	) RETURNING id`,
+		sqliteTime(v.firstTime), sqliteTime(v.lastTime), !v.engagedAfterEntry, domainID, v.exitPath,
+		e.VisitorID, e.Path,
+		e.Country, e.Latitude, e.Longitude, e.Subdivision, e.City,
+		e.Browser, e.BrowserVersion, e.Os, e.OsVersion, e.Platform, e.DeviceType, e.Bot, e.ScreenW, e.ScreenH, e.Timezone, e.PixelRatio, e.PixelDepth,
+		e.UtmSource, e.UtmMedium, e.UtmCampaign, e.UtmContent, e.UtmTerm, v.engagedMs,
+	).Scan(&sessionID)
+	return sessionID, err
+}
+
+// Prune has no rollups to prune
+func (s *SQLiteStore) Prune(ctx context.Context, pruneDays, rollupPruneDays int) error {
+	if pruneDays < 1 {
+		return nil
+	}
+	cutoff := sqliteTime(time.Now().AddDate(0, 0, -pruneDays))
+	if _, err := s.db.ExecContext(ctx, "DELETE FROM events WHERE created_at <= ?", cutoff); err != nil {
+		return fmt.Errorf("prune events error: %v", err)
+	}
+	// guards the foreign key, in case a session's events outlive it
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM sessions WHERE updated_at <= ?
+		AND NOT EXISTS (SELECT 1 FROM events WHERE events.session_id = sessions.id)`, cutoff); err != nil {
+		return fmt.Errorf("prune sessions error: %v", err)
+	}
+	if _, err := s.db.ExecContext(ctx, "DELETE FROM js_errors WHERE last_seen <= ?", cutoff); err != nil {
+		return fmt.Errorf("prune js errors error: %v", err)
+	}
+	return nil
+}
+
+func (s *SQLiteStore) Close() {
+	s.db.Close()
+}
+
+// autocert.Cache implementation
+
+func (s *SQLiteStore) Get(ctx context.Context, key string) ([]byte, error) {
+	var data []byte
+	err := s.db.QueryRowContext(ctx, "SELECT data FROM autocert_cache WHERE key = ?", key).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, autocert.ErrCacheMiss
+	}
+	return data, err
+}
+
+func (s *SQLiteStore) Put(ctx context.Context, key string, data []byte) error {
+	now := sqliteTime(time.Now())
+	_, err := s.db.ExecContext(context.Background(), `INSERT INTO autocert_cache (key, data, created_at, updated_at)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT (key) DO UPDATE SET data = excluded.data, updated_at = excluded.updated_at`, key, data, now, now)
+	return err
+}
+
+func (s *SQLiteStore) Delete(ctx context.Context, key string) error {
+	_, err := s.db.ExecContext(context.Background(), "DELETE FROM autocert_cache WHERE key = ?", key)
+	return err
+}
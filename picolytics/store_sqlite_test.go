@@ -0,0 +1,126 @@
+package picolytics
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func TestSQLiteStore(t *testing.T) {
+	o11yMock := &PicolyticsO11y{
+		Logger:  slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError})),
+		Metrics: setupMetrics(1, "", "", ""),
+	}
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "picolytics.db")
+	sites := testSites(t, &Config{SessionTimeoutMin: 30})
+	store, err := NewSQLiteStore(path, sites, o11yMock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	salt, err := store.getSalt()
+	assert.NoError(t, err)
+	now := time.Now().Truncate(time.Second)
+	batches := [][]PicolyticsEvent{
+		{{Name: "load", Domain: "example.com", VisitorID: "a", Path: "/", Created: now.Add(-100 * 24 * time.Hour)}},
+		{
+			{Name: "load", Domain: "example.com", VisitorID: "a", Path: "/", Created: now.Add(-2 * time.Hour)},
+			{Name: "hidden", Domain: "example.com", VisitorID: "a", Path: "/", Created: now.Add(-2*time.Hour + time.Minute)},
+			{Name: "engagement", Domain: "example.com", VisitorID: "a", Path: "/", EngagedMs: 1400, Created: now.Add(-2*time.Hour + time.Minute)},
+			{Name: "load", Domain: "example.com", VisitorID: "b", Path: "/about", Props: map[string]interface{}{"plan": "pro"}, Created: now.Add(-time.Hour)},
+		},
+		{
+			{Name: "load", Domain: "example.com", VisitorID: "a", Path: "/pricing", Created: now.Add(-110 * time.Minute)},
+			{Name: "engagement", Domain: "example.com", VisitorID: "a", Path: "/pricing", EngagedMs: 2600, ScrollDepth: ptr(int32(80)), Created: now.Add(-110 * time.Minute)},
+			{Name: "error", Domain: "example.com", VisitorID: "a", Path: "/pricing", ErrorMessage: "Error: boom", ErrorLine: 1, Created: now.Add(-110 * time.Minute)},
+			{Name: "error", Domain: "example.com", VisitorID: "a", Path: "/pricing", ErrorMessage: "Error: boom", ErrorLine: 1, Created: now.Add(-110 * time.Minute)},
+		},
+		{{Name: "load", Domain: "example.com", VisitorID: "a", Path: "/", Created: now.Add(-time.Hour)}}, // timed out
+		// backdated, so it extends the session active at the time, not the latest session
+		{{Name: "load", Domain: "example.com", VisitorID: "a", Path: "/backdated", Created: now.Add(-105 * time.Minute)}},
+		{ // replayed, and further apart than the timeout
+			{Name: "load", Domain: "example.com", VisitorID: "c", Path: "/two", Created: now.Add(-5 * time.Minute)},
+			{Name: "load", Domain: "example.com", VisitorID: "c", Path: "/one", Created: now.Add(-50 * time.Minute)},
+		},
+	}
+	for _, batch := range batches {
+		assert.NoError(t, store.SaveEvents(ctx, batch))
+	}
+
+	type session struct {
+		ID        int64
+		VisitorID string
+		Bounce    bool
+		Duration  int
+		Engaged   int
+		EntryPath string
+		ExitPath  string
+	}
+	rows, err := store.db.QueryContext(ctx, "SELECT id, visitor_id, bounce, duration, engaged_seconds, entry_path, exit_path FROM sessions ORDER BY id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions := []session{}
+	for rows.Next() {
+		var s session
+		assert.NoError(t, rows.Scan(&s.ID, &s.VisitorID, &s.Bounce, &s.Duration, &s.Engaged, &s.EntryPath, &s.ExitPath))
+		sessions = append(sessions, s)
+	}
+	assert.NoError(t, rows.Err())
+	assert.Equal(t, []session{
+		{ID: 1, VisitorID: "a", Bounce: true, EntryPath: "/", ExitPath: "/"},
+		{ID: 2, VisitorID: "a", Bounce: false, Duration: 900, Engaged: 4, EntryPath: "/", ExitPath: "/backdated"},
+		{ID: 3, VisitorID: "b", Bounce: true, EntryPath: "/about", ExitPath: "/about"},
+		{ID: 4, VisitorID: "a", Bounce: true, EntryPath: "/", ExitPath: "/"},
+		{ID: 5, VisitorID: "c", Bounce: true, EntryPath: "/one", ExitPath: "/one"},
+		{ID: 6, VisitorID: "c", Bounce: true, EntryPath: "/two", ExitPath: "/two"},
+	}, sessions)
+
+	var props string
+	assert.NoError(t, store.db.QueryRowContext(ctx, "SELECT props FROM events WHERE visitor_id = 'b'").Scan(&props))
+	assert.JSONEq(t, `{"plan":"pro"}`, props)
+	var scrollDepth int
+	assert.NoError(t, store.db.QueryRowContext(ctx, "SELECT scroll_depth FROM events WHERE scroll_depth IS NOT NULL").Scan(&scrollDepth))
+	assert.Equal(t, 80, scrollDepth)
+	var occurrences int
+	assert.NoError(t, store.db.QueryRowContext(ctx, "SELECT occurrences FROM js_errors WHERE message = 'Error: boom'").Scan(&occurrences))
+	assert.Equal(t, 2, occurrences)
+
+	assert.NoError(t, store.Prune(ctx, 30, 0))
+	var count int
+	assert.NoError(t, store.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM events").Scan(&count))
+	assert.Equal(t, 12, count)
+	assert.NoError(t, store.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM sessions").Scan(&count))
+	assert.Equal(t, 5, count)
+
+	_, err = store.Get(ctx, "cert")
+	assert.Equal(t, autocert.ErrCacheMiss, err)
+	assert.NoError(t, store.Put(ctx, "cert", []byte("one")))
+	assert.NoError(t, store.Put(ctx, "cert", []byte("two")))
+	data, err := store.Get(ctx, "cert")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("two"), data)
+	assert.NoError(t, store.Delete(ctx, "cert"))
+	_, err = store.Get(ctx, "cert")
+	assert.Equal(t, autocert.ErrCacheMiss, err)
+	store.Close()
+
+	// reopening keeps the data and the salt, without migrating again
+	store, err = NewSQLiteStore(path, sites, o11yMock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	again, err := store.getSalt()
+	assert.NoError(t, err)
+	assert.Equal(t, salt, again)
+	assert.NoError(t, store.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM events").Scan(&count))
+	assert.Equal(t, 12, count)
+}
@@ -1,12 +1,19 @@
 package picolytics
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
 )
 
 type PicolyticsEvent struct {
@@ -27,9 +34,42 @@ type PicolyticsEvent struct {
 	UtmContent  string  `json:"utm_content"`
 	UtmTerm     string  `json:"utm_term"`
 
+	// populated by tracker javascript for vitals events, sent when the page is hidden: nil if unsupported
+	LCP *int32   `json:"lcp"` // Largest Contentful Paint, ms
+	CLS *float64 `json:"cls"` // Cumulative Layout Shift
+	INP *int32   `json:"inp"` // Interaction to Next Paint, ms
+	FCP *int32   `json:"fcp"` // First Contentful Paint, ms
+
+	// populated by tracker javascript for outbound and download events: the link URL
+	Target string `json:"tg"`
+
+	// populated by tracker javascript for engagement events: active time on the page since the last report,
+	// and the furthest percent of the page seen, reported once per pageview
+	EngagedMs   int32  `json:"em"`
+	ScrollDepth *int32 `json:"sd"`
+
+	// populated by tracker javascript for error events: saved to js_errors, grouped by fingerprint
+	ErrorMessage string `json:"msg"`
+	ErrorSource  string `json:"src"` // script URL
+	ErrorLine    int32  `json:"ln"`
+	ErrorColumn  int32  `json:"col"`
+	ErrorStack   string `json:"stk"`
+
+	// populated by tracker javascript from the script's data attributes
+	DomainOverride string `json:"d"` // record the event for this registered domain, instead of the URL's
+	HashRoutes     bool   `json:"h"` // the URL fragment is part of the path, for hash-routed apps
+
+	// populated by tracker javascript for custom events via window.pico()
+	Props map[string]interface{} `json:"p"`
+
+	// populated by apps sending buffered events to the batch endpoint: ms since epoch
+	ClientTime int64 `json:"t"`
+
 	// populated by tracker handler
 	Lang    string
+	Origin  string // Origin header, or Referer if missing
 	Created time.Time
+	pixel   bool // images don't send an Origin, and emails don't send a Referer
 
 	// populated by tracker handler - DO NOT store in DB
 	ClientIpDONOTSTORE string
@@ -45,47 +85,324 @@ type PicolyticsEvent struct {
 	Longitude, Latitude        float64
 	Country, Subdivision, City string
 	Bot                        bool
+
+	// populated by Spool.feed, used to acknowledge saved events
+	spoolPos spoolPosition
 }
 
 type EventSaver interface {
-	SaveEvent(event PicolyticsEvent)
+	SaveEvent(event PicolyticsEvent) error
 }
 
 type Trackers struct {
-	eventSaver  EventSaver
-	bodyMaxSize int64
+	eventSaver       EventSaver
+	sites            *Sites
+	batchBodyMaxSize int64
+	batchMaxAge      time.Duration
+	o11y             *PicolyticsO11y
+	saving           sync.WaitGroup // in-flight SaveEvent calls
 }
 
-func NewTrackers(eventSaver EventSaver, bodyMaxSize int64) *Trackers {
+func NewTrackers(config *Config, eventSaver EventSaver, sites *Sites, o11y *PicolyticsO11y) *Trackers {
 	return &Trackers{
-		eventSaver:  eventSaver,
-		bodyMaxSize: bodyMaxSize,
+		eventSaver:       eventSaver,
+		sites:            sites,
+		batchBodyMaxSize: config.BatchBodyMaxSize,
+		batchMaxAge:      time.Duration(config.BatchMaxAgeHours) * time.Hour,
+		o11y:             o11y,
 	}
 }
 
 func (t *Trackers) recordPicolyticsEvent(c echo.Context) error {
 	event := PicolyticsEvent{Created: time.Now()}
-	if err := unmarshallBody(c, &event, t.bodyMaxSize); err != nil {
+	size, err := unmarshallBody(c, &event, t.sites.maxBodySize)
+	if err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, "Invalid event data")
 	}
+	if err := t.acceptEvent(c, event, size); err != nil {
+		return err
+	}
+	return c.String(http.StatusAccepted, "ok")
+}
+
+// recordPixelEvent accepts an event from query parameters, and responds with a
+// 1x1 transparent image. For pages without Javascript, AMP pages, and emails.
+func (t *Trackers) recordPixelEvent(image pixel) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		event := PicolyticsEvent{Created: time.Now(), pixel: true}
+		size, err := unmarshallQuery(c, &event)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid event data")
+		}
+		if len(event.Location) < 1 {
+			event.Location = c.Request().Referer() // the page embedding the image
+		}
+		if err := t.acceptEvent(c, event, size); err != nil {
+			return err
+		}
+		c.Response().Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+		c.Response().Header().Set("Pragma", "no-cache")
+		c.Response().Header().Set("Expires", "0")
+		return c.Blob(http.StatusOK, image.contentType, image.data)
+	}
+}
 
+type batchResult struct {
+	Accepted bool   `json:"accepted"`
+	Error    string `json:"error,omitempty"`
+}
+
+type batchResponse struct {
+	Accepted int           `json:"accepted"`
+	Rejected int           `json:"rejected"`
+	Results  []batchResult `json:"results"` // in request order
+}
+
+// recordPicolyticsBatch accepts a JSON array or NDJSON stream of events, e.g. buffered
+// by apps while offline. Each event is checked and saved on its own, so one invalid
+// event doesn't reject the batch, and the response has the result for each event.
+func (t *Trackers) recordPicolyticsBatch(c echo.Context) error {
+	items, err := readBatch(c, t.batchBodyMaxSize)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	res := batchResponse{Results: make([]batchResult, 0, len(items))}
+	allowed := map[*site]bool{} // each site's rate limit applies once per batch
+	for _, item := range items {
+		if err := t.acceptBatchEvent(c, item, now, allowed); err != nil {
+			res.Rejected++
+			res.Results = append(res.Results, batchResult{Error: err.Error()})
+			continue
+		}
+		res.Accepted++
+		res.Results = append(res.Results, batchResult{Accepted: true})
+	}
+	if res.Rejected > 0 {
+		t.o11y.Metrics.batchRejectedEvents.Add(float64(res.Rejected))
+	}
+	return c.JSON(http.StatusAccepted, res)
+}
+
+// acceptBatchEvent checks and saves one event from a batch. The client time is clamped to
+// the batch window, since offline devices can have wrong clocks.
+func (t *Trackers) acceptBatchEvent(c echo.Context, item []byte, now time.Time, allowed map[*site]bool) error {
+	if int64(len(item)) > t.sites.maxBodySize {
+		return errEventTooLarge
+	}
+	event := PicolyticsEvent{Created: now}
+	if err := json.Unmarshal(item, &event); err != nil {
+		t.o11y.Metrics.eventErrors.WithLabelValues("parse").Add(1)
+		return fmt.Errorf("invalid event data")
+	}
+	site := t.sites.forEvent(&event)
+	if err := t.checkSite(c, site, int64(len(item))); err != nil {
+		return err
+	}
+	if _, ok := allowed[site]; !ok {
+		allowed[site] = t.allowRequest(c, site)
+	}
+	if !allowed[site] {
+		return errRateLimited
+	}
+	if event.ClientTime > 0 {
+		event.Created = time.UnixMilli(event.ClientTime)
+		if event.Created.After(now) {
+			event.Created = now
+		} else if event.Created.Before(now.Add(-t.batchMaxAge)) {
+			event.Created = now.Add(-t.batchMaxAge)
+		}
+	}
+	setRequestFields(c, &event)
+	return t.eventSaver.SaveEvent(event)
+}
+
+// readBatch splits a batch body into events. Bodies starting with '[' are JSON arrays,
+// anything else is NDJSON, with one event per line.
+func readBatch(c echo.Context, maxSize int64) ([]json.RawMessage, error) {
+	r := c.Request()
+	r.Body = http.MaxBytesReader(c.Response().Writer, r.Body, maxSize)
+	defer r.Body.Close()
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusRequestEntityTooLarge, "Batch too large")
+	}
+	body = bytes.TrimSpace(body)
+	if len(body) < 1 {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "Request body empty")
+	}
+	items := []json.RawMessage{}
+	if body[0] == '[' {
+		if err := json.Unmarshal(body, &items); err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "Invalid batch data")
+		}
+		return items, nil
+	}
+	for _, line := range bytes.Split(body, []byte("\n")) {
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			items = append(items, line)
+		}
+	}
+	return items, nil
+}
+
+var (
+	errEventTooLarge = errors.New("event too large")
+	errRateLimited   = errors.New("rate limit exceeded")
+)
+
+// checkSite applies the site's size and origin settings before an event is accepted.
+func (t *Trackers) checkSite(c echo.Context, site *site, size int64) error {
+	if size > site.bodyMaxSize {
+		return errEventTooLarge
+	}
+	if !site.allowsOrigin(c.Request().Header.Get("Origin")) {
+		t.o11y.Metrics.eventErrors.WithLabelValues("origin_mismatch").Add(1)
+		return errOriginMismatch
+	}
+	return nil
+}
+
+// allowRequest applies the site's rate limit, if it has one, to the client's IP address.
+func (t *Trackers) allowRequest(c echo.Context, site *site) bool {
+	if site.rateLimiter == nil {
+		return true
+	}
+	if allow, err := site.rateLimiter.Allow(c.RealIP()); !allow || err != nil {
+		t.o11y.Metrics.rateLimiterDrops.Inc()
+		t.o11y.Logger.Debug("rate limit exceeded", "domain", site.domain, "error", err)
+		return false
+	}
+	return true
+}
+
+// setRequestFields populates the event fields that come from the request.
+func setRequestFields(c echo.Context, event *PicolyticsEvent) {
 	event.ClientIpDONOTSTORE = c.RealIP()
 	event.UaDONOTSTORE = c.Request().UserAgent()
 	event.Lang = c.Request().Header.Get("Accept-Language")
-	go t.eventSaver.SaveEvent(event)
+	event.Origin = c.Request().Header.Get("Origin")
+	if len(event.Origin) < 1 {
+		event.Origin = c.Request().Referer()
+	}
+}
 
-	return c.String(http.StatusAccepted, "ok")
+// acceptEvent applies the site's settings to a decoded event, and saves it asynchronously.
+func (t *Trackers) acceptEvent(c echo.Context, event PicolyticsEvent, size int64) error {
+	// the site's settings apply before the event is accepted
+	site := t.sites.forEvent(&event)
+	if err := t.checkSite(c, site, size); errors.Is(err, errEventTooLarge) {
+		return echo.NewHTTPError(http.StatusRequestEntityTooLarge, "Invalid event data")
+	} else if err != nil {
+		return echo.NewHTTPError(http.StatusForbidden, "Origin not allowed")
+	}
+	if !t.allowRequest(c, site) {
+		return middleware.ErrRateLimitExceeded
+	}
+
+	setRequestFields(c, &event)
+	t.saving.Add(1)
+	go func() {
+		defer t.saving.Done()
+		_ = t.eventSaver.SaveEvent(event) // rejected events are logged and counted by the saver
+	}()
+	return nil
 }
 
-func unmarshallBody(c echo.Context, e interface{}, maxBodySize int64) error {
+// wait blocks until in-flight SaveEvent calls have finished
+func (t *Trackers) wait() {
+	t.saving.Wait()
+}
+
+// unmarshallBody decodes the request body, and returns the number of bytes read
+func unmarshallBody(c echo.Context, e interface{}, maxBodySize int64) (int64, error) {
 	r := c.Request()
 	r.Body = http.MaxBytesReader(c.Response().Writer, r.Body, maxBodySize)
 	defer r.Body.Close()
-	if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+	body := &countingReader{r: r.Body}
+	if err := json.NewDecoder(body).Decode(&e); err != nil {
 		if err == io.EOF {
-			return echo.NewHTTPError(http.StatusRequestEntityTooLarge, "Request body empty")
+			return body.n, echo.NewHTTPError(http.StatusRequestEntityTooLarge, "Request body empty")
 		}
-		return echo.NewHTTPError(http.StatusBadRequest, "Invalid event data")
+		return body.n, echo.NewHTTPError(http.StatusBadRequest, "Invalid event data")
 	}
-	return nil
+	return body.n, nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
 }
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// unmarshallQuery decodes an event from query parameters, using the same names as the
+// JSON body. Custom event properties are passed as p.<key>=<value>, and saved as strings.
+// It returns the size of the query string, which is limited like a request body.
+func unmarshallQuery(c echo.Context, e *PicolyticsEvent) (int64, error) {
+	query := c.QueryParams()
+	e.Name = query.Get("n")
+	if len(e.Name) < 1 {
+		e.Name = "load"
+	}
+	e.Location = query.Get("l")
+	e.Referrer = query.Get("r")
+	e.DomainOverride = query.Get("d")
+	e.Target = query.Get("tg")
+	e.Timezone = query.Get("tz")
+	e.UtmSource = query.Get("utm_source")
+	e.UtmMedium = query.Get("utm_medium")
+	e.UtmCampaign = query.Get("utm_campaign")
+	e.UtmContent = query.Get("utm_content")
+	e.UtmTerm = query.Get("utm_term")
+	for key, dest := range map[string]*int32{"lt": &e.LoadTime, "fb": &e.TTFB, "sw": &e.ScreenW, "sh": &e.ScreenH, "pd": &e.PixelDepth, "em": &e.EngagedMs} {
+		if v := query.Get(key); len(v) > 0 {
+			i, err := strconv.ParseInt(v, 10, 32)
+			if err != nil {
+				return 0, fmt.Errorf("invalid %s: %v", key, err)
+			}
+			*dest = int32(i)
+		}
+	}
+	if v := query.Get("pr"); len(v) > 0 {
+		pr, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid pr: %v", err)
+		}
+		e.PixelRatio = pr
+	}
+	for key, values := range query {
+		if prop, ok := strings.CutPrefix(key, "p."); ok && len(values) > 0 {
+			if e.Props == nil {
+				e.Props = map[string]interface{}{}
+			}
+			e.Props[prop] = values[0]
+		}
+	}
+	return int64(len(c.Request().URL.RawQuery)), nil
+}
+
+type pixel struct {
+	contentType string
+	data        []byte
+}
+
+var (
+	// smallest transparent 1x1 images
+	gifPixel = pixel{contentType: "image/gif", data: []byte{
+		0x47, 0x49, 0x46, 0x38, 0x39, 0x61, 0x01, 0x00, 0x01, 0x00, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0xff, 0xff, 0xff, 0x21, 0xf9, 0x04, 0x01, 0x00, 0x00, 0x00, 0x00, 0x2c, 0x00, 0x00, 0x00, 0x00,
+		0x01, 0x00, 0x01, 0x00, 0x00, 0x02, 0x02, 0x44, 0x01, 0x00, 0x3b,
+	}}
+	pngPixel = pixel{contentType: "image/png", data: []byte{
+		0x89, 0x50, 0x4e, 0x47, 0x0d, 0x0a, 0x1a, 0x0a, 0x00, 0x00, 0x00, 0x0d, 0x49, 0x48, 0x44, 0x52,
+		0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x08, 0x06, 0x00, 0x00, 0x00, 0x1f, 0x15, 0xc4,
+		0x89, 0x00, 0x00, 0x00, 0x0e, 0x49, 0x44, 0x41, 0x54, 0x78, 0xda, 0x62, 0x62, 0x60, 0x60, 0x60,
+		0x00, 0x0c, 0x00, 0x00, 0x0f, 0x00, 0x03, 0xb1, 0x88, 0xf4, 0x0f, 0x00, 0x00, 0x00, 0x00, 0x49,
+		0x45, 0x4e, 0x44, 0xae, 0x42, 0x60, 0x82,
+	}}
+)
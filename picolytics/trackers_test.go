@@ -2,9 +2,16 @@ package picolytics
 
 import (
 	"bytes"
+	"image"
+	_ "image/gif"
+	_ "image/png"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"reflect"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -38,19 +45,24 @@ type TestEventSaver struct {
 	events chan PicolyticsEvent
 }
 
-func (es TestEventSaver) SaveEvent(event PicolyticsEvent) {
+func (es TestEventSaver) SaveEvent(event PicolyticsEvent) error {
 	es.events <- event
+	return nil
 }
 
 func TestRecordPicolyticsEvent(t *testing.T) {
+	o11yMock := &PicolyticsO11y{
+		Logger:  slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError})),
+		Metrics: setupMetrics(1, "", "", ""),
+	}
 	eventSaver := TestEventSaver{
 		events: make(chan PicolyticsEvent, 1),
 	}
-	trackers := NewTrackers(eventSaver, 1024)
+	trackers := NewTrackers(&Config{}, eventSaver, testSites(t, &Config{BodyMaxSize: 1024}), o11yMock)
 	e := echo.New()
 
 	// Test for a valid event
-	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte(`{"n":"load","l":"http://example.com/","r":"https://google.com","lt":100,"fb":200,"sw":1920,"sh":1080,"pr":1.5,"pd":24,"tz":"Europe/Paris","utm_source":"testSource","utm_medium":"testMedium","utm_campaign":"testCampaign","utm_content":"testContent","utm_term":"testTerm"}`)))
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte(`{"n":"load","l":"http://example.com/","r":"https://google.com","lt":100,"fb":200,"sw":1920,"sh":1080,"pr":1.5,"pd":24,"tz":"Europe/Paris","utm_source":"testSource","utm_medium":"testMedium","utm_campaign":"testCampaign","utm_content":"testContent","utm_term":"testTerm","p":{"plan":"pro","value":49}}`)))
 	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
 	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/42.0.2311.135 Safari/537.36 Edge/12.246")
 	req.Header.Set("Accept-Language", "en-US,en;q=0.9,fr;q=0.8")
@@ -80,6 +92,7 @@ func TestRecordPicolyticsEvent(t *testing.T) {
 		UtmCampaign:        "testCampaign",
 		UtmContent:         "testContent",
 		UtmTerm:            "testTerm",
+		Props:              map[string]interface{}{"plan": "pro", "value": float64(49)},
 	}
 	select {
 	case gotEvent := <-eventSaver.events:
@@ -114,10 +127,14 @@ func TestRecordPicolyticsEvent_Invalid(t *testing.T) {
 			input: []byte(`{"n": "nnnnnnnnnnnnnnnnnnnnnnnnn nnnnnnnnnnnnnnnnnnnnnnnnnnnnnnn nnnnnnnnnnnnnnnnnnnnnnnnnnnnnnnnnnnnnn nnnnnnnnnnnnnnnnnnnnnnnnnnnnnnnnnnnnnnnnnnnnnnnnn","l":"http://example.com/"}`),
 		},
 	}
+	o11yMock := &PicolyticsO11y{
+		Logger:  slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError})),
+		Metrics: setupMetrics(1, "", "", ""),
+	}
 	eventSaver := TestEventSaver{
 		events: make(chan PicolyticsEvent, 1),
 	}
-	trackers := NewTrackers(eventSaver, 128)
+	trackers := NewTrackers(&Config{}, eventSaver, testSites(t, &Config{BodyMaxSize: 128}), o11yMock)
 	e := echo.New()
 
 	for _, tt := range tests {
@@ -131,3 +148,311 @@ func TestRecordPicolyticsEvent_Invalid(t *testing.T) {
 		})
 	}
 }
+
+func TestRecordPicolyticsEvent_SiteSettings(t *testing.T) {
+	o11yMock := &PicolyticsO11y{
+		Logger:  slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError})),
+		Metrics: setupMetrics(1, "", "", ""),
+	}
+	sites := testSites(t, &Config{
+		BodyMaxSize: 1024,
+		Sites: []SiteConfig{
+			{Domain: "example.com", BodyMaxSize: 64},
+			{Domain: "app.example.com", CorsOrigins: []string{"https://app.example.com"}, RequestRateLimit: 1},
+		},
+	})
+	tests := []struct {
+		name     string
+		input    string
+		origin   string
+		wantCode int // 0 if accepted
+	}{
+		{
+			name:  "accepted",
+			input: `{"n":"load","l":"https://app.example.com/"}`,
+		},
+		{
+			name:     "site rate limit",
+			input:    `{"n":"load","l":"https://app.example.com/"}`,
+			wantCode: http.StatusTooManyRequests,
+		},
+		{
+			name:     "site body size",
+			input:    `{"n":"load","l":"https://example.com/","r":"https://www.google.com/search?q=picolytics"}`,
+			wantCode: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:   "global body size for unknown site",
+			input:  `{"n":"load","l":"https://example.org/","r":"https://www.google.com/search?q=picolytics"}`,
+			origin: "https://example.org",
+		},
+		{
+			name:     "site origin",
+			input:    `{"n":"load","l":"https://app.example.com/"}`,
+			origin:   "https://example.com",
+			wantCode: http.StatusForbidden,
+		},
+	}
+	eventSaver := TestEventSaver{
+		events: make(chan PicolyticsEvent, len(tests)),
+	}
+	trackers := NewTrackers(&Config{}, eventSaver, sites, o11yMock)
+	e := echo.New()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte(tt.input)))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			req.Header.Set("Origin", tt.origin)
+			c := e.NewContext(req, httptest.NewRecorder())
+
+			err := trackers.recordPicolyticsEvent(&mockEchoContext{Context: c, request: req})
+			if tt.wantCode == 0 {
+				assert.NoError(t, err)
+				return
+			}
+			var httpErr *echo.HTTPError
+			if assert.ErrorAs(t, err, &httpErr) {
+				assert.Equal(t, tt.wantCode, httpErr.Code)
+			}
+		})
+	}
+}
+
+func TestRecordPixelEvent(t *testing.T) {
+	o11yMock := &PicolyticsO11y{
+		Logger:  slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError})),
+		Metrics: setupMetrics(1, "", "", ""),
+	}
+	tests := []struct {
+		name      string
+		query     string
+		referer   string
+		image     pixel
+		wantEvent *PicolyticsEvent // nil if rejected
+		wantCode  int
+	}{
+		{
+			name:  "email open",
+			query: "n=email_open&l=https%3A%2F%2Fexample.com%2Fnewsletter&utm_campaign=june&p.list=weekly",
+			image: gifPixel,
+			wantEvent: &PicolyticsEvent{
+				Name:        "email_open",
+				Location:    "https://example.com/newsletter",
+				UtmCampaign: "june",
+				Props:       map[string]interface{}{"list": "weekly"},
+				pixel:       true,
+			},
+		},
+		{
+			name:    "noscript pageview",
+			query:   "sw=1920&sh=1080&pr=1.5",
+			referer: "https://example.com/about",
+			image:   pngPixel,
+			wantEvent: &PicolyticsEvent{
+				Name:       "load",
+				Location:   "https://example.com/about",
+				ScreenW:    1920,
+				ScreenH:    1080,
+				PixelRatio: 1.5,
+				Origin:     "https://example.com/about",
+				pixel:      true,
+			},
+		},
+		{
+			name:     "invalid number",
+			query:    "l=https%3A%2F%2Fexample.com%2F&lt=fast",
+			image:    gifPixel,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "too-large query",
+			query:    "l=https%3A%2F%2Fexample.com%2F&r=https%3A%2F%2Fwww.google.com%2Fsearch%3Fq%3Dpicolytics%2Bpixel%2Btracking",
+			image:    gifPixel,
+			wantCode: http.StatusRequestEntityTooLarge,
+		},
+	}
+	eventSaver := TestEventSaver{
+		events: make(chan PicolyticsEvent, len(tests)),
+	}
+	trackers := NewTrackers(&Config{}, eventSaver, testSites(t, &Config{BodyMaxSize: 96}), o11yMock)
+	e := echo.New()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/p.gif?"+tt.query, nil)
+			req.Header.Set("Referer", tt.referer)
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+
+			err := trackers.recordPixelEvent(tt.image)(&mockEchoContext{Context: c, request: req})
+			if tt.wantEvent == nil {
+				var httpErr *echo.HTTPError
+				if assert.ErrorAs(t, err, &httpErr) {
+					assert.Equal(t, tt.wantCode, httpErr.Code)
+				}
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.image.contentType, rec.Header().Get(echo.HeaderContentType))
+			assert.Equal(t, "no-cache, no-store, must-revalidate", rec.Header().Get("Cache-Control"))
+			assert.Equal(t, tt.image.data, rec.Body.Bytes())
+
+			select {
+			case gotEvent := <-eventSaver.events:
+				gotEvent.Created = time.Time{}
+				tt.wantEvent.ClientIpDONOTSTORE = "127.0.0.1"
+				assert.Equal(t, *tt.wantEvent, gotEvent)
+			case <-time.After(time.Second * 1):
+				t.Error("asyncSaveEvent was not called within the expected time")
+			}
+		})
+	}
+}
+
+func TestPixelImages(t *testing.T) {
+	for _, p := range []pixel{gifPixel, pngPixel} {
+		img, _, err := image.Decode(bytes.NewReader(p.data))
+		if assert.NoError(t, err, p.contentType) {
+			assert.Equal(t, image.Rect(0, 0, 1, 1), img.Bounds())
+			_, _, _, alpha := img.At(0, 0).RGBA()
+			assert.Zero(t, alpha, "%s should be transparent", p.contentType)
+		}
+	}
+}
+
+func TestRecordPicolyticsBatch(t *testing.T) {
+	o11yMock := &PicolyticsO11y{
+		Logger:  slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError})),
+		Metrics: setupMetrics(1, "", "", ""),
+	}
+	config := &Config{BodyMaxSize: 128, ValidEventNames: []string{"load", "signup"}, BatchBodyMaxSize: 512, BatchMaxAgeHours: 24}
+	sites := testSites(t, config)
+	events := make(chan PicolyticsEvent, 10)
+	eventSaver := NewAsyncEventSaver(events, nil, TestSalter{}, nil, sites, o11yMock)
+	trackers := NewTrackers(config, eventSaver, sites, o11yMock)
+	e := echo.New()
+
+	hourAgo := time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+	tests := []struct {
+		name         string
+		body         string
+		expectedCode int
+		expectedBody string
+		wantCreated  []time.Time // zero for now
+	}{
+		{
+			name: "array",
+			body: `[{"n":"load","l":"https://example.com/","t":` + strconv.FormatInt(hourAgo.UnixMilli(), 10) + `},` +
+				`{"n":"nope","l":"https://example.com/"},` +
+				`{"n":"signup","l":"https://example.com/","t":4102444800000}]`,
+			expectedCode: http.StatusAccepted,
+			expectedBody: `{"accepted":2,"rejected":1,"results":[{"accepted":true},{"accepted":false,"error":"invalid event name: nope"},{"accepted":true}]}`,
+			wantCreated:  []time.Time{hourAgo, {}},
+		},
+		{
+			name: "ndjson",
+			body: `{"n":"load","l":"https://example.com/a","t":1}` + "\n\n" +
+				`{invalid json}` + "\n" +
+				`{"n":"load","l":"https://example.com/b","r":"https://www.google.com/search?q=picolytics+batch+ingestion+with+a+long+referrer+that+is+over+the+limit"}` + "\n" +
+				`{"n":"load","l":"https://example.com/c"}`,
+			expectedCode: http.StatusAccepted,
+			expectedBody: `{"accepted":2,"rejected":2,"results":[{"accepted":true},{"accepted":false,"error":"invalid event data"},` +
+				`{"accepted":false,"error":"event too large"},{"accepted":true}]}`,
+			wantCreated: []time.Time{time.Now().Add(-24 * time.Hour), {}},
+		},
+		{
+			name:         "too large",
+			body:         "[" + strings.Repeat(`{"n":"load","l":"https://example.com/"},`, 20) + "]",
+			expectedCode: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:         "empty",
+			body:         " \n",
+			expectedCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/p/batch", strings.NewReader(tt.body))
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+
+			err := trackers.recordPicolyticsBatch(&mockEchoContext{Context: c, request: req})
+			if len(tt.expectedBody) < 1 {
+				var httpErr *echo.HTTPError
+				if assert.ErrorAs(t, err, &httpErr) {
+					assert.Equal(t, tt.expectedCode, httpErr.Code)
+				}
+				assert.Empty(t, events)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedCode, rec.Code)
+			assert.JSONEq(t, tt.expectedBody, rec.Body.String())
+			assert.Len(t, events, len(tt.wantCreated))
+			for _, want := range tt.wantCreated {
+				event := <-events
+				if want.IsZero() {
+					want = time.Now()
+				}
+				assert.WithinDuration(t, want, event.Created, time.Second)
+			}
+		})
+	}
+}
+
+func TestRecordPicolyticsBatchRateLimit(t *testing.T) {
+	o11yMock := &PicolyticsO11y{
+		Logger:  slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError})),
+		Metrics: setupMetrics(1, "", "", ""),
+	}
+	config := &Config{
+		BodyMaxSize: 128, ValidEventNames: []string{"load"}, BatchBodyMaxSize: 512, BatchMaxAgeHours: 24,
+		Sites: []SiteConfig{{Domain: "example.com", RequestRateLimit: 1}, {Domain: "other.example.com"}},
+	}
+	sites := testSites(t, config)
+	events := make(chan PicolyticsEvent, 10)
+	eventSaver := NewAsyncEventSaver(events, nil, TestSalter{}, nil, sites, o11yMock)
+	trackers := NewTrackers(config, eventSaver, sites, o11yMock)
+	e := echo.New()
+
+	tests := []struct {
+		name         string
+		body         string
+		expectedBody string
+		wantDrops    float64
+	}{
+		{
+			name:         "limit applies once per batch",
+			body:         `[{"n":"load","l":"https://example.com/a"},{"n":"load","l":"https://example.com/b"}]`,
+			expectedBody: `{"accepted":2,"rejected":0,"results":[{"accepted":true},{"accepted":true}]}`,
+		},
+		{
+			name: "limited",
+			body: `[{"n":"load","l":"https://example.com/a"},{"n":"load","l":"https://other.example.com/"},{"n":"load","l":"https://example.com/b"}]`,
+			expectedBody: `{"accepted":1,"rejected":2,"results":[{"accepted":false,"error":"rate limit exceeded"},{"accepted":true},` +
+				`{"accepted":false,"error":"rate limit exceeded"}]}`,
+			wantDrops: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/p/batch", strings.NewReader(tt.body))
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+			drops := getCounterValue(o11yMock.Metrics.rateLimiterDrops)
+
+			err := trackers.recordPicolyticsBatch(&mockEchoContext{Context: c, request: req})
+			assert.NoError(t, err)
+			assert.Equal(t, http.StatusAccepted, rec.Code)
+			assert.JSONEq(t, tt.expectedBody, rec.Body.String())
+			assert.Equal(t, tt.wantDrops, getCounterValue(o11yMock.Metrics.rateLimiterDrops)-drops)
+			for len(events) > 0 {
+				<-events
+			}
+		})
+	}
+}
@@ -1,85 +1,291 @@
 package picolytics
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/oschwald/maxminddb-golang"
 )
 
 type Worker struct {
 	events chan PicolyticsEvent
+	spool  *Spool
 	config *Config
-	pool   PgxIface
+	store  EventStore
 	o11y   *PicolyticsO11y
+	ch     *ClickHouseWriter // nil if disabled
 	geo    *maxminddb.Reader
-	quit   chan bool
+	quit   chan context.Context
+	done   chan struct{}
+
+	attempts int                      // consecutive failed saves
+	onSaved  []func(oldest time.Time) // called with the oldest event time of each saved batch
 }
 
-func NewWorker(config *Config, pool PgxIface, o11y *PicolyticsO11y) (*Worker, error) {
+func NewWorker(config *Config, store EventStore, o11y *PicolyticsO11y) (*Worker, error) {
 	w := Worker{
 		config: config,
-		pool:   pool,
+		store:  store,
 		o11y:   o11y,
-		quit:   make(chan bool, 1),
+		quit:   make(chan context.Context, 1),
+		done:   make(chan struct{}),
 	}
 	var err error
 	w.geo, err = maxminddb.Open(config.GeoIPFile)
 	if err != nil {
 		return nil, fmt.Errorf("error opening GeoIP database: %v", err)
 	}
+	if len(config.ClickhouseURL) > 0 {
+		w.ch, err = NewClickHouseWriter(config, o11y)
+		if err != nil {
+			return nil, fmt.Errorf("error setting up clickhouse: %v", err)
+		}
+	}
 	w.events = make(chan PicolyticsEvent, config.QueueSize)
+	if len(config.SpoolDir) > 0 {
+		w.spool, err = NewSpool(config.SpoolDir, config.SpoolMaxBytes, config.SpoolSegmentBytes, o11y)
+		if err != nil {
+			return nil, fmt.Errorf("error opening event spool: %v", err)
+		}
+		w.spool.prepare = w.prepareEvent
+	}
 	return &w, nil
 }
 
-func (w *Worker) Shutdown() {
-	w.quit <- true
+// Shutdown stops the worker after draining queued events to the database, and
+// waits for it to finish. Draining stops when ctx is done.
+func (w *Worker) Shutdown(ctx context.Context) {
+	w.quit <- ctx
+	<-w.done
 }
 
 func (w *Worker) processQueuedEvents() {
+	defer close(w.done)
+	defer w.geo.Close()
 	toProcess := []PicolyticsEvent{}
 	ticker := time.NewTicker(time.Duration(w.config.BatchMaxMsec) * time.Millisecond)
 	defer ticker.Stop()
+	if w.spool != nil {
+		go w.spool.feed(w.events)
+		defer w.spool.close()
+	}
 
 	for {
 		select {
 		case e := <-w.events:
 			w.o11y.Metrics.queueUtilization.Set(float64(len(w.events)))
-			if err := enrichEvent(&e, w.geo); err != nil {
-				w.o11y.Metrics.eventErrors.WithLabelValues("enrich").Add(1)
-				w.o11y.Logger.Warn("Error enriching event - saving anyway", "error", err)
-			}
-			e.ClientIpDONOTSTORE = "" // explicitly never store client IP
-			e.UaDONOTSTORE = ""       // explicitly never store useragent
-
-			toProcess = append(toProcess, e)
+			toProcess = append(toProcess, w.queuedEvent(e))
 			if len(toProcess) >= w.config.BatchMaxSize {
 				ticker.Reset(time.Duration(w.config.BatchMaxMsec) * time.Millisecond)
-				if err := w.processBatch(&toProcess, "BatchMaxSize"); err != nil {
-					w.o11y.Logger.Error("error saving queue events to db", "events", len(toProcess), "error", err)
-					w.o11y.Metrics.eventErrors.WithLabelValues("save").Add(1)
+				if !w.saveBatch(&toProcess, "BatchMaxSize") {
+					return
 				}
 			}
 		case <-ticker.C:
 			w.o11y.Metrics.queueUtilization.Set(float64(len(w.events)))
 			if len(toProcess) > 0 {
-				if err := w.processBatch(&toProcess, "BatchMaxMsec"); err != nil {
-					w.o11y.Logger.Error("error saving queue events to db", "events", len(toProcess), "error", err)
-					w.o11y.Metrics.eventErrors.WithLabelValues("save").Add(1)
+				if !w.saveBatch(&toProcess, "BatchMaxMsec") {
+					return
 				}
 			}
-		case <-w.quit:
-			w.geo.Close()
+		case ctx := <-w.quit:
+			w.drain(ctx, &toProcess)
 			return
 		}
 	}
 }
 
-func (w *Worker) processBatch(toProcess *[]PicolyticsEvent, reason string) error {
+func (w *Worker) prepareEvent(e PicolyticsEvent) PicolyticsEvent {
+	if err := enrichEvent(&e, w.geo); err != nil {
+		w.o11y.Metrics.eventErrors.WithLabelValues("enrich").Add(1)
+		w.o11y.Logger.Warn("Error enriching event - saving anyway", "error", err)
+	}
+	e.ClientIpDONOTSTORE = "" // explicitly never store client IP
+	e.UaDONOTSTORE = ""       // explicitly never store useragent
+	return e
+}
+
+// queuedEvent prepares an event read from the queue, unless it was prepared before it was spooled.
+// Events spooled by older versions still have the client IP and user agent.
+func (w *Worker) queuedEvent(e PicolyticsEvent) PicolyticsEvent {
+	if w.spool != nil && len(e.ClientIpDONOTSTORE) == 0 && len(e.UaDONOTSTORE) == 0 {
+		return e
+	}
+	return w.prepareEvent(e)
+}
+
+// drain saves the pending batch and the rest of the queue, in batches, until the queue
+// is empty or ctx is done. With a spool, the spool stops feeding the queue first, and
+// unsaved events stay spooled for replay at startup instead of being dropped.
+func (w *Worker) drain(ctx context.Context, toProcess *[]PicolyticsEvent) {
+	if w.spool != nil {
+		w.spool.close()
+	}
+	start := time.Now()
+	saved := 0
+	var err error
+	for ctx.Err() == nil {
+		for len(*toProcess) < w.config.BatchMaxSize && len(w.events) > 0 {
+			*toProcess = append(*toProcess, w.queuedEvent(<-w.events))
+		}
+		if len(*toProcess) < 1 {
+			break
+		}
+		batchSize := len(*toProcess)
+		dead := 0
+		if err = w.processBatch(ctx, toProcess, "drain"); err != nil {
+			w.o11y.Metrics.eventErrors.WithLabelValues("save").Add(1)
+			if permanentError(err) {
+				dead, err = w.saveEach(ctx, toProcess, "drain")
+			}
+		}
+		saved += batchSize - len(*toProcess) - dead
+		if err != nil {
+			break
+		}
+	}
+	w.o11y.Metrics.queueUtilization.Set(float64(len(w.events)))
+	w.o11y.Metrics.drainedEvents.Add(float64(saved))
+	remaining := len(*toProcess) + len(w.events)
+	if remaining < 1 {
+		w.o11y.Logger.Info("Drained event queue", "saved", saved, "duration", time.Since(start))
+		return
+	}
+	if w.spool != nil {
+		w.o11y.Logger.Warn("Event queue not drained, unsaved events remain spooled", "saved", saved, "spooled", remaining, "error", err, "timeout", ctx.Err())
+		return
+	}
+	w.o11y.Metrics.drainDroppedEvents.Add(float64(remaining))
+	w.o11y.Logger.Error("Event queue not drained, dropping events", "saved", saved, "dropped", remaining, "error", err, "timeout", ctx.Err())
+}
+
+// saveBatch saves a batch, returning false if the worker should quit.
+// With a spool, failed batches are retried with backoff until they succeed, so memory
+// use stays bounded while the spool absorbs incoming events. Without a spool, they're
+// retried along with the next batch. Batches rejected by the database are saved one
+// event at a time, and the rejected events are dead-lettered, so one bad event can't
+// block the queue.
+func (w *Worker) saveBatch(toProcess *[]PicolyticsEvent, reason string) bool {
+	for {
+		err := w.processBatch(context.Background(), toProcess, reason)
+		if err == nil {
+			w.attempts = 0
+			return true
+		}
+		w.o11y.Logger.Error("error saving queue events to db", "events", len(*toProcess), "error", err)
+		w.o11y.Metrics.eventErrors.WithLabelValues("save").Add(1)
+		if permanentError(err) {
+			if _, err = w.saveEach(context.Background(), toProcess, reason); err == nil {
+				w.attempts = 0
+				return true
+			}
+		}
+		w.attempts++
+		if w.spool == nil {
+			return true
+		}
+		select {
+		case <-time.After(backoffWithJitter(w.attempts - 1)):
+		case <-w.quit:
+			return false // unsaved events remain in the spool
+		}
+	}
+}
+
+// saveEach saves a rejected batch one event at a time, dead-lettering the events that
+// are rejected, and returns how many were. It stops at the first error that might
+// succeed if retried, leaving the unsaved events in the batch.
+func (w *Worker) saveEach(ctx context.Context, toProcess *[]PicolyticsEvent, reason string) (dead int, err error) {
+	for len(*toProcess) > 0 {
+		event := (*toProcess)[:1:1]
+		if err := w.processBatch(ctx, &event, reason); err != nil {
+			if !permanentError(err) {
+				return dead, err
+			}
+			w.deadLetter(event, err)
+			dead++
+		}
+		*toProcess = (*toProcess)[1:]
+	}
+	return dead, nil
+}
+
+// deadLetter gives up on events that can't be saved. With a spool, they're written to
+// its dead letter file and acknowledged, so they aren't replayed. Otherwise they're dropped.
+func (w *Worker) deadLetter(events []PicolyticsEvent, cause error) {
+	w.o11y.Metrics.eventErrors.WithLabelValues("dead_letter").Add(float64(len(events)))
+	if w.spool == nil {
+		w.o11y.Logger.Error("Dropping events that can't be saved", "events", len(events), "error", cause)
+		return
+	}
+	if err := w.spool.deadLetter(events, cause); err != nil {
+		w.o11y.Logger.Error("error dead-lettering events, dropping", "events", len(events), "error", err)
+	} else {
+		w.o11y.Logger.Error("Dead-lettered events that can't be saved", "events", len(events), "error", cause)
+	}
+	if err := w.spool.ack(events[len(events)-1].spoolPos); err != nil {
+		w.o11y.Logger.Warn("error acknowledging spooled events", "error", err)
+	}
+}
+
+// permanentError reports whether the database rejected a batch, so retrying it won't help
+func permanentError(err error) bool {
+	var chErr clickhouseClientError
+	if errors.As(err, &chErr) {
+		return true
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		// class 22 is data exceptions, and class 23 is integrity constraint violations
+		return strings.HasPrefix(pgErr.Code, "22") || strings.HasPrefix(pgErr.Code, "23")
+	}
+	return false
+}
+
+func (w *Worker) processBatch(ctx context.Context, toProcess *[]PicolyticsEvent, reason string) error {
 	w.o11y.Logger.Debug("saving queue events to db", "events", len(*toProcess), "reason", reason)
-	if err := w.saveEvents(*toProcess); err != nil {
+	start := time.Now()
+	// When events are only saved to ClickHouse, it's written first, since it deduplicates
+	// batches that are retried. Otherwise postgres comes first, and a ClickHouse failure
+	// doesn't stop events being saved to it.
+	if w.ch != nil && w.config.ClickhouseEventsOnly {
+		if err := w.ch.writeEvents(ctx, *toProcess); err != nil {
+			return err
+		}
+	}
+	if err := w.store.SaveEvents(ctx, *toProcess); err != nil {
 		return err
 	}
+	if w.ch != nil && !w.config.ClickhouseEventsOnly {
+		if err := w.ch.writeEvents(ctx, *toProcess); err != nil {
+			w.o11y.Metrics.eventErrors.WithLabelValues("clickhouse").Add(float64(len(*toProcess)))
+			w.o11y.Logger.Error("error saving events to clickhouse, skipping", "events", len(*toProcess), "error", err)
+		}
+	}
+	oldest := (*toProcess)[0].Created
+	for _, e := range *toProcess {
+		if e.Created.Before(oldest) {
+			oldest = e.Created
+		}
+		w.o11y.Metrics.ingestLatency.WithLabelValues(e.Domain).Observe(float64(time.Since(e.Created).Seconds()))
+		w.o11y.Metrics.workerLatency.WithLabelValues(e.Domain).Observe(float64(time.Since(start).Seconds()))
+		w.o11y.Metrics.observeVitals(&e)
+		if e.Name == "error" {
+			w.o11y.Metrics.jsErrors.WithLabelValues(e.Domain).Inc()
+		}
+	}
+	for _, onSaved := range w.onSaved {
+		onSaved(oldest)
+	}
+	if w.spool != nil {
+		if err := w.spool.ack((*toProcess)[len(*toProcess)-1].spoolPos); err != nil {
+			w.o11y.Logger.Warn("error acknowledging spooled events", "error", err)
+		}
+	}
 	*toProcess = []PicolyticsEvent{}
 	return nil
 }
@@ -3,34 +3,18 @@ package picolytics
 import (
 	"context"
 	"fmt"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
-	"github.com/jackc/pgx/v5"
+	"github.com/cespare/xxhash"
 	"github.com/jackc/pgx/v5/pgtype"
 
 	"github.com/nmcclain/picolytics/picolytics/db"
+	"github.com/nmcclain/picolytics/picolytics/dbtypes"
 )
 
-func (w *Worker) saveEvents(events []PicolyticsEvent) error {
-	start := time.Now()
-	ctx := context.Background()
-	client := db.New(w.pool)
-	eventDomains, err := upsertDomains(ctx, client, events)
-	if err != nil {
-		return err
-	}
-
-	eventSessions, err := upsertSessions(ctx, w.pool, client, events, eventDomains, w.config.SessionTimeoutMin)
-	if err != nil {
-		return err
-	}
-
-	if err := createEvents(ctx, client, events, eventDomains, *eventSessions, w.o11y.Metrics, start); err != nil {
-		return err
-	}
-	return nil
-}
-
 type EventDomains map[string]int32
 
 func upsertDomains(ctx context.Context, client *db.Queries, events []PicolyticsEvent) (EventDomains, error) {
@@ -42,106 +26,273 @@ func upsertDomains(ctx context.Context, client *db.Queries, events []PicolyticsE
 	for domain := range eventDomains {
 		domainID, err := client.UpsertDomain(ctx, domain)
 		if err != nil {
-			return nil, fmt.Errorf("error upserting domain %s: %v", domain, err)
+			return nil, fmt.Errorf("error upserting domain %s: %w", domain, err)
 		}
 		eventDomains[domain] = domainID
 	}
 	return eventDomains, nil
 }
 
-type EventSessions map[string]int64
+// EventSessions is the session ID of each event in a batch
+type EventSessions []int64
 
-func upsertSessions(ctx context.Context, pool PgxIface, client *db.Queries, events []PicolyticsEvent, domains EventDomains, sessionTimeoutMin int) (*EventSessions, error) {
-	eventSessions := EventSessions{} // visitorID-> sessionID
-	for _, e := range events {
-		tx, err := pool.Begin(ctx)
-		if err != nil {
-			return nil, fmt.Errorf("error beginning transaction: %v", err)
-		}
+// visitorEvents summarizes a visitor's events in a batch that belong to one session
+type visitorEvents struct {
+	first             PicolyticsEvent // static values from earliest event
+	exitPath          string
+	engaged           bool  // any engaged event
+	engagedAfterEntry bool  // any engaged event after the first
+	engagedMs         int32 // total engagement time reported in the batch
+	firstTime         time.Time
+	lastTime          time.Time
+	events            []int // indexes of the events in the batch
+	round             int   // the visitor's earlier sessions in the batch
+}
 
-		txClient := client.WithTx(tx)
-		sessionID, err := txClient.GetSession(ctx, db.GetSessionParams{
-			VisitorID: newPGText(e.VisitorID),
-			Column2:   pgtype.Interval{Microseconds: int64(sessionTimeoutMin) * 1000 * 1000 * 60, Valid: true},
+// groupVisitors groups a batch of events by visitor, in order of each visitor's first event.
+// Each visitor's events are sorted by time, and split where they're further apart than the
+// site's session timeout, e.g. after the spool is replayed, so each group is one session.
+func groupVisitors(events []PicolyticsEvent, sites *Sites) []*visitorEvents {
+	visitorIDs := []string{}
+	byID := map[string][]int{} // visitorID -> event indexes
+	for i, e := range events {
+		if _, ok := byID[e.VisitorID]; !ok {
+			visitorIDs = append(visitorIDs, e.VisitorID)
+		}
+		byID[e.VisitorID] = append(byID[e.VisitorID], i)
+	}
+	visitors := []*visitorEvents{}
+	for _, visitorID := range visitorIDs {
+		indexes := byID[visitorID]
+		sort.SliceStable(indexes, func(a, b int) bool {
+			return events[indexes[a]].Created.Before(events[indexes[b]].Created)
 		})
-		if err != nil {
-			if err != pgx.ErrNoRows {
-				_ = tx.Rollback(ctx)
-				return nil, fmt.Errorf("error getting session: %v", err)
+		timeout := time.Duration(sites.sessionTimeoutMin(events[indexes[0]].Domain)) * time.Minute
+		var v *visitorEvents
+		for _, i := range indexes {
+			e := events[i]
+			if v != nil && e.Created.Sub(v.lastTime) <= timeout { // values updated with each event
+				v.exitPath = e.Path
+				v.lastTime = e.Created
+				if engagedEvent(e.Name) {
+					v.engaged = true
+					v.engagedAfterEntry = true
+				}
+				v.engagedMs += e.EngagedMs
+				v.events = append(v.events, i)
+				continue
 			}
-			sessionID, err = txClient.CreateSession(ctx, db.CreateSessionParams{
-				DomainID:       domains[e.Domain],
-				VisitorID:      newPGText(e.VisitorID),
-				EntryPath:      e.Path,
-				ExitPath:       e.Path,
-				Country:        newPGText(e.Country),
-				Latitude:       newPGFloat8(e.Latitude),
-				Longitude:      newPGFloat8(e.Longitude),
-				Subdivision:    newPGText(e.Subdivision),
-				City:           newPGText(e.City),
-				Browser:        newPGText(e.Browser),
-				BrowserVersion: newPGText(e.BrowserVersion),
-				Os:             newPGText(e.Os),
-				OsVersion:      newPGText(e.OsVersion),
-				Platform:       newPGText(e.Platform),
-				DeviceType:     newPGText(e.DeviceType),
-				Bot:            e.Bot,
-				ScreenW:        newPGInt4(e.ScreenW),
-				ScreenH:        newPGInt4(e.ScreenH),
-				Timezone:       newPGText(e.Timezone),
-				PixelRatio:     newPGFloat8(e.PixelRatio),
-				PixelDepth:     newPGInt4(e.PixelDepth),
-				UtmSource:      newPGText(e.UtmSource),
-				UtmMedium:      newPGText(e.UtmMedium),
-				UtmTerm:        newPGText(e.UtmTerm),
-				UtmContent:     newPGText(e.UtmContent),
-				UtmCampaign:    newPGText(e.UtmCampaign),
-			})
-			if err != nil {
-				_ = tx.Rollback(ctx)
-				return nil, fmt.Errorf("error creating session: %v", err)
+			round := 0
+			if v != nil {
+				round = v.round + 1
 			}
-		} else {
-			if err := txClient.UpdateSession(ctx, db.UpdateSessionParams{ // updated_at and duration are updated by the db
-				ID:        sessionID,
-				ExitPath:  e.Path,
-				EventName: e.Name, // the event name is used to determine if "bounce" should be set
-			}); err != nil {
-				_ = tx.Rollback(ctx)
-				return nil, fmt.Errorf("error updating session: %v", err)
+			v = &visitorEvents{
+				first:     e,
+				exitPath:  e.Path,
+				engaged:   engagedEvent(e.Name),
+				engagedMs: e.EngagedMs,
+				firstTime: e.Created,
+				lastTime:  e.Created,
+				events:    []int{i},
+				round:     round,
 			}
+			visitors = append(visitors, v)
+		}
+	}
+	return visitors
+}
+
+// upsertSessions resolves the session for each visitor in the batch: events are grouped
+// by visitor, existing sessions are updated, and new sessions are created. Each statement
+// upserts one session per visitor, so it's usually a single statement, but a visitor with
+// several sessions in the batch takes one statement per session, in time order.
+// If maxSessionLength is positive, sessions that started longer ago aren't extended.
+func upsertSessions(ctx context.Context, client *db.Queries, events []PicolyticsEvent, domains EventDomains, sites *Sites, maxSessionLength time.Duration) (EventSessions, error) {
+	eventSessions := make(EventSessions, len(events))
+	rounds := [][]*visitorEvents{}
+	for _, v := range groupVisitors(events, sites) {
+		if v.round >= len(rounds) {
+			rounds = append(rounds, []*visitorEvents{})
+		}
+		rounds[v.round] = append(rounds[v.round], v)
+	}
+	for _, visitors := range rounds {
+		if err := upsertVisitorSessions(ctx, client, visitors, domains, sites, maxSessionLength, eventSessions); err != nil {
+			return nil, err
+		}
+	}
+	return eventSessions, nil
+}
+
+// upsertVisitorSessions upserts the sessions of distinct visitors with a single statement
+func upsertVisitorSessions(ctx context.Context, client *db.Queries, visitors []*visitorEvents, domains EventDomains, sites *Sites, maxSessionLength time.Duration, eventSessions EventSessions) error {
+	params := db.UpsertSessionsParams{
+		CreatedAfter: pgtype.Timestamptz{InfinityModifier: pgtype.NegativeInfinity, Valid: true},
+	}
+	var createdAfter time.Time
+	for _, v := range visitors {
+		e := v.first
+		start := v.firstTime.Add(-time.Duration(sites.sessionTimeoutMin(e.Domain))*time.Minute - maxSessionLength)
+		if createdAfter.IsZero() || start.Before(createdAfter) {
+			createdAfter = start
+		}
+		params.VisitorIds = append(params.VisitorIds, e.VisitorID)
+		params.DomainIds = append(params.DomainIds, domains[e.Domain])
+		params.SessionTimeoutMins = append(params.SessionTimeoutMins, int32(sites.sessionTimeoutMin(e.Domain)))
+		params.FirstEventTimes = append(params.FirstEventTimes, newPGTimestamptz(v.firstTime))
+		params.LastEventTimes = append(params.LastEventTimes, newPGTimestamptz(v.lastTime))
+		params.EntryPaths = append(params.EntryPaths, e.Path)
+		params.ExitPaths = append(params.ExitPaths, v.exitPath)
+		params.Engaged = append(params.Engaged, v.engaged)
+		params.EngagedAfterEntry = append(params.EngagedAfterEntry, v.engagedAfterEntry)
+		params.EngagedMs = append(params.EngagedMs, v.engagedMs)
+		params.Countries = append(params.Countries, e.Country)
+		params.Latitudes = append(params.Latitudes, e.Latitude)
+		params.Longitudes = append(params.Longitudes, e.Longitude)
+		params.Subdivisions = append(params.Subdivisions, e.Subdivision)
+		params.Cities = append(params.Cities, e.City)
+		params.Browsers = append(params.Browsers, e.Browser)
+		params.BrowserVersions = append(params.BrowserVersions, e.BrowserVersion)
+		params.Oses = append(params.Oses, e.Os)
+		params.OsVersions = append(params.OsVersions, e.OsVersion)
+		params.Platforms = append(params.Platforms, e.Platform)
+		params.DeviceTypes = append(params.DeviceTypes, e.DeviceType)
+		params.Bots = append(params.Bots, e.Bot)
+		params.ScreenWs = append(params.ScreenWs, e.ScreenW)
+		params.ScreenHs = append(params.ScreenHs, e.ScreenH)
+		params.Timezones = append(params.Timezones, e.Timezone)
+		params.PixelRatios = append(params.PixelRatios, e.PixelRatio)
+		params.PixelDepths = append(params.PixelDepths, e.PixelDepth)
+		params.UtmSources = append(params.UtmSources, e.UtmSource)
+		params.UtmMediums = append(params.UtmMediums, e.UtmMedium)
+		params.UtmCampaigns = append(params.UtmCampaigns, e.UtmCampaign)
+		params.UtmContents = append(params.UtmContents, e.UtmContent)
+		params.UtmTerms = append(params.UtmTerms, e.UtmTerm)
+	}
+	if maxSessionLength > 0 {
+		params.CreatedAfter = newPGTimestamptz(createdAfter)
+	}
+
+	rows, err := client.UpsertSessions(ctx, params)
+	if err != nil {
+		return fmt.Errorf("error upserting sessions: %w", err)
+	}
+	sessions := map[string]int64{} // visitorID -> sessionID
+	for _, row := range rows {
+		sessions[row.VisitorID.String] = row.ID
+	}
+	if len(sessions) != len(visitors) {
+		return fmt.Errorf("error upserting sessions: got %d sessions for %d visitors", len(sessions), len(visitors))
+	}
+	for _, v := range visitors {
+		for _, i := range v.events {
+			eventSessions[i] = sessions[v.first.VisitorID]
+		}
+	}
+	return nil
+}
+
+// jsErrors summarizes a batch's occurrences of a javascript error
+type jsErrors struct {
+	fingerprint string
+	first       PicolyticsEvent // static values from first occurrence
+	latest      PicolyticsEvent // stack and path from last occurrence
+	occurrences int64
+	firstTime   time.Time
+	lastTime    time.Time
+}
+
+// jsErrorFingerprint identifies an error by where it was thrown, so its occurrences are counted together
+func jsErrorFingerprint(e PicolyticsEvent) string {
+	key := strings.Join([]string{e.Domain, e.ErrorMessage, e.ErrorSource,
+		strconv.Itoa(int(e.ErrorLine)), strconv.Itoa(int(e.ErrorColumn))}, "\x00")
+	return fmt.Sprintf("%016x", xxhash.Sum64String(key))
+}
+
+// groupJSErrors groups a batch's error events by fingerprint, in order of first occurrence
+func groupJSErrors(events []PicolyticsEvent) []*jsErrors {
+	groups := []*jsErrors{}
+	byFingerprint := map[string]*jsErrors{}
+	for _, e := range events {
+		if e.Name != "error" {
+			continue
+		}
+		fingerprint := jsErrorFingerprint(e)
+		g, ok := byFingerprint[fingerprint]
+		if !ok {
+			g = &jsErrors{fingerprint: fingerprint, first: e, firstTime: e.Created, lastTime: e.Created}
+			byFingerprint[fingerprint] = g
+			groups = append(groups, g)
+		}
+		g.latest = e
+		g.occurrences++
+		if e.Created.Before(g.firstTime) {
+			g.firstTime = e.Created
 		}
-		eventSessions[e.VisitorID] = sessionID
-		if err = tx.Commit(ctx); err != nil {
-			return nil, fmt.Errorf("error committing transaction: %v", err)
+		if e.Created.After(g.lastTime) {
+			g.lastTime = e.Created
 		}
 	}
-	return &eventSessions, nil
+	return groups
+}
+
+// upsertJSErrors adds the batch's error events to the occurrence counts of their fingerprints
+func upsertJSErrors(ctx context.Context, client *db.Queries, events []PicolyticsEvent, domains EventDomains) error {
+	for _, g := range groupJSErrors(events) {
+		if err := client.UpsertJSError(ctx, db.UpsertJSErrorParams{
+			Fingerprint: g.fingerprint,
+			DomainID:    domains[g.first.Domain],
+			Message:     g.first.ErrorMessage,
+			Source:      g.first.ErrorSource,
+			Line:        g.first.ErrorLine,
+			Col:         g.first.ErrorColumn,
+			Stack:       g.latest.ErrorStack,
+			Path:        g.latest.Path,
+			Occurrences: g.occurrences,
+			FirstSeen:   newPGTimestamptz(g.firstTime),
+			LastSeen:    newPGTimestamptz(g.lastTime),
+		}); err != nil {
+			return fmt.Errorf("error upserting js error %s: %w", g.fingerprint, err)
+		}
+	}
+	return nil
+}
+
+// engagedEvent returns true if the event means the visit is not a bounce, like a
+// pageview from single-page app navigation. Events sent as the page is hidden, and
+// errors, are not.
+func engagedEvent(name string) bool {
+	return name != "hidden" && name != "ping" && name != "vitals" && name != "engagement" && name != "error"
 }
 
 func createEvents(ctx context.Context, client *db.Queries, events []PicolyticsEvent,
 	eventDomains EventDomains,
-	eventSessions EventSessions,
-	metrics *Metrics,
-	start time.Time) error {
+	eventSessions EventSessions) error {
 	params := []db.CreateEventsParams{}
-	for _, e := range events {
+	for i, e := range events {
 		params = append(params, db.CreateEventsParams{
-			DomainID:  eventDomains[e.Domain],
-			VisitorID: e.VisitorID,
-			SessionID: eventSessions[e.VisitorID],
-			Name:      e.Name,
-			Path:      e.Path,
-			Referrer:  e.Referrer,
-			LoadTime:  e.LoadTime,
-			Ttfb:      e.TTFB,
+			DomainID:    eventDomains[e.Domain],
+			VisitorID:   e.VisitorID,
+			SessionID:   eventSessions[i],
+			Name:        e.Name,
+			Path:        e.Path,
+			Referrer:    e.Referrer,
+			LoadTime:    e.LoadTime,
+			Ttfb:        e.TTFB,
+			Props:       dbtypes.JSONB(e.Props),
+			CreatedAt:   newPGTimestamptz(e.Created),
+			Lcp:         optionalPGInt4(e.LCP),
+			Cls:         optionalPGFloat8(e.CLS),
+			Inp:         optionalPGInt4(e.INP),
+			Fcp:         optionalPGInt4(e.FCP),
+			Target:      e.Target,
+			EngagedMs:   e.EngagedMs,
+			ScrollDepth: optionalPGInt4(e.ScrollDepth),
 		})
-		metrics.ingestLatency.WithLabelValues(e.Domain).Observe(float64(time.Since(e.Created).Seconds()))
-		metrics.workerLatency.WithLabelValues(e.Domain).Observe(float64(time.Since(start).Seconds()))
 	}
 
 	if _, err := client.CreateEvents(ctx, params); err != nil {
-		return fmt.Errorf("error writing event to db: %v", err)
+		return fmt.Errorf("error writing event to db: %w", err)
 	}
 	return nil
 }
@@ -157,3 +308,23 @@ func newPGInt4(val int32) pgtype.Int4 {
 func newPGFloat8(val float64) pgtype.Float8 {
 	return pgtype.Float8{Float64: val, Valid: true}
 }
+
+// optionalPGInt4 is NULL if val is nil
+func optionalPGInt4(val *int32) pgtype.Int4 {
+	if val == nil {
+		return pgtype.Int4{}
+	}
+	return newPGInt4(*val)
+}
+
+// optionalPGFloat8 is NULL if val is nil
+func optionalPGFloat8(val *float64) pgtype.Float8 {
+	if val == nil {
+		return pgtype.Float8{}
+	}
+	return newPGFloat8(*val)
+}
+
+func newPGTimestamptz(val time.Time) pgtype.Timestamptz {
+	return pgtype.Timestamptz{Time: val, Valid: true}
+}
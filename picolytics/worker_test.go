@@ -0,0 +1,372 @@
+package picolytics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/assert"
+)
+
+// rejectingStore is a MemoryStore that fails to save any batch with an event for the rejected path
+type rejectingStore struct {
+	*MemoryStore
+	reject string
+	err    error
+	saves  int
+}
+
+func (s *rejectingStore) SaveEvents(ctx context.Context, events []PicolyticsEvent) error {
+	s.saves++
+	for _, e := range events {
+		if e.Path == s.reject {
+			return s.err
+		}
+	}
+	return s.MemoryStore.SaveEvents(ctx, events)
+}
+
+func newTestWorker(t *testing.T, config *Config, store EventStore) *Worker {
+	o11yMock := &PicolyticsO11y{
+		Logger:  slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError})),
+		Metrics: setupMetrics(1, "", "", ""),
+	}
+	config.GeoIPFile = "../etc/geoip-city-test.mmdb"
+	config.QueueSize = 10
+	config.BatchMaxSize = 10
+	if len(config.SpoolDir) > 0 {
+		config.SpoolMaxBytes = 1024 * 1024
+		config.SpoolSegmentBytes = 1024 * 1024
+	}
+	w, err := NewWorker(config, store, o11yMock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { w.geo.Close() })
+	if w.spool != nil {
+		t.Cleanup(w.spool.close)
+		go w.spool.feed(w.events)
+	}
+	return w
+}
+
+// queueTestEvents queues an event for each path, through the spool if there is one
+func queueTestEvents(t *testing.T, w *Worker, paths ...string) []PicolyticsEvent {
+	for _, path := range paths {
+		e := PicolyticsEvent{Name: "load", Domain: "example.com", VisitorID: "v1", Path: path}
+		if w.spool != nil {
+			assert.NoError(t, w.spool.append(e))
+		} else {
+			w.events <- e
+		}
+	}
+	return readSpooled(t, w.events, len(paths))
+}
+
+func savedPaths(s *MemoryStore) []string {
+	paths := []string{}
+	for _, e := range s.events {
+		paths = append(paths, e.Path)
+	}
+	return paths
+}
+
+func TestSaveBatch(t *testing.T) {
+	rejected := fmt.Errorf("error writing event to db: %w", &pgconn.PgError{Code: "22021", Message: "invalid byte sequence"})
+	unavailable := errors.New("connection refused")
+	tests := []struct {
+		name          string
+		spool         bool
+		quit          bool
+		err           error
+		saves         int // calls to saveBatch
+		wantSaved     []string
+		wantDead      []string
+		wantRemaining int
+		wantAttempts  int // store saves, unchecked if zero
+	}{
+		{
+			name:         "rejected event is dead-lettered, and the rest of the batch saved",
+			spool:        true,
+			err:          rejected,
+			saves:        1,
+			wantSaved:    []string{"/one", "/three"},
+			wantDead:     []string{"/bad"},
+			wantAttempts: 4, // batch, then each event
+		},
+		{
+			name:         "rejected event is dropped without a spool",
+			err:          rejected,
+			saves:        1,
+			wantSaved:    []string{"/one", "/three"},
+			wantDead:     []string{"/bad"},
+			wantAttempts: 4,
+		},
+		{
+			name:          "failing batch is retried until the worker quits with a spool",
+			spool:         true,
+			quit:          true,
+			err:           unavailable,
+			saves:         1,
+			wantSaved:     []string{},
+			wantRemaining: 3,
+		},
+		{
+			name:          "failing batch is kept for the next batch without a spool",
+			err:           unavailable,
+			saves:         2,
+			wantSaved:     []string{},
+			wantRemaining: 3,
+			wantAttempts:  2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &rejectingStore{MemoryStore: NewMemoryStore(testSites(t, &Config{})), reject: "/bad", err: tt.err}
+			config := &Config{}
+			if tt.spool {
+				config.SpoolDir = t.TempDir()
+			}
+			w := newTestWorker(t, config, store)
+			toProcess := queueTestEvents(t, w, "/one", "/bad", "/three")
+			last := toProcess[len(toProcess)-1]
+			if tt.quit {
+				w.quit <- context.Background()
+			}
+			for i := 0; i < tt.saves; i++ {
+				assert.Equal(t, !tt.quit, w.saveBatch(&toProcess, "test"))
+			}
+			assert.Len(t, toProcess, tt.wantRemaining)
+			if tt.wantRemaining == 0 {
+				assert.Equal(t, 0, w.attempts)
+			}
+			if tt.wantAttempts > 0 {
+				assert.Equal(t, tt.wantAttempts, store.saves)
+			}
+			assert.Equal(t, tt.wantSaved, savedPaths(store.MemoryStore))
+			m, err := w.o11y.Metrics.eventErrors.GetMetricWithLabelValues("dead_letter")
+			assert.NoError(t, err)
+			assert.Equal(t, float64(len(tt.wantDead)), getCounterValue(m))
+			if !tt.spool || len(tt.wantDead) < 1 {
+				return
+			}
+			checkpoint, err := w.spool.readCheckpoint()
+			assert.NoError(t, err)
+			assert.Equal(t, last.spoolPos, checkpoint, "dead-lettered events are acknowledged")
+			data, err := os.ReadFile(filepath.Join(config.SpoolDir, spoolDeadLetterFile))
+			assert.NoError(t, err)
+			lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+			assert.Len(t, lines, len(tt.wantDead))
+			for i, path := range tt.wantDead {
+				assert.Contains(t, lines[i], `"Path":"`+path+`"`)
+				assert.Contains(t, lines[i], `"error":"`+tt.err.Error())
+			}
+		})
+	}
+}
+
+func TestPermanentError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "clickhouse rejected query", err: fmt.Errorf("error writing events to clickhouse: %w", clickhouseClientError("400 Bad Request")), want: true},
+		{name: "data exception", err: fmt.Errorf("error upserting sessions: %w", &pgconn.PgError{Code: "22P02"}), want: true},
+		{name: "constraint violation", err: fmt.Errorf("error writing event to db: %w", &pgconn.PgError{Code: "23503"}), want: true},
+		{name: "serialization failure", err: fmt.Errorf("error writing event to db: %w", &pgconn.PgError{Code: "40001"}), want: false},
+		{name: "connection error", err: errors.New("connection refused"), want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, permanentError(tt.err))
+		})
+	}
+}
+
+func TestDrain(t *testing.T) {
+	rejected := fmt.Errorf("error writing event to db: %w", &pgconn.PgError{Code: "23514"})
+	unavailable := errors.New("connection refused")
+	tests := []struct {
+		name        string
+		spool       bool
+		err         error
+		timeout     bool
+		wantSaved   []string
+		wantDrained float64
+		wantDropped float64
+		wantSpooled int // events replayed from the spool after restart
+	}{
+		{
+			name:        "drained",
+			wantSaved:   []string{"/one", "/two", "/three"},
+			wantDrained: 3,
+		},
+		{
+			name:        "drained with spool",
+			spool:       true,
+			wantSaved:   []string{"/one", "/two", "/three"},
+			wantDrained: 3,
+		},
+		{
+			name:        "rejected event dead-lettered",
+			err:         rejected,
+			wantSaved:   []string{"/one", "/three"},
+			wantDrained: 2,
+		},
+		{
+			name:        "save failure drops events",
+			err:         unavailable,
+			wantSaved:   []string{},
+			wantDropped: 3,
+		},
+		{
+			name:        "save failure leaves events spooled",
+			spool:       true,
+			err:         unavailable,
+			wantSaved:   []string{},
+			wantSpooled: 3,
+		},
+		{
+			name:        "timeout drops events",
+			timeout:     true,
+			wantSaved:   []string{},
+			wantDropped: 3,
+		},
+		{
+			name:        "timeout leaves events spooled",
+			spool:       true,
+			timeout:     true,
+			wantSaved:   []string{},
+			wantSpooled: 3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &rejectingStore{MemoryStore: NewMemoryStore(testSites(t, &Config{})), err: tt.err}
+			if tt.err != nil {
+				store.reject = "/two"
+			}
+			config := &Config{}
+			if tt.spool {
+				config.SpoolDir = t.TempDir()
+			}
+			w := newTestWorker(t, config, store)
+			w.config.BatchMaxSize = 2
+			// one event is pending in a batch, and the rest are still queued
+			events := queueTestEvents(t, w, "/one", "/two", "/three")
+			toProcess := events[:1]
+			for _, e := range events[1:] {
+				w.events <- e
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.timeout {
+				cancel()
+			}
+			w.drain(ctx, &toProcess)
+
+			assert.Equal(t, tt.wantSaved, savedPaths(store.MemoryStore))
+			assert.Equal(t, tt.wantDrained, getCounterValue(w.o11y.Metrics.drainedEvents))
+			assert.Equal(t, tt.wantDropped, getCounterValue(w.o11y.Metrics.drainDroppedEvents))
+			if !tt.spool {
+				return
+			}
+			restarted := newTestSpool(t, config.SpoolDir, 1024*1024, 1024*1024)
+			replayed := make(chan PicolyticsEvent, 10)
+			go restarted.feed(replayed)
+			defer restarted.close()
+			readSpooled(t, replayed, tt.wantSpooled)
+			select {
+			case e := <-replayed:
+				t.Errorf("unexpected replayed event: %s", e.Path)
+			case <-time.After(50 * time.Millisecond):
+			}
+		})
+	}
+}
+
+func TestProcessBatchClickHouse(t *testing.T) {
+	tests := []struct {
+		name           string
+		eventsOnly     bool
+		storeErr       error
+		chFails        bool
+		wantErr        bool
+		wantSaved      []string
+		wantInserts    int
+		wantChFailures float64
+	}{
+		{
+			name:        "saved to both",
+			wantSaved:   []string{"/one", "/two"},
+			wantInserts: 1,
+		},
+		{
+			name:           "clickhouse failure doesn't block postgres",
+			chFails:        true,
+			wantSaved:      []string{"/one", "/two"},
+			wantChFailures: 2,
+		},
+		{
+			name:      "postgres failure skips clickhouse",
+			storeErr:  errors.New("connection refused"),
+			wantErr:   true,
+			wantSaved: []string{},
+		},
+		{
+			name:       "clickhouse failure fails batch when events are only in clickhouse",
+			eventsOnly: true,
+			chFails:    true,
+			wantErr:    true,
+			wantSaved:  []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeClickHouse{failureStatus: http.StatusBadRequest}
+			server := httptest.NewServer(fake)
+			defer server.Close()
+			store := &rejectingStore{MemoryStore: NewMemoryStore(testSites(t, &Config{})), reject: "/two", err: tt.storeErr}
+			if tt.storeErr == nil {
+				store.reject = ""
+			}
+			w := newTestWorker(t, &Config{ClickhouseURL: server.URL, ClickhouseEventsOnly: tt.eventsOnly}, store)
+			if tt.chFails {
+				fake.failInserts = 1
+			}
+			toProcess := queueTestEvents(t, w, "/one", "/two")
+			err := w.processBatch(context.Background(), &toProcess, "test")
+			assert.Equal(t, tt.wantErr, err != nil, "unexpected error: %v", err)
+			assert.Equal(t, tt.wantSaved, savedPaths(store.MemoryStore))
+			assert.Len(t, fake.inserts, tt.wantInserts)
+			m, err := w.o11y.Metrics.eventErrors.GetMetricWithLabelValues("clickhouse")
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantChFailures, getCounterValue(m))
+		})
+	}
+}
+
+func TestProcessBatchOnSaved(t *testing.T) {
+	store := NewMemoryStore(testSites(t, &Config{}))
+	w := newTestWorker(t, &Config{}, store)
+	got := []time.Time{}
+	w.onSaved = append(w.onSaved, func(oldest time.Time) { got = append(got, oldest) })
+	now := time.Now()
+	toProcess := []PicolyticsEvent{
+		{Name: "load", Domain: "example.com", VisitorID: "v1", Path: "/one", Created: now},
+		{Name: "load", Domain: "example.com", VisitorID: "v2", Path: "/two", Created: now.Add(-time.Hour)},
+		{Name: "load", Domain: "example.com", VisitorID: "v1", Path: "/three", Created: now.Add(-time.Minute)},
+	}
+	assert.NoError(t, w.processBatch(context.Background(), &toProcess, "test"))
+	assert.Equal(t, []time.Time{now.Add(-time.Hour)}, got)
+}